@@ -1,6 +1,316 @@
 package base
 
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	log "stupid-kv/logutil"
+	"time"
+)
+
 type KeyT string
 type ValueT int
 
 type Tid int64
+
+const (
+	FsyncAlways = "always" // fsync every persisted file after writing it
+	FsyncNone   = "none"   // leave it to the os page cache
+)
+
+const (
+	EngineMemory = "memory" // every version in memory, rewritten to DATA.bin on flush
+	EngineLSM    = "lsm"    // log structured merge tree in <data_dir>/lsm
+	EngineBTree  = "btree"  // paged b+tree in <data_dir>/btree
+)
+
+// Config holds the server settings, tagged with the key used in config files.
+// The environment variable for a key is STUPIDKV_ followed by the upper-cased key.
+type Config struct {
+	DataDir     string        `config:"data_dir"`
+	RespAddr    string        `config:"resp_addr"`
+	HttpAddr    string        `config:"http_addr"`
+	GrpcAddr    string        `config:"grpc_addr"`
+	Fsync       string        `config:"fsync"`
+	Engine      string        `config:"storage_engine"`
+	GCInterval  time.Duration `config:"gc_interval"`  // 0 disables mvcc gc
+	LockTimeout time.Duration `config:"lock_timeout"` // 10s by default, an explicit 0 waits forever
+	LogLevel    string        `config:"log_level"`
+	LogLevels   string        `config:"log_levels"` // per package, e.g. "txn=debug,lsm=warning"
+	LogFormat   string        `config:"log_format"` // text or json
+
+	LogFile           string        `config:"log_file"`            // logs go here instead of stdout and stderr
+	LogMaxSize        int64         `config:"log_max_size"`        // rotate the log file before it grows past it, 0 never
+	LogRotateInterval time.Duration `config:"log_rotate_interval"` // rotate the log file this often, 0 never
+	LogMaxAge         time.Duration `config:"log_max_age"`         // remove rotated log files older than it, 0 keeps them
+	LogMaxBackups     int           `config:"log_max_backups"`     // rotated log files kept, 0 keeps all
+	LogCompress       bool          `config:"log_compress"`        // gzip rotated log files
+
+	BlockCacheSize int64 `config:"block_cache_size"` // bytes of disk blocks or pages cached, or with a KB/MB/GB suffix
+
+	TxnIdleTimeout time.Duration `config:"txn_idle_timeout"` // http txn sessions
+
+	SlowTxnThreshold time.Duration `config:"slow_txn_threshold"` // log txns open longer, 0 disables
+	SlowOpThreshold  time.Duration `config:"slow_op_threshold"`  // log txn ops slower, 0 disables
+
+	NodeId        string `config:"node_id"`        // raft server id, raft_addr if empty
+	RaftAddr      string `config:"raft_addr"`      // empty runs a single node without raft
+	RaftJoin      string `config:"raft_join"`      // http addr of the leader to join
+	RaftBootstrap bool   `config:"raft_bootstrap"` // start a new cluster with this node
+
+	Shards string `config:"shards"` // comma separated grpc addrs the router spreads keys over
+
+	ReplAddr      string `config:"repl_addr"`      // a primary streams its commits to replicas here
+	ReplicateFrom string `config:"replicate_from"` // repl_addr of the primary, makes this node a replica
+
+	CDCFile      string        `config:"cdc_file"`      // the cdc log of change events as json lines, relative to data_dir
+	CDCRetention time.Duration `config:"cdc_retention"` // drop the events older than it from the cdc log, 0 keeps all
+
+	AdminToken string `config:"admin_token"` // admin grpc calls carry it, empty takes them from this host only
+}
+
+const envPrefix = "STUPIDKV_"
+
+var config = DefaultConfig()
+
+func DefaultConfig() *Config {
+	return &Config{
+		DataDir:     ".",
+		RespAddr:    "127.0.0.1:6380",
+		HttpAddr:    "127.0.0.1:8080",
+		GrpcAddr:    "127.0.0.1:9090",
+		Fsync:       FsyncNone,
+		Engine:      EngineMemory,
+		GCInterval:  0,
+		LockTimeout: 10 * time.Second,
+		LogLevel:    "debug",
+		LogLevels:   "",
+		LogFormat:   "text",
+
+		LogFile:           "",
+		LogMaxSize:        100 << 20,
+		LogRotateInterval: 0,
+		LogMaxAge:         0,
+		LogMaxBackups:     0,
+		LogCompress:       false,
+
+		BlockCacheSize: 8 << 20,
+
+		TxnIdleTimeout: 30 * time.Second,
+
+		SlowTxnThreshold: 0,
+		SlowOpThreshold:  0,
+
+		NodeId:        "",
+		RaftAddr:      "",
+		RaftJoin:      "",
+		RaftBootstrap: false,
+
+		Shards: "",
+
+		ReplAddr:      "",
+		ReplicateFrom: "",
+
+		CDCFile:      "CDC.log",
+		CDCRetention: 7 * 24 * time.Hour,
+
+		AdminToken: "",
+	}
+}
+
+func GetConfig() *Config {
+	return config
+}
+
+func SetConfig(c *Config) {
+	config = c
+}
+
+// LoadConfig builds the effective config: defaults, then the file at path
+// (skipped if path is empty), then STUPIDKV_* environment overrides.
+func LoadConfig(path string) (*Config, error) {
+	c := DefaultConfig()
+	if path != "" {
+		if err := c.loadFile(path); err != nil {
+			return nil, err
+		}
+	}
+	for _, key := range c.keys() {
+		if value, ok := os.LookupEnv(envPrefix + strings.ToUpper(key)); ok {
+			if err := c.set(key, value); err != nil {
+				return nil, fmt.Errorf("env %v%v: %v", envPrefix, strings.ToUpper(key), err)
+			}
+		}
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Config) Validate() error {
+	if c.Fsync != FsyncAlways && c.Fsync != FsyncNone {
+		return fmt.Errorf("fsync must be %q or %q, got %q", FsyncAlways, FsyncNone, c.Fsync)
+	}
+	switch c.Engine {
+	case EngineMemory, EngineLSM, EngineBTree:
+	default:
+		return fmt.Errorf("unknown storage_engine %q", c.Engine)
+	}
+	if _, err := log.ParseLevel(c.LogLevel); err != nil {
+		return fmt.Errorf("log_level: %v", err)
+	}
+	if _, err := log.ParsePackageLevels(c.LogLevels); err != nil {
+		return fmt.Errorf("log_levels: %v", err)
+	}
+	if _, err := log.ParseFormat(c.LogFormat); err != nil {
+		return fmt.Errorf("log_format: %v", err)
+	}
+	if c.LogMaxSize < 0 || c.LogRotateInterval < 0 || c.LogMaxAge < 0 || c.LogMaxBackups < 0 {
+		return fmt.Errorf("log_max_size, log_rotate_interval, log_max_age and log_max_backups must not be negative")
+	}
+	if c.BlockCacheSize < 0 {
+		return fmt.Errorf("block_cache_size must not be negative")
+	}
+	if c.GCInterval < 0 || c.LockTimeout < 0 {
+		return fmt.Errorf("gc_interval and lock_timeout must not be negative")
+	}
+	if c.CDCFile == "" || c.CDCRetention < 0 {
+		return fmt.Errorf("cdc_file must be set and cdc_retention must not be negative")
+	}
+	if c.SlowTxnThreshold < 0 || c.SlowOpThreshold < 0 {
+		return fmt.Errorf("slow_txn_threshold and slow_op_threshold must not be negative")
+	}
+	if c.TxnIdleTimeout <= 0 {
+		return fmt.Errorf("txn_idle_timeout must be positive")
+	}
+	if c.RaftAddr == "" && (c.RaftJoin != "" || c.RaftBootstrap) {
+		return fmt.Errorf("raft_join and raft_bootstrap need raft_addr")
+	}
+	if c.RaftJoin != "" && c.RaftBootstrap {
+		return fmt.Errorf("set only one of raft_join and raft_bootstrap")
+	}
+	if c.RaftAddr != "" && (c.ReplAddr != "" || c.ReplicateFrom != "") {
+		return fmt.Errorf("raft and primary-backup replication can not be used together")
+	}
+	return nil
+}
+
+// String prints the config in the toml file format.
+func (c *Config) String() string {
+	var sb strings.Builder
+	v := reflect.ValueOf(c).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		key := v.Type().Field(i).Tag.Get("config")
+		sb.WriteString(fmt.Sprintf("%v = %q\n", key, fmt.Sprint(v.Field(i).Interface())))
+	}
+	return sb.String()
+}
+
+func (c *Config) keys() []string {
+	t := reflect.TypeOf(c).Elem()
+	keys := make([]string, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		keys = append(keys, t.Field(i).Tag.Get("config"))
+	}
+	return keys
+}
+
+func (c *Config) set(key string, value string) error {
+	v := reflect.ValueOf(c).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		if v.Type().Field(i).Tag.Get("config") != key {
+			continue
+		}
+		field := v.Field(i)
+		if field.Type() == reflect.TypeOf(time.Duration(0)) {
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return err
+			}
+			field.SetInt(int64(d))
+		} else if field.Kind() == reflect.Int64 {
+			n, err := ParseSize(value)
+			if err != nil {
+				return err
+			}
+			field.SetInt(n)
+		} else if field.Kind() == reflect.Int {
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return err
+			}
+			field.SetInt(int64(n))
+		} else if field.Kind() == reflect.Bool {
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return err
+			}
+			field.SetBool(b)
+		} else {
+			field.SetString(value)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown config key %q", key)
+}
+
+// loadFile reads flat `key = value` (toml) or `key: value` (yaml) pairs.
+// Section headers are skipped, so keys may be grouped but must stay unique.
+func (c *Config) loadFile(path string) error {
+	var sep string
+	switch filepath.Ext(path) {
+	case ".toml":
+		sep = "="
+	case ".yaml", ".yml":
+		sep = ":"
+	default:
+		return fmt.Errorf("config %v: unsupported format, use .toml or .yaml", path)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(stripComment(scanner.Text()))
+		if line == "" || line == "---" || strings.HasPrefix(line, "[") {
+			continue
+		}
+		idx := strings.Index(line, sep)
+		if idx < 0 {
+			return fmt.Errorf("config %v:%d: expected key%vvalue", path, lineNo, sep)
+		}
+		key := strings.TrimSpace(line[:idx])
+		value := strings.Trim(strings.TrimSpace(line[idx+1:]), `"'`)
+		if value == "" && sep == ":" {
+			continue // yaml mapping header
+		}
+		if err := c.set(key, value); err != nil {
+			return fmt.Errorf("config %v:%d: %v", path, lineNo, err)
+		}
+	}
+	return scanner.Err()
+}
+
+func stripComment(line string) string {
+	quoted := false
+	for i, ch := range line {
+		switch ch {
+		case '"', '\'':
+			quoted = !quoted
+		case '#':
+			if !quoted {
+				return line[:i]
+			}
+		}
+	}
+	return line
+}
@@ -1 +1,97 @@
 package base
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// DataPath returns the path of a persisted file inside the configured data dir.
+func DataPath(name string) string {
+	return filepath.Join(GetConfig().DataDir, name)
+}
+
+// TempSuffix marks the copy WriteFile writes before renaming it over the file
+const TempSuffix = ".tmp"
+
+// WriteFile replaces the file with data atomically: it writes path.tmp, renames
+// it over path and syncs the dir, so a crash leaves either the old or the new
+// content. The syncs are skipped when the fsync policy is none.
+func WriteFile(path string, data []byte) error {
+	tmp := path + TempSuffix
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if GetConfig().Fsync == FsyncAlways {
+		if err := f.Sync(); err != nil {
+			f.Close()
+			os.Remove(tmp)
+			return err
+		}
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if GetConfig().Fsync == FsyncAlways {
+		return SyncDir(filepath.Dir(path))
+	}
+	return nil
+}
+
+// SyncDir makes the creates, renames and removes of files in dir durable
+func SyncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// RemoveTempFiles deletes the copies WriteFile left in dir when it crashed
+// before the rename, the files they were meant to replace are intact.
+func RemoveTempFiles(dir string) error {
+	names, err := filepath.Glob(filepath.Join(dir, "*"+TempSuffix))
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err := os.Remove(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ParseSize reads a byte count like 4096, 64KB, 8MB or 1GB.
+func ParseSize(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	unit := int64(1)
+	for _, suffix := range []struct {
+		name string
+		unit int64
+	}{{"KB", 1 << 10}, {"MB", 1 << 20}, {"GB", 1 << 30}, {"B", 1}} {
+		if strings.HasSuffix(s, suffix.name) {
+			s, unit = strings.TrimSpace(strings.TrimSuffix(s, suffix.name)), suffix.unit
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("bad size %q", s)
+	}
+	return n * unit, nil
+}
@@ -0,0 +1,271 @@
+package btree
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"stupid-kv/base"
+)
+
+// Every page is pageSize bytes. Page 0 holds the meta, the others start
+// with a header:
+//
+//	kind u8 | unused u8 | count u16 | next u64 | crc32c u32
+//
+// leaf:      count cells of u16 key length, key, u8 overflow flag, u32 value
+//
+//	length, then the value inline or the u64 first overflow page
+//
+// internal:  u64 child, then count cells of u16 key length, key, u64 child;
+//
+//	the keys of child i+1 are >= key i
+//
+// overflow:  count bytes of a value, next is the following overflow page
+// free:      next is the following free page
+const (
+	pageSize   = 4096
+	headerSize = 16
+	bodySize   = pageSize - headerSize
+
+	maxKeySize    = 1024 // keeps at least two cells in a page
+	maxInlineSize = 512  // longer values go to overflow pages
+)
+
+const (
+	kindFree byte = iota
+	kindLeaf
+	kindInternal
+	kindOverflow
+)
+
+type pageID uint64
+
+var (
+	ErrCorrupted = errors.New("btree: corrupted page")
+	castagnoli   = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// value of a leaf cell, either inline or the first page of its overflow chain
+type value struct {
+	inline   []byte
+	overflow pageID
+	length   uint32
+}
+
+// node is a decoded page
+type node struct {
+	id       pageID
+	kind     byte
+	keys     []base.KeyT
+	values   []value  // leaf
+	children []pageID // internal, one more than keys
+	data     []byte   // overflow
+	next     pageID   // overflow and free
+}
+
+func cellSize(kind byte, key base.KeyT, v value) int {
+	if kind == kindInternal {
+		return 2 + len(key) + 8
+	}
+	if v.overflow != 0 {
+		return 2 + len(key) + 1 + 4 + 8
+	}
+	return 2 + len(key) + 1 + 4 + len(v.inline)
+}
+
+// size is the encoded size of the body
+func (n *node) size() int {
+	switch n.kind {
+	case kindLeaf:
+		size := 0
+		for i, key := range n.keys {
+			size += cellSize(kindLeaf, key, n.values[i])
+		}
+		return size
+	case kindInternal:
+		size := 8
+		for _, key := range n.keys {
+			size += cellSize(kindInternal, key, value{})
+		}
+		return size
+	case kindOverflow:
+		return len(n.data)
+	}
+	return 0
+}
+
+func (n *node) encode() []byte {
+	page := make([]byte, pageSize)
+	page[0] = n.kind
+	body := page[headerSize:headerSize]
+	count := 0
+	switch n.kind {
+	case kindLeaf:
+		count = len(n.keys)
+		for i, key := range n.keys {
+			v := n.values[i]
+			body = appendKey(body, key)
+			if v.overflow != 0 {
+				body = append(body, 1)
+				body = appendUint32(body, v.length)
+				body = appendUint64(body, uint64(v.overflow))
+			} else {
+				body = append(body, 0)
+				body = appendUint32(body, v.length)
+				body = append(body, v.inline...)
+			}
+		}
+	case kindInternal:
+		count = len(n.keys)
+		body = appendUint64(body, uint64(n.children[0]))
+		for i, key := range n.keys {
+			body = appendKey(body, key)
+			body = appendUint64(body, uint64(n.children[i+1]))
+		}
+	case kindOverflow:
+		count = len(n.data)
+		body = append(body, n.data...)
+	}
+	binary.LittleEndian.PutUint16(page[2:4], uint16(count))
+	binary.LittleEndian.PutUint64(page[4:12], uint64(n.next))
+	binary.LittleEndian.PutUint32(page[12:16], crc32.Checksum(page[headerSize:], castagnoli)^crc32.Checksum(page[:12], castagnoli))
+	return page
+}
+
+func decodeNode(id pageID, page []byte) (*node, error) {
+	if len(page) != pageSize {
+		return nil, ErrCorrupted
+	}
+	if binary.LittleEndian.Uint32(page[12:16]) != crc32.Checksum(page[headerSize:], castagnoli)^crc32.Checksum(page[:12], castagnoli) {
+		return nil, ErrCorrupted
+	}
+	n := &node{id: id, kind: page[0], next: pageID(binary.LittleEndian.Uint64(page[4:12]))}
+	count := int(binary.LittleEndian.Uint16(page[2:4]))
+	r := reader{data: page[headerSize:]}
+	switch n.kind {
+	case kindLeaf:
+		for i := 0; i < count; i++ {
+			key := r.key()
+			flag := r.byte()
+			v := value{length: r.uint32()}
+			if flag == 1 {
+				v.overflow = pageID(r.uint64())
+			} else {
+				v.inline = r.bytes(int(v.length))
+			}
+			n.keys = append(n.keys, key)
+			n.values = append(n.values, v)
+		}
+	case kindInternal:
+		n.children = append(n.children, pageID(r.uint64()))
+		for i := 0; i < count; i++ {
+			n.keys = append(n.keys, r.key())
+			n.children = append(n.children, pageID(r.uint64()))
+		}
+	case kindOverflow:
+		n.data = r.bytes(count)
+	case kindFree:
+	default:
+		return nil, ErrCorrupted
+	}
+	if r.bad {
+		return nil, ErrCorrupted
+	}
+	return n, nil
+}
+
+// meta is page 0
+type meta struct {
+	root      pageID
+	freeHead  pageID
+	pageCount uint64
+}
+
+const metaMagic = 0x73746b7662747231 // "stkvbtr1"
+
+func (m meta) encode() []byte {
+	page := make([]byte, pageSize)
+	binary.LittleEndian.PutUint64(page[0:8], metaMagic)
+	binary.LittleEndian.PutUint32(page[8:12], pageSize)
+	binary.LittleEndian.PutUint64(page[12:20], uint64(m.root))
+	binary.LittleEndian.PutUint64(page[20:28], uint64(m.freeHead))
+	binary.LittleEndian.PutUint64(page[28:36], m.pageCount)
+	binary.LittleEndian.PutUint32(page[36:40], crc32.Checksum(page[:36], castagnoli))
+	return page
+}
+
+func decodeMeta(page []byte) (meta, error) {
+	if len(page) != pageSize || binary.LittleEndian.Uint64(page[0:8]) != metaMagic ||
+		binary.LittleEndian.Uint32(page[8:12]) != pageSize ||
+		binary.LittleEndian.Uint32(page[36:40]) != crc32.Checksum(page[:36], castagnoli) {
+		return meta{}, ErrCorrupted
+	}
+	return meta{
+		root:      pageID(binary.LittleEndian.Uint64(page[12:20])),
+		freeHead:  pageID(binary.LittleEndian.Uint64(page[20:28])),
+		pageCount: binary.LittleEndian.Uint64(page[28:36]),
+	}, nil
+}
+
+func appendKey(buf []byte, key base.KeyT) []byte {
+	var tmp [2]byte
+	binary.LittleEndian.PutUint16(tmp[:], uint16(len(key)))
+	return append(append(buf, tmp[:]...), key...)
+}
+
+func appendUint32(buf []byte, v uint32) []byte {
+	var tmp [4]byte
+	binary.LittleEndian.PutUint32(tmp[:], v)
+	return append(buf, tmp[:]...)
+}
+
+func appendUint64(buf []byte, v uint64) []byte {
+	var tmp [8]byte
+	binary.LittleEndian.PutUint64(tmp[:], v)
+	return append(buf, tmp[:]...)
+}
+
+// reader decodes a page body, bad is set instead of reading past its end
+type reader struct {
+	data []byte
+	bad  bool
+}
+
+func (r *reader) bytes(n int) []byte {
+	if r.bad || n > len(r.data) {
+		r.bad = true
+		return nil
+	}
+	b := append([]byte{}, r.data[:n]...)
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *reader) byte() byte {
+	if b := r.bytes(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *reader) uint32() uint32 {
+	if b := r.bytes(4); b != nil {
+		return binary.LittleEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *reader) uint64() uint64 {
+	if b := r.bytes(8); b != nil {
+		return binary.LittleEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (r *reader) key() base.KeyT {
+	n := 0
+	if b := r.bytes(2); b != nil {
+		n = int(binary.LittleEndian.Uint16(b))
+	}
+	return base.KeyT(r.bytes(n))
+}
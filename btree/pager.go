@@ -0,0 +1,200 @@
+package btree
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"os"
+	"sort"
+	"stupid-kv/base"
+	"stupid-kv/kv"
+)
+
+// pager reads and writes the pages of the data file. Changed pages reach
+// the file through checkpoint: they are first written to the journal with a
+// commit record, then in place, then the journal is emptied. A journal with
+// a commit record is redone when the file opens, one without is ignored.
+type pager struct {
+	f         *os.File
+	journal   *os.File
+	meta      meta
+	metaDirty bool
+}
+
+// journal records are a u64 page id and the page, the commit record is
+// commitID and the u64 number of pages before it
+const commitID = ^uint64(0)
+
+func openPager(path string) (*pager, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	journal, err := os.OpenFile(path+".journal", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	p := &pager{f: f, journal: journal}
+	if err := p.redo(); err != nil {
+		p.close()
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		p.close()
+		return nil, err
+	}
+	if info.Size() == 0 {
+		// page 0 is the meta, page 1 the empty root leaf
+		p.meta = meta{root: 1, pageCount: 2}
+		root := &node{id: 1, kind: kindLeaf}
+		if _, err := f.WriteAt(p.meta.encode(), 0); err != nil {
+			p.close()
+			return nil, err
+		}
+		if _, err := f.WriteAt(root.encode(), pageSize); err != nil {
+			p.close()
+			return nil, err
+		}
+		return p, nil
+	}
+	page := make([]byte, pageSize)
+	if _, err := f.ReadAt(page, 0); err != nil {
+		p.close()
+		return nil, err
+	}
+	if p.meta, err = decodeMeta(page); err != nil {
+		p.close()
+		return nil, err
+	}
+	return p, nil
+}
+
+// redo writes the pages of a committed journal into the file
+func (p *pager) redo() error {
+	if _, err := p.journal.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	r := bufio.NewReader(p.journal)
+	pages := make(map[uint64][]byte)
+	committed := false
+	for {
+		var id [8]byte
+		if _, err := io.ReadFull(r, id[:]); err != nil {
+			break
+		}
+		if binary.LittleEndian.Uint64(id[:]) == commitID {
+			var count [8]byte
+			if _, err := io.ReadFull(r, count[:]); err == nil && binary.LittleEndian.Uint64(count[:]) == uint64(len(pages)) {
+				committed = true
+			}
+			break
+		}
+		page := make([]byte, pageSize)
+		if _, err := io.ReadFull(r, page); err != nil {
+			break
+		}
+		pages[binary.LittleEndian.Uint64(id[:])] = page
+	}
+	if committed {
+		for id, page := range pages {
+			if _, err := p.f.WriteAt(page, int64(id)*pageSize); err != nil {
+				return err
+			}
+		}
+		if err := p.f.Sync(); err != nil {
+			return err
+		}
+	}
+	if err := p.journal.Truncate(0); err != nil {
+		return err
+	}
+	_, err := p.journal.Seek(0, io.SeekStart)
+	return err
+}
+
+func (p *pager) read(id pageID) (*node, error) {
+	if id == 0 || uint64(id) >= p.meta.pageCount {
+		return nil, ErrCorrupted
+	}
+	page := make([]byte, pageSize)
+	if _, err := p.f.ReadAt(page, int64(id)*pageSize); err != nil {
+		return nil, err
+	}
+	return decodeNode(id, page)
+}
+
+// allocate takes a page from the free list, or appends one to the file
+func (p *pager) allocate(pool *bufferPool) (pageID, error) {
+	p.metaDirty = true
+	if id := p.meta.freeHead; id != 0 {
+		n, err := pool.fetch(id)
+		if err != nil {
+			return 0, err
+		}
+		p.meta.freeHead = n.next
+		pool.release(n, false)
+		return id, nil
+	}
+	id := pageID(p.meta.pageCount)
+	p.meta.pageCount++
+	return id, nil
+}
+
+// checkpoint makes the changed pages durable in the file
+func (p *pager) checkpoint(nodes []*node) error {
+	if len(nodes) == 0 && !p.metaDirty {
+		return nil
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].id < nodes[j].id })
+	pages := make([][]byte, 0, len(nodes)+1)
+	ids := make([]uint64, 0, len(nodes)+1)
+	pages, ids = append(pages, p.meta.encode()), append(ids, 0)
+	for _, n := range nodes {
+		pages, ids = append(pages, n.encode()), append(ids, uint64(n.id))
+	}
+
+	w := bufio.NewWriter(p.journal)
+	for i, page := range pages {
+		_, _ = w.Write(appendUint64(nil, ids[i]))
+		_, _ = w.Write(page)
+	}
+	_, _ = w.Write(appendUint64(nil, commitID))
+	_, _ = w.Write(appendUint64(nil, uint64(len(pages))))
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := p.sync(p.journal); err != nil {
+		return err
+	}
+	for i, page := range pages {
+		if _, err := p.f.WriteAt(page, int64(ids[i])*pageSize); err != nil {
+			return err
+		}
+	}
+	if err := p.sync(p.f); err != nil {
+		return err
+	}
+	kv.FlushBytes.Add(int64(len(pages) * pageSize))
+	if err := p.journal.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := p.journal.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	p.metaDirty = false
+	return nil
+}
+
+func (p *pager) sync(f *os.File) error {
+	if base.GetConfig().Fsync == base.FsyncAlways {
+		return f.Sync()
+	}
+	return nil
+}
+
+func (p *pager) close() error {
+	p.journal.Close()
+	return p.f.Close()
+}
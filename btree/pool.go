@@ -0,0 +1,182 @@
+package btree
+
+import (
+	"sync"
+)
+
+// frame holds a page in the buffer pool
+type frame struct {
+	node  *node
+	pins  int
+	dirty bool
+	ref   bool // clock bit, set on every use
+}
+
+type PoolStats struct {
+	Hits      int64
+	Misses    int64
+	Evictions int64
+	Frames    int64
+	Dirty     int64
+	Capacity  int64
+}
+
+// bufferPool caches decoded pages and evicts clean unpinned ones with the
+// clock algorithm. Dirty pages stay until the next checkpoint writes them
+// (no steal), so the file only ever holds checkpointed pages; the pool
+// grows past its capacity if every frame is dirty or pinned.
+type bufferPool struct {
+	guard    *sync.Mutex
+	pager    *pager
+	capacity int
+	frames   map[pageID]*frame
+	clock    []pageID
+	hand     int
+	stats    PoolStats
+}
+
+func newBufferPool(pager *pager, capacity int) *bufferPool {
+	if capacity < 16 {
+		capacity = 16
+	}
+	return &bufferPool{
+		guard:    &sync.Mutex{},
+		pager:    pager,
+		capacity: capacity,
+		frames:   make(map[pageID]*frame),
+	}
+}
+
+// fetch pins the page id, release must follow
+func (p *bufferPool) fetch(id pageID) (*node, error) {
+	p.guard.Lock()
+	defer p.guard.Unlock()
+	if f, ok := p.frames[id]; ok {
+		f.pins++
+		f.ref = true
+		p.stats.Hits++
+		return f.node, nil
+	}
+	p.stats.Misses++
+	n, err := p.pager.read(id)
+	if err != nil {
+		return nil, err
+	}
+	p.add(n, 1, false)
+	return n, nil
+}
+
+// add makes a new frame for n, the caller holds guard
+func (p *bufferPool) add(n *node, pins int, dirty bool) {
+	f := &frame{node: n, pins: pins, dirty: dirty, ref: true}
+	if len(p.frames) >= p.capacity {
+		if slot, ok := p.evict(); ok {
+			p.clock[slot] = n.id
+			p.frames[n.id] = f
+			return
+		}
+	}
+	p.clock = append(p.clock, n.id)
+	p.frames[n.id] = f
+}
+
+// evict frees the slot of a clean unpinned frame, false if there is none
+func (p *bufferPool) evict() (int, bool) {
+	for i := 0; i < 2*len(p.clock); i++ {
+		slot := p.hand
+		p.hand = (p.hand + 1) % len(p.clock)
+		f := p.frames[p.clock[slot]]
+		if f.pins > 0 || f.dirty {
+			continue
+		}
+		if f.ref {
+			f.ref = false
+			continue
+		}
+		delete(p.frames, p.clock[slot])
+		p.stats.Evictions++
+		return slot, true
+	}
+	return 0, false
+}
+
+// release unpins n, marking it dirty if it was changed
+func (p *bufferPool) release(n *node, dirty bool) {
+	p.guard.Lock()
+	defer p.guard.Unlock()
+	f := p.frames[n.id]
+	f.pins--
+	f.dirty = f.dirty || dirty
+}
+
+// create pins a new dirty page, reusing a free page if there is one
+func (p *bufferPool) create(kind byte) (*node, error) {
+	id, err := p.pager.allocate(p)
+	if err != nil {
+		return nil, err
+	}
+	n := &node{id: id, kind: kind}
+	p.guard.Lock()
+	defer p.guard.Unlock()
+	if f, ok := p.frames[id]; ok { // a free page read to find the next one
+		f.node, f.pins, f.dirty, f.ref = n, f.pins+1, true, true
+		return n, nil
+	}
+	p.add(n, 1, true)
+	return n, nil
+}
+
+// free puts the page id on the free list, it must not be pinned
+func (p *bufferPool) free(id pageID) {
+	p.guard.Lock()
+	defer p.guard.Unlock()
+	n := &node{id: id, kind: kindFree, next: p.pager.meta.freeHead}
+	p.pager.meta.freeHead = id
+	p.pager.metaDirty = true
+	if f, ok := p.frames[id]; ok {
+		f.node, f.dirty = n, true
+		return
+	}
+	p.add(n, 0, true)
+}
+
+// takeDirty returns the changed pages and marks them clean, the caller writes them
+func (p *bufferPool) takeDirty() []*node {
+	p.guard.Lock()
+	defer p.guard.Unlock()
+	nodes := make([]*node, 0)
+	for _, f := range p.frames {
+		if f.dirty {
+			nodes = append(nodes, f.node)
+			f.dirty = false
+		}
+	}
+	// shrink back to the capacity now that the frames are clean
+	for len(p.frames) > p.capacity {
+		slot, ok := p.evict()
+		if !ok {
+			break
+		}
+		last := len(p.clock) - 1
+		p.clock[slot] = p.clock[last]
+		p.clock = p.clock[:last]
+		if p.hand >= len(p.clock) {
+			p.hand = 0
+		}
+	}
+	return nodes
+}
+
+func (p *bufferPool) Stats() PoolStats {
+	p.guard.Lock()
+	defer p.guard.Unlock()
+	stats := p.stats
+	stats.Frames = int64(len(p.frames))
+	stats.Capacity = int64(p.capacity)
+	for _, f := range p.frames {
+		if f.dirty {
+			stats.Dirty++
+		}
+	}
+	return stats
+}
@@ -0,0 +1,418 @@
+package btree
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"stupid-kv/base"
+	"stupid-kv/kv"
+	log "stupid-kv/logutil"
+	"sync"
+)
+
+func init() {
+	kv.RegisterStore(base.EngineBTree, func() (kv.Store, error) {
+		if err := os.MkdirAll(base.DataPath("btree"), 0755); err != nil {
+			return nil, err
+		}
+		return Open(base.DataPath("btree/DATA.btree"), int(base.GetConfig().BlockCacheSize/pageSize))
+	})
+}
+
+// Tree is a kv.Store that keeps the chain of each key in the leaves of a
+// paged B+tree, chains too long for a leaf continue in overflow pages.
+// Flush checkpoints the changed pages; after a crash the file is as of the
+// last Flush and txn recovery rolls back the versions of interrupted txns.
+type Tree struct {
+	guard *sync.RWMutex // one writer or many readers
+	pager *pager
+	pool  *bufferPool
+}
+
+// Open opens the tree file at path with a buffer pool of frames pages
+func Open(path string, frames int) (*Tree, error) {
+	pager, err := openPager(path)
+	if err != nil {
+		return nil, fmt.Errorf("open %v: %w", path, err)
+	}
+	return &Tree{
+		guard: &sync.RWMutex{},
+		pager: pager,
+		pool:  newBufferPool(pager, frames),
+	}, nil
+}
+
+func (t *Tree) Load(key base.KeyT) (kv.ValueSlot, bool) {
+	t.guard.RLock()
+	defer t.guard.RUnlock()
+	data, ok, err := t.get(key)
+	if err != nil {
+		log.Fatal("btree read ", key, " error: ", err)
+	}
+	if !ok {
+		return kv.ValueSlot{}, false
+	}
+	var slot kv.ValueSlot
+	if err := slot.UnmarshalBinary(data); err != nil {
+		log.Fatal("btree read ", key, " error: ", err)
+	}
+	return slot, true
+}
+
+func (t *Tree) get(key base.KeyT) ([]byte, bool, error) {
+	n, err := t.pool.fetch(t.pager.meta.root)
+	if err != nil {
+		return nil, false, err
+	}
+	for n.kind == kindInternal {
+		child := n.children[childIndex(n, key)]
+		t.pool.release(n, false)
+		if n, err = t.pool.fetch(child); err != nil {
+			return nil, false, err
+		}
+	}
+	defer t.pool.release(n, false)
+	i := sort.Search(len(n.keys), func(i int) bool { return n.keys[i] >= key })
+	if i == len(n.keys) || n.keys[i] != key {
+		return nil, false, nil
+	}
+	data, err := t.readValue(n.values[i])
+	return data, err == nil, err
+}
+
+// childIndex is the child of an internal node whose keys may hold key
+func childIndex(n *node, key base.KeyT) int {
+	return sort.Search(len(n.keys), func(i int) bool { return n.keys[i] > key })
+}
+
+func (t *Tree) readValue(v value) ([]byte, error) {
+	if v.overflow == 0 {
+		return v.inline, nil
+	}
+	data := make([]byte, 0, v.length)
+	for id := v.overflow; id != 0; {
+		n, err := t.pool.fetch(id)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, n.data...)
+		id = n.next
+		t.pool.release(n, false)
+	}
+	if len(data) != int(v.length) {
+		return nil, ErrCorrupted
+	}
+	return data, nil
+}
+
+// writeValue stores data inline or in a new overflow chain
+func (t *Tree) writeValue(data []byte) (value, error) {
+	if len(data) <= maxInlineSize {
+		return value{inline: data, length: uint32(len(data))}, nil
+	}
+	v := value{length: uint32(len(data))}
+	var prev *node
+	for len(data) > 0 {
+		n, err := t.pool.create(kindOverflow)
+		if err != nil {
+			return value{}, err
+		}
+		chunk := len(data)
+		if chunk > bodySize {
+			chunk = bodySize
+		}
+		n.data, data = data[:chunk], data[chunk:]
+		if prev == nil {
+			v.overflow = n.id
+		} else {
+			prev.next = n.id
+			t.pool.release(prev, true)
+		}
+		prev = n
+	}
+	t.pool.release(prev, true)
+	return v, nil
+}
+
+func (t *Tree) freeValue(v value) error {
+	for id := v.overflow; id != 0; {
+		n, err := t.pool.fetch(id)
+		if err != nil {
+			return err
+		}
+		next := n.next
+		t.pool.release(n, false)
+		t.pool.free(id)
+		id = next
+	}
+	return nil
+}
+
+func (t *Tree) Save(key base.KeyT, slot kv.ValueSlot) {
+	if len(key) > maxKeySize {
+		log.Fatal("btree key longer than ", maxKeySize, " bytes: ", key)
+	}
+	data, _ := slot.MarshalBinary()
+	t.guard.Lock()
+	defer t.guard.Unlock()
+	if err := t.put(key, data); err != nil {
+		log.Fatal("btree write ", key, " error: ", err)
+	}
+}
+
+func (t *Tree) put(key base.KeyT, data []byte) error {
+	v, err := t.writeValue(data)
+	if err != nil {
+		return err
+	}
+	sep, right, err := t.insert(t.pager.meta.root, key, v)
+	if err != nil || right == 0 {
+		return err
+	}
+	// the root split, grow the tree by a level
+	root, err := t.pool.create(kindInternal)
+	if err != nil {
+		return err
+	}
+	root.keys = []base.KeyT{sep}
+	root.children = []pageID{t.pager.meta.root, right}
+	t.pager.meta.root = root.id
+	t.pager.metaDirty = true
+	t.pool.release(root, true)
+	return nil
+}
+
+// insert puts key into the subtree at id, if the page splits it returns the
+// first key and the page of the right half
+func (t *Tree) insert(id pageID, key base.KeyT, v value) (base.KeyT, pageID, error) {
+	n, err := t.pool.fetch(id)
+	if err != nil {
+		return "", 0, err
+	}
+	defer t.pool.release(n, true)
+
+	if n.kind == kindLeaf {
+		i := sort.Search(len(n.keys), func(i int) bool { return n.keys[i] >= key })
+		if i < len(n.keys) && n.keys[i] == key {
+			if err := t.freeValue(n.values[i]); err != nil {
+				return "", 0, err
+			}
+			n.values[i] = v
+		} else {
+			n.keys = append(n.keys, "")
+			copy(n.keys[i+1:], n.keys[i:])
+			n.keys[i] = key
+			n.values = append(n.values, value{})
+			copy(n.values[i+1:], n.values[i:])
+			n.values[i] = v
+		}
+	} else {
+		i := childIndex(n, key)
+		sep, right, err := t.insert(n.children[i], key, v)
+		if err != nil || right == 0 {
+			return "", 0, err
+		}
+		n.keys = append(n.keys, "")
+		copy(n.keys[i+1:], n.keys[i:])
+		n.keys[i] = sep
+		n.children = append(n.children, 0)
+		copy(n.children[i+2:], n.children[i+1:])
+		n.children[i+1] = right
+	}
+	if n.size() <= bodySize {
+		return "", 0, nil
+	}
+	return t.split(n)
+}
+
+// split moves the upper half of n by size to a new page
+func (t *Tree) split(n *node) (base.KeyT, pageID, error) {
+	right, err := t.pool.create(n.kind)
+	if err != nil {
+		return "", 0, err
+	}
+	defer t.pool.release(right, true)
+
+	half, size, mid := n.size()/2, 0, 0
+	for mid < len(n.keys)-1 {
+		var v value
+		if n.kind == kindLeaf {
+			v = n.values[mid]
+		}
+		if size += cellSize(n.kind, n.keys[mid], v); size > half {
+			break
+		}
+		mid++
+	}
+	if mid == 0 {
+		mid = 1
+	}
+	if n.kind == kindLeaf {
+		right.keys = append([]base.KeyT{}, n.keys[mid:]...)
+		right.values = append([]value{}, n.values[mid:]...)
+		n.keys, n.values = n.keys[:mid], n.values[:mid]
+		return right.keys[0], right.id, nil
+	}
+	// the middle key moves up, its right child starts the new page
+	sep := n.keys[mid]
+	right.keys = append([]base.KeyT{}, n.keys[mid+1:]...)
+	right.children = append([]pageID{}, n.children[mid+1:]...)
+	n.keys, n.children = n.keys[:mid], n.children[:mid+1]
+	return sep, right.id, nil
+}
+
+func (t *Tree) Delete(key base.KeyT) {
+	t.guard.Lock()
+	defer t.guard.Unlock()
+	if err := t.delete(key); err != nil {
+		log.Fatal("btree delete ", key, " error: ", err)
+	}
+}
+
+func (t *Tree) delete(key base.KeyT) error {
+	empty, err := t.remove(t.pager.meta.root, key)
+	if err != nil {
+		return err
+	}
+	if empty {
+		// the last leaf went away under an internal root, start over with an empty leaf
+		root, err := t.pool.fetch(t.pager.meta.root)
+		if err != nil {
+			return err
+		}
+		root.kind, root.keys, root.children = kindLeaf, nil, nil
+		t.pool.release(root, true)
+		return nil
+	}
+	// an internal root with a single child hands the root over
+	for {
+		root, err := t.pool.fetch(t.pager.meta.root)
+		if err != nil {
+			return err
+		}
+		if root.kind != kindInternal || len(root.children) > 1 {
+			t.pool.release(root, false)
+			return nil
+		}
+		t.pager.meta.root = root.children[0]
+		t.pager.metaDirty = true
+		t.pool.release(root, false)
+		t.pool.free(root.id)
+	}
+}
+
+// remove deletes key from the subtree at id and returns true if the page is
+// left empty. Empty pages are freed by their parent, pages are not merged.
+func (t *Tree) remove(id pageID, key base.KeyT) (bool, error) {
+	n, err := t.pool.fetch(id)
+	if err != nil {
+		return false, err
+	}
+	if n.kind == kindLeaf {
+		i := sort.Search(len(n.keys), func(i int) bool { return n.keys[i] >= key })
+		if i == len(n.keys) || n.keys[i] != key {
+			t.pool.release(n, false)
+			return false, nil
+		}
+		if err := t.freeValue(n.values[i]); err != nil {
+			t.pool.release(n, false)
+			return false, err
+		}
+		n.keys = append(n.keys[:i], n.keys[i+1:]...)
+		n.values = append(n.values[:i], n.values[i+1:]...)
+		t.pool.release(n, true)
+		return len(n.keys) == 0, nil
+	}
+
+	i := childIndex(n, key)
+	empty, err := t.remove(n.children[i], key)
+	if err != nil || !empty {
+		t.pool.release(n, false)
+		return false, err
+	}
+	if len(n.children) == 1 {
+		// the last child, the parent frees both
+		t.pool.release(n, false)
+		t.pool.free(n.children[0])
+		return true, nil
+	}
+	t.pool.free(n.children[i])
+	// drop the child with the key on its left, or on its right for the first child
+	k := i - 1
+	if i == 0 {
+		k = 0
+	}
+	n.keys = append(n.keys[:k], n.keys[k+1:]...)
+	n.children = append(n.children[:i], n.children[i+1:]...)
+	t.pool.release(n, true)
+	return false, nil
+}
+
+// Keys walks the leaves in order from start on
+func (t *Tree) Keys(start base.KeyT, end base.KeyT) []base.KeyT {
+	t.guard.RLock()
+	defer t.guard.RUnlock()
+	keys := make([]base.KeyT, 0)
+	if _, err := t.walk(t.pager.meta.root, start, end, &keys); err != nil {
+		log.Fatal("btree scan error: ", err)
+	}
+	return keys
+}
+
+// walk appends the keys in [start, end) of the subtree at id, returns false
+// once it passed end
+func (t *Tree) walk(id pageID, start base.KeyT, end base.KeyT, keys *[]base.KeyT) (bool, error) {
+	n, err := t.pool.fetch(id)
+	if err != nil {
+		return false, err
+	}
+	defer t.pool.release(n, false)
+	if n.kind == kindLeaf {
+		for _, key := range n.keys {
+			if end != "" && key >= end {
+				return false, nil
+			}
+			if key >= start {
+				*keys = append(*keys, key)
+			}
+		}
+		return true, nil
+	}
+	for i := childIndex(n, start); i < len(n.children); i++ {
+		if more, err := t.walk(n.children[i], start, end, keys); err != nil || !more {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// Flush checkpoints every page changed since the last Flush
+func (t *Tree) Flush() error {
+	t.guard.Lock()
+	defer t.guard.Unlock()
+	return t.pager.checkpoint(t.pool.takeDirty())
+}
+
+func (t *Tree) Close() error {
+	if err := t.Flush(); err != nil {
+		t.pager.close()
+		return err
+	}
+	return t.pager.close()
+}
+
+// StoreStats reports the buffer pool and the size of the file
+func (t *Tree) StoreStats() map[string]int64 {
+	s := t.pool.Stats()
+	t.guard.RLock()
+	defer t.guard.RUnlock()
+	return map[string]int64{
+		"buffer_pool_hits":      s.Hits,
+		"buffer_pool_misses":    s.Misses,
+		"buffer_pool_evictions": s.Evictions,
+		"buffer_pool_frames":    s.Frames,
+		"buffer_pool_dirty":     s.Dirty,
+		"buffer_pool_capacity":  s.Capacity,
+		"btree_pages":           int64(t.pager.meta.pageCount),
+	}
+}
@@ -0,0 +1,105 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+)
+
+// Key names a block by the file it was read from and its offset
+type Key struct {
+	File   uint64
+	Offset int64
+}
+
+type Stats struct {
+	Hits      int64
+	Misses    int64
+	Evictions int64
+	Entries   int64
+	Size      int64
+	Capacity  int64
+}
+
+type item struct {
+	key   Key
+	value interface{}
+	size  int64
+}
+
+// LRU keeps decoded blocks up to a size budget in bytes, evicting the least
+// recently used. A capacity of 0 caches nothing.
+type LRU struct {
+	guard    *sync.Mutex
+	capacity int64
+	size     int64
+	order    *list.List // front is the most recently used
+	items    map[Key]*list.Element
+	stats    Stats
+}
+
+func NewLRU(capacity int64) *LRU {
+	return &LRU{
+		guard:    &sync.Mutex{},
+		capacity: capacity,
+		order:    list.New(),
+		items:    make(map[Key]*list.Element),
+	}
+}
+
+func (c *LRU) Get(key Key) (interface{}, bool) {
+	c.guard.Lock()
+	defer c.guard.Unlock()
+	if el, ok := c.items[key]; ok {
+		c.order.MoveToFront(el)
+		c.stats.Hits++
+		return el.Value.(*item).value, true
+	}
+	c.stats.Misses++
+	return nil, false
+}
+
+// Add caches value as size bytes, values larger than the whole budget are not kept
+func (c *LRU) Add(key Key, value interface{}, size int64) {
+	c.guard.Lock()
+	defer c.guard.Unlock()
+	if size > c.capacity {
+		return
+	}
+	if el, ok := c.items[key]; ok {
+		c.size -= el.Value.(*item).size
+		c.order.Remove(el)
+	}
+	c.items[key] = c.order.PushFront(&item{key, value, size})
+	c.size += size
+	for c.size > c.capacity {
+		el := c.order.Back()
+		it := el.Value.(*item)
+		c.order.Remove(el)
+		delete(c.items, it.key)
+		c.size -= it.size
+		c.stats.Evictions++
+	}
+}
+
+// Forget drops the blocks of a deleted file
+func (c *LRU) Forget(file uint64) {
+	c.guard.Lock()
+	defer c.guard.Unlock()
+	for key, el := range c.items {
+		if key.File == file {
+			c.size -= el.Value.(*item).size
+			c.order.Remove(el)
+			delete(c.items, key)
+		}
+	}
+}
+
+func (c *LRU) Stats() Stats {
+	c.guard.Lock()
+	defer c.guard.Unlock()
+	stats := c.stats
+	stats.Entries = int64(len(c.items))
+	stats.Size = c.size
+	stats.Capacity = c.capacity
+	return stats
+}
@@ -0,0 +1,24 @@
+package cdc
+
+import (
+	"stupid-kv/base"
+	"time"
+)
+
+type Op string
+
+const (
+	OpPut    Op = "put" // inc and dec are puts of the new value
+	OpDelete Op = "delete"
+)
+
+// Event is one key written by a committed txn. OldValue is nil if the key did
+// not exist before, NewValue is nil for a delete.
+type Event struct {
+	Tid        base.Tid     `json:"tid"`
+	Key        base.KeyT    `json:"key"`
+	Op         Op           `json:"op"`
+	OldValue   *base.ValueT `json:"old_value"`
+	NewValue   *base.ValueT `json:"new_value"`
+	CommitTime time.Time    `json:"commit_time"`
+}
@@ -0,0 +1,63 @@
+package cdc
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"stupid-kv/base"
+	"stupid-kv/kv"
+	log "stupid-kv/logutil"
+	"stupid-kv/txn"
+)
+
+// Replay applies the txns of a cdc log in the order they committed, e.g.
+// after restoring a backup. keep picks the events to apply, e.g. those not in
+// the backup and with a tid or commit time up to a target, the events of a
+// txn share both. It flushes the store once at the end and returns the count
+// and the last tid of the txns applied.
+func Replay(path string, keep func(e Event) bool) (int, base.Tid, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, base.NIL_TID, err
+	}
+	defer f.Close()
+
+	tm := txn.GetManagerInstance()
+	applied, last := 0, base.NIL_TID
+	var tid base.Tid
+	writes := make([]txn.Write, 0)
+	apply := func() {
+		if len(writes) == 0 {
+			return
+		}
+		tm.ApplyReplicated(tid, writes)
+		applied, last = applied+1, tid
+		writes = writes[:0]
+	}
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e Event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			log.Warning("cdc: skip bad log line: ", err)
+			continue
+		}
+		if e.Tid != tid {
+			apply()
+			tid = e.Tid
+		}
+		if !keep(e) {
+			continue
+		}
+		w := txn.Write{Key: e.Key, Value: base.VALUE_NOT_FOUND}
+		if e.NewValue != nil {
+			w.Value = *e.NewValue
+		}
+		writes = append(writes, w)
+	}
+	apply()
+	if applied > 0 {
+		kv.GetManagerInstance().Flush()
+	}
+	return applied, last, scanner.Err()
+}
@@ -0,0 +1,84 @@
+package cdc
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"stupid-kv/base"
+)
+
+// Sink receives the events of each committed txn, in commit order. Send
+// should give up once done is closed, the subscription stopped.
+type Sink interface {
+	Send(done <-chan struct{}, events []Event) error
+}
+
+// ChanSink sends every event to a channel, a full channel holds the
+// subscription back until it lags too far and is dropped
+type ChanSink chan<- Event
+
+func (s ChanSink) Send(done <-chan struct{}, events []Event) error {
+	for _, e := range events {
+		select {
+		case s <- e:
+		case <-done:
+			return nil
+		}
+	}
+	return nil
+}
+
+// FileSink appends the events to a file as json lines
+type FileSink struct {
+	f *os.File
+	w *bufio.Writer
+}
+
+func NewFileSink(path string) (*FileSink, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileSink{f: f, w: bufio.NewWriter(f)}, nil
+}
+
+func (s *FileSink) Send(done <-chan struct{}, events []Event) error {
+	enc := json.NewEncoder(s.w)
+	for _, e := range events {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+	if err := s.w.Flush(); err != nil {
+		return err
+	}
+	if base.GetConfig().Fsync == base.FsyncAlways {
+		return s.f.Sync()
+	}
+	return nil
+}
+
+func (s *FileSink) Close() error {
+	return s.f.Close()
+}
+
+// LastTid returns the tid of the last event in a file written by FileSink,
+// to resume from it, or FromStart if the file has no events
+func LastTid(path string) (base.Tid, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return FromStart, nil
+	} else if err != nil {
+		return FromStart, err
+	}
+	defer f.Close()
+	last := FromStart
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e Event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err == nil {
+			last = e.Tid
+		}
+	}
+	return last, scanner.Err()
+}
@@ -0,0 +1,318 @@
+package cdc
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"stupid-kv/base"
+	log "stupid-kv/logutil"
+	"stupid-kv/txn"
+	"sync"
+	"time"
+)
+
+const (
+	FromStart base.Tid = -1 // every event in the cdc log
+	FromNow   base.Tid = -2 // only txns committed after Subscribe
+
+	// subscriberBuffer is how many txns a subscriber may lag behind before it is dropped
+	subscriberBuffer = 1024
+)
+
+var (
+	ErrUnknownTid = errors.New("cdc: tid has no events to resume from")
+	ErrLagging    = errors.New("cdc: subscriber lags too far behind, resume from its last tid")
+)
+
+// Stream turns the commits of txn.Manager into events. Every event is
+// appended to the cdc log, cdc_file, in commit order, so subscribers can
+// resume after the last tid they saw.
+type Stream struct {
+	guard     *sync.Mutex // orders the log and the subscribers
+	file      *os.File
+	subs      map[int]*Subscription
+	nextSubId int
+}
+
+var instance *Stream
+
+// the stream starts with the txn manager, so no commit misses the log
+func init() {
+	txn.OnStart(start)
+}
+
+func start(m *txn.Manager) {
+	log.Info("cdc stream starts to init")
+	f, err := os.OpenFile(LogPath(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		log.Fatal("open cdc log error: ", err)
+	}
+	instance = &Stream{
+		guard: &sync.Mutex{},
+		file:  f,
+		subs:  make(map[int]*Subscription),
+	}
+	m.AddCommitListener(instance.onCommit)
+	if retention := base.GetConfig().CDCRetention; retention > 0 {
+		go instance.truncateLoop(retention)
+	}
+}
+
+func GetStreamInstance() *Stream {
+	txn.GetManagerInstance()
+	return instance
+}
+
+// LogPath is cdc_file, relative to data_dir unless absolute
+func LogPath() string {
+	path := base.GetConfig().CDCFile
+	if !filepath.IsAbs(path) {
+		path = base.DataPath(path)
+	}
+	return path
+}
+
+// onCommit runs before the write locks of tid are released, so events of a
+// key reach the log in commit order.
+func (s *Stream) onCommit(tid base.Tid, writes []txn.Write) {
+	now := time.Now()
+	events := make([]Event, 0, len(writes))
+	for _, w := range writes {
+		e := Event{Tid: tid, Key: w.Key, Op: OpPut, CommitTime: now}
+		if w.Value == base.VALUE_NOT_FOUND {
+			e.Op = OpDelete
+		} else {
+			value := w.Value
+			e.NewValue = &value
+		}
+		if w.Old != base.VALUE_NOT_FOUND {
+			old := w.Old
+			e.OldValue = &old
+		}
+		events = append(events, e)
+	}
+
+	s.guard.Lock()
+	defer s.guard.Unlock()
+	if err := s.append(events); err != nil {
+		log.Warning("cdc append error: ", err)
+	}
+	for _, sub := range s.subs {
+		sub.push(events)
+	}
+}
+
+// truncateLoop drops the events older than retention from the log now and then
+func (s *Stream) truncateLoop(retention time.Duration) {
+	interval := retention / 4
+	if interval > time.Hour {
+		interval = time.Hour
+	} else if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if dropped, err := s.Truncate(time.Now().Add(-retention)); err != nil {
+			log.Warning("cdc truncate error: ", err)
+		} else if dropped > 0 {
+			log.Infof("cdc log drops %v events older than %v", dropped, retention)
+		}
+	}
+}
+
+// Truncate drops the events committed before cutoff from the head of the
+// log and returns how many, a subscriber can not resume from a dropped tid
+func (s *Stream) Truncate(cutoff time.Time) (int, error) {
+	s.guard.Lock()
+	defer s.guard.Unlock()
+	data, err := ioutil.ReadFile(s.file.Name())
+	if err != nil {
+		return 0, err
+	}
+	dropped, head := 0, 0
+	for head < len(data) {
+		end := bytes.IndexByte(data[head:], '\n')
+		if end < 0 {
+			break
+		}
+		var e Event
+		if err := json.Unmarshal(data[head:head+end], &e); err == nil && !e.CommitTime.Before(cutoff) {
+			break
+		}
+		head += end + 1
+		dropped++
+	}
+	if dropped == 0 {
+		return 0, nil
+	}
+	if err := base.WriteFile(s.file.Name(), data[head:]); err != nil {
+		return 0, err
+	}
+	f, err := os.OpenFile(s.file.Name(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return 0, err
+	}
+	s.file.Close()
+	s.file = f
+	return dropped, nil
+}
+
+func (s *Stream) append(events []Event) error {
+	data := make([]byte, 0)
+	for _, e := range events {
+		line, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		data = append(append(data, line...), '\n')
+	}
+	if _, err := s.file.Write(data); err != nil {
+		return err
+	}
+	if base.GetConfig().Fsync == base.FsyncAlways {
+		return s.file.Sync()
+	}
+	return nil
+}
+
+// Subscribe sends sink the events of the txns committed after from, a tid
+// of an earlier event, replaying them from the cdc log first. Commits wait
+// while the log replays.
+func (s *Stream) Subscribe(from base.Tid, sink Sink) (*Subscription, error) {
+	s.guard.Lock()
+	defer s.guard.Unlock()
+
+	sub := &Subscription{
+		stream: s,
+		queue:  make(chan []Event, subscriberBuffer),
+		done:   make(chan struct{}),
+	}
+	s.nextSubId++
+	sub.id = s.nextSubId
+	s.subs[sub.id] = sub
+	if from != FromNow {
+		backlog, err := s.readLog(from)
+		if err != nil {
+			delete(s.subs, sub.id)
+			return nil, err
+		}
+		go func() {
+			for _, events := range backlog {
+				if err := sink.Send(sub.done, events); err != nil {
+					sub.stop(err)
+					return
+				}
+			}
+			sub.run(sink)
+		}()
+	} else {
+		go sub.run(sink)
+	}
+	return sub, nil
+}
+
+// readLog returns the events after the last ones of from, grouped by txn
+func (s *Stream) readLog(from base.Tid) ([][]Event, error) {
+	f, err := os.Open(s.file.Name())
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	backlog := make([][]Event, 0)
+	found := from == FromStart
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e Event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			log.Warning("cdc: skip bad cdc log line: ", err)
+			continue
+		}
+		if e.Tid == from {
+			backlog, found = backlog[:0], true
+			continue
+		}
+		if n := len(backlog); n > 0 && backlog[n-1][0].Tid == e.Tid {
+			backlog[n-1] = append(backlog[n-1], e)
+		} else {
+			backlog = append(backlog, []Event{e})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, ErrUnknownTid
+	}
+	return backlog, nil
+}
+
+func (s *Stream) unsubscribe(id int) {
+	s.guard.Lock()
+	defer s.guard.Unlock()
+	delete(s.subs, id)
+}
+
+// Subscription delivers events to its sink until it is closed or fails
+type Subscription struct {
+	id     int
+	stream *Stream
+	queue  chan []Event
+	done   chan struct{}
+	once   sync.Once
+	err    error
+}
+
+// push queues events without blocking the commit, the caller holds the stream guard
+func (sub *Subscription) push(events []Event) {
+	select {
+	case sub.queue <- events:
+	default:
+		delete(sub.stream.subs, sub.id)
+		go sub.stop(ErrLagging)
+	}
+}
+
+func (sub *Subscription) run(sink Sink) {
+	for {
+		select {
+		case <-sub.done:
+			return
+		case events := <-sub.queue:
+			if err := sink.Send(sub.done, events); err != nil {
+				sub.stop(err)
+				return
+			}
+		}
+	}
+}
+
+func (sub *Subscription) stop(err error) {
+	sub.once.Do(func() {
+		sub.err = err
+		close(sub.done)
+		if err != nil {
+			log.Warningf("cdc subscription %v stops: %v", sub.id, err)
+		}
+	})
+	sub.stream.unsubscribe(sub.id)
+}
+
+// Close stops the subscription, events already queued are dropped
+func (sub *Subscription) Close() {
+	sub.stop(nil)
+}
+
+// Done is closed when the subscription stops, Err tells why
+func (sub *Subscription) Done() <-chan struct{} {
+	return sub.done
+}
+
+func (sub *Subscription) Err() error {
+	<-sub.done
+	return sub.err
+}
@@ -0,0 +1,232 @@
+package cluster
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"stupid-kv/base"
+	"stupid-kv/kv"
+	log "stupid-kv/logutil"
+	"stupid-kv/txn"
+	"sync"
+
+	"github.com/hashicorp/raft"
+)
+
+// entry is the redo log of one committed txn
+type entry struct {
+	Tid    base.Tid    `json:"tid"`
+	Writes []txn.Write `json:"writes"`
+}
+
+// snapshot is the kv store with the versions of uncommitted txns to drop,
+// Data is in the binary kv data format, base64 in the json
+type snapshot struct {
+	Data     []byte     `json:"data"`
+	CurTid   base.Tid   `json:"cur_tid"`
+	Rollback []base.Tid `json:"rollback"`
+}
+
+// doubt is an entry of a local txn whose commit outcome is unknown
+type doubt struct {
+	tid  base.Tid
+	keys []base.KeyT
+}
+
+// fsm applies redo entries to kv.Manager. The leader wrote them already when
+// they are applied. The index of the last entry in the data file is kept in
+// APPLIED, a restarted node skips the entries up to it.
+type fsm struct {
+	guard   *sync.Mutex
+	applied map[base.Tid]bool // replicated tids that may still be active here
+
+	appliedPath string
+	persisted   uint64              // the data file has every entry up to it
+	local       map[uint64]base.Tid // entries of local txns, in the data file once they end
+	doubts      map[uint64]doubt    // entries of local txns in doubt
+}
+
+func newFSM(appliedPath string) (*fsm, error) {
+	f := &fsm{
+		guard:       &sync.Mutex{},
+		applied:     make(map[base.Tid]bool),
+		appliedPath: appliedPath,
+		local:       make(map[uint64]base.Tid),
+		doubts:      make(map[uint64]doubt),
+	}
+	data, err := ioutil.ReadFile(appliedPath)
+	if os.IsNotExist(err) {
+		return f, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if f.persisted, err = strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64); err != nil {
+		return nil, fmt.Errorf("%v: %v", appliedPath, err)
+	}
+	return f, nil
+}
+
+func (f *fsm) Apply(l *raft.Log) interface{} {
+	return f.ApplyBatch([]*raft.Log{l})[0]
+}
+
+// ApplyBatch applies the entries and flushes the store once for all of them
+func (f *fsm) ApplyBatch(logs []*raft.Log) []interface{} {
+	f.guard.Lock()
+	defer f.guard.Unlock()
+	resps := make([]interface{}, len(logs))
+	for i, l := range logs {
+		resps[i] = f.apply(l)
+	}
+	if len(logs) > 0 {
+		if err := f.persist(logs[len(logs)-1].Index); err != nil {
+			log.Warning("raft persist applied index error: ", err)
+		}
+	}
+	return resps
+}
+
+func (f *fsm) apply(l *raft.Log) interface{} {
+	tid := base.NIL_TID
+	defer func() { f.resolveDoubts(l.Index, tid) }()
+	if l.Type != raft.LogCommand || l.Index <= f.persisted {
+		return nil
+	}
+	var e entry
+	if err := json.Unmarshal(l.Data, &e); err != nil {
+		log.Warningf("raft log %v is not a redo entry: %v", l.Index, err)
+		return err
+	}
+	tid = e.Tid
+	if txn.GetManagerInstance().ApplyReplicated(e.Tid, e.Writes) {
+		f.local[l.Index] = e.Tid
+	}
+	f.applied[e.Tid] = true
+	return nil
+}
+
+// addDoubt notes the entry of a local txn whose commit outcome is unknown
+func (f *fsm) addDoubt(index uint64, tid base.Tid, writes []txn.Write) {
+	keys := make([]base.KeyT, 0, len(writes))
+	for _, w := range writes {
+		keys = append(keys, w.Key)
+	}
+	f.guard.Lock()
+	defer f.guard.Unlock()
+	f.doubts[index] = doubt{tid, keys}
+}
+
+// resolveDoubts aborts the txns in doubt whose entry the log replaced, once
+// it applied the entry at index, of tid. The entry of tid itself committed.
+func (f *fsm) resolveDoubts(index uint64, tid base.Tid) {
+	for at, d := range f.doubts {
+		if at > index {
+			continue
+		}
+		delete(f.doubts, at)
+		if d.tid != tid {
+			txn.GetManagerInstance().ResolveInDoubt(d.tid, false)
+		}
+	}
+}
+
+// persist flushes the store and moves APPLIED up to last, but not past an
+// entry of a local txn that did not end, recovery rolls that one back
+func (f *fsm) persist(last uint64) error {
+	tm := txn.GetManagerInstance()
+	safe := last
+	for index, tid := range f.local {
+		if !tm.IsActive(tid) {
+			delete(f.local, index)
+		} else if index-1 < safe {
+			safe = index - 1
+		}
+	}
+	kv.GetManagerInstance().Flush()
+	if safe <= f.persisted {
+		return nil
+	}
+	if err := base.WriteFile(f.appliedPath, []byte(strconv.FormatUint(safe, 10))); err != nil {
+		return err
+	}
+	f.persisted = safe
+	return nil
+}
+
+// Snapshot copies the store along with the tids active around the copy, they
+// are rolled back on restore unless their entry was applied.
+func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
+	tm := txn.GetManagerInstance()
+	before := tm.Stats().ActiveTids
+	data, err := kv.GetManagerInstance().Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	stats := tm.Stats()
+
+	f.guard.Lock()
+	defer f.guard.Unlock()
+	rollback := make([]base.Tid, 0)
+	active := make(map[base.Tid]bool)
+	for _, tid := range append(before, stats.ActiveTids...) {
+		if !active[tid] && !f.applied[tid] {
+			rollback = append(rollback, tid)
+		}
+		active[tid] = true
+	}
+	for tid := range f.applied {
+		if !active[tid] {
+			delete(f.applied, tid)
+		}
+	}
+	return &snapshot{data, stats.CurTid, rollback}, nil
+}
+
+func (f *fsm) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+	var s snapshot
+	if err := json.NewDecoder(rc).Decode(&s); err != nil {
+		return err
+	}
+	kvStore := kv.GetManagerInstance()
+	if err := kvStore.Restore(bytes.NewReader(s.Data)); err != nil {
+		return err
+	}
+	for _, tid := range s.Rollback {
+		kvStore.RollbackTid(tid)
+	}
+	kvStore.Flush()
+	txn.GetManagerInstance().AdvanceTid(s.CurTid - 1)
+
+	// the snapshot holds a txn in doubt if the log committed it
+	f.guard.Lock()
+	for index, d := range f.doubts {
+		committed := false
+		for _, key := range d.keys {
+			for _, v := range kvStore.History(key) {
+				committed = committed || v.Begin == d.tid
+			}
+		}
+		txn.GetManagerInstance().ResolveInDoubt(d.tid, committed)
+		delete(f.doubts, index)
+	}
+	f.local = make(map[uint64]base.Tid)
+	f.guard.Unlock()
+	log.Infof("raft snapshot restored, next tid %v", s.CurTid)
+	return nil
+}
+
+func (s *snapshot) Persist(sink raft.SnapshotSink) error {
+	if err := json.NewEncoder(sink).Encode(s); err != nil {
+		_ = sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (s *snapshot) Release() {}
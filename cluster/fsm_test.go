@@ -0,0 +1,161 @@
+package cluster
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"stupid-kv/base"
+	"stupid-kv/testutil"
+	"stupid-kv/txn"
+	"testing"
+
+	"github.com/hashicorp/raft"
+)
+
+func TestMain(m *testing.M) {
+	testutil.Main(m)
+}
+
+// memSink keeps a persisted snapshot in memory
+type memSink struct {
+	bytes.Buffer
+}
+
+func (s *memSink) ID() string    { return "test" }
+func (s *memSink) Cancel() error { return nil }
+func (s *memSink) Close() error  { return nil }
+
+func TestFSMSnapshotRoundTrip(t *testing.T) {
+	tm := txn.GetManagerInstance()
+	tid := tm.BeginTxn()
+	testutil.MustDo(t, tm.Put("a", 1, tid))
+	testutil.MustDo(t, tm.Put("b", 2, tid))
+	testutil.MustDo(t, tm.CommitTxn(tid))
+	open := tm.BeginTxn()
+	testutil.MustDo(t, tm.Put("c", 3, open))
+
+	f := newTestFSM(t)
+	snap, err := f.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := &memSink{}
+	if err := snap.Persist(sink); err != nil {
+		t.Fatal(err)
+	}
+	testutil.MustDo(t, tm.AbortTxn(open))
+	tid = tm.BeginTxn()
+	testutil.MustDo(t, tm.Put("a", 10, tid))
+	testutil.MustDo(t, tm.Del("b", tid))
+	testutil.MustDo(t, tm.CommitTxn(tid))
+
+	if err := f.Restore(ioutil.NopCloser(&sink.Buffer)); err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectCommitted(t, "a", 1)
+	testutil.ExpectCommitted(t, "b", 2)
+	// the txn open during the snapshot is rolled back
+	testutil.ExpectCommitted(t, "c", base.VALUE_NOT_FOUND)
+
+	// a redo entry applies over the restored store
+	data, err := json.Marshal(entry{Tid: tm.GetCurrentTid(), Writes: []txn.Write{{Key: "c", Value: 30, Old: base.VALUE_NOT_FOUND}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err, _ := f.Apply(&raft.Log{Index: 1, Data: data}).(error); err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectCommitted(t, "c", 30)
+}
+
+// redo returns the raft log of a redo entry
+func redo(t *testing.T, index uint64, tid base.Tid, writes ...txn.Write) *raft.Log {
+	t.Helper()
+	data, err := json.Marshal(entry{Tid: tid, Writes: writes})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &raft.Log{Index: index, Type: raft.LogCommand, Data: data}
+}
+
+func TestFSMAppliedIndex(t *testing.T) {
+	tm := txn.GetManagerInstance()
+	f := newTestFSM(t)
+	hi, lo := tm.GetCurrentTid()+1, tm.GetCurrentTid()
+	// a lower tid may commit after a higher one, both apply
+	f.ApplyBatch([]*raft.Log{
+		redo(t, 1, hi, txn.Write{Key: "idx", Value: 1}),
+		redo(t, 2, lo, txn.Write{Key: "idx", Value: 2}),
+	})
+	testutil.ExpectCommitted(t, "idx", 2)
+
+	// a restart skips the entries the data file has
+	f, err := newFSM(f.appliedPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.persisted != 2 {
+		t.Fatalf("persisted index %v, want 2", f.persisted)
+	}
+	f.ApplyBatch([]*raft.Log{
+		redo(t, 2, lo, txn.Write{Key: "idx", Value: 20}),
+		redo(t, 3, hi+1, txn.Write{Key: "idx", Value: 3}),
+	})
+	testutil.ExpectCommitted(t, "idx", 3)
+}
+
+// unknownReplicator never learns if the log has an entry
+type unknownReplicator struct{}
+
+func (unknownReplicator) Writable() error { return nil }
+func (unknownReplicator) Replicate(tid base.Tid, writes []txn.Write) error {
+	return fmt.Errorf("%w: test", txn.ErrorOutcomeUnknown)
+}
+
+func TestFSMResolvesDoubts(t *testing.T) {
+	tm := txn.GetManagerInstance()
+	tm.SetReplicator(unknownReplicator{})
+	defer tm.SetReplicator(nil)
+	f := newTestFSM(t)
+
+	lost, kept := tm.BeginTxn(), tm.BeginTxn()
+	testutil.MustDo(t, tm.Put("lost", 1, lost))
+	testutil.MustDo(t, tm.Put("kept", 1, kept))
+	for _, tid := range []base.Tid{lost, kept} {
+		if err := tm.CommitTxn(tid); !errors.Is(err, txn.ErrorOutcomeUnknown) {
+			t.Fatalf("commit %v: %v, want outcome unknown", tid, err)
+		}
+		if err := tm.AbortTxn(tid); err != txn.ErrorOutcomeUnknown {
+			t.Fatalf("abort %v: %v, want outcome unknown", tid, err)
+		}
+	}
+	f.addDoubt(10, lost, []txn.Write{{Key: "lost", Value: 1}})
+	f.addDoubt(11, kept, []txn.Write{{Key: "kept", Value: 1}})
+
+	// a new leader wrote another entry at 10, the log has the one at 11
+	f.ApplyBatch([]*raft.Log{
+		redo(t, 10, tm.GetCurrentTid(), txn.Write{Key: "other", Value: 1}),
+		redo(t, 11, kept, txn.Write{Key: "kept", Value: 1}),
+	})
+	if tm.IsActive(lost) || tm.IsActive(kept) {
+		t.Fatal("txns still in doubt")
+	}
+	testutil.ExpectCommitted(t, "lost", base.VALUE_NOT_FOUND)
+	testutil.ExpectCommitted(t, "kept", 1)
+}
+
+func newTestFSM(t *testing.T) *fsm {
+	t.Helper()
+	dir, err := ioutil.TempDir(base.GetConfig().DataDir, "fsm-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := newFSM(filepath.Join(dir, "APPLIED"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
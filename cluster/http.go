@@ -0,0 +1,107 @@
+package cluster
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	log "stupid-kv/logutil"
+)
+
+// member is the body of join and remove
+type member struct {
+	Id   string `json:"id"`
+	Addr string `json:"addr,omitempty"`
+}
+
+// Handler serves the membership api of the node:
+//
+//	GET /cluster/status, POST /cluster/join {"id", "addr"},
+//	POST /cluster/remove {"id"}, POST /cluster/snapshot
+func (n *Node) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/cluster/status", n.handleStatus)
+	mux.HandleFunc("/cluster/join", n.handleMember)
+	mux.HandleFunc("/cluster/remove", n.handleMember)
+	mux.HandleFunc("/cluster/snapshot", n.handleSnapshot)
+	return mux
+}
+
+func (n *Node) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]interface{}{"error": "use GET"})
+		return
+	}
+	future := n.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		writeError(w, err)
+		return
+	}
+	servers := make([]map[string]interface{}, 0)
+	for _, s := range future.Configuration().Servers {
+		servers = append(servers, map[string]interface{}{
+			"id":       s.ID,
+			"addr":     s.Address,
+			"suffrage": s.Suffrage.String(),
+		})
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"id":            n.id,
+		"state":         n.raft.State().String(),
+		"leader":        n.Leader(),
+		"servers":       servers,
+		"last_index":    n.raft.LastIndex(),
+		"applied_index": n.raft.AppliedIndex(),
+	})
+}
+
+func (n *Node) handleMember(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]interface{}{"error": "use POST"})
+		return
+	}
+	var m member
+	if err := json.NewDecoder(r.Body).Decode(&m); err != nil || m.Id == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": `body must be {"id": <id>, "addr": <raft addr>}`})
+		return
+	}
+	var err error
+	if r.URL.Path == "/cluster/join" {
+		err = n.Join(m.Id, m.Addr)
+	} else {
+		err = n.Remove(m.Id)
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	log.Infof("raft membership %v: %v", r.URL.Path, m.Id)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"ok": true})
+}
+
+func (n *Node) handleSnapshot(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]interface{}{"error": "use POST"})
+		return
+	}
+	if err := n.Snapshot(); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"ok": true})
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	if errors.Is(err, ErrNotLeader) {
+		status = http.StatusMisdirectedRequest
+	}
+	writeJSON(w, status, map[string]interface{}{"error": err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Warning("http write error: ", err)
+	}
+}
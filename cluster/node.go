@@ -0,0 +1,210 @@
+package cluster
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"stupid-kv/base"
+	log "stupid-kv/logutil"
+	"stupid-kv/txn"
+	"time"
+
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb"
+)
+
+const (
+	applyTimeout = 10 * time.Second
+	joinTimeout  = 30 * time.Second
+)
+
+var ErrNotLeader = errors.New("not the raft leader")
+
+// Node replicates the txns committed on the leader to the other nodes of a
+// raft cluster. Only the leader takes writes, every node serves reads.
+type Node struct {
+	id        string
+	fsm       *fsm
+	raft      *raft.Raft
+	transport *raft.NetworkTransport
+	store     *raftboltdb.BoltStore
+}
+
+// NewNode starts raft under <data_dir>/raft and installs the node as the
+// replicator of txn.Manager. It bootstraps a new cluster or joins through
+// the http api of the leader as configured, a restarted node does neither.
+func NewNode(cfg *base.Config) (*Node, error) {
+	n := &Node{id: cfg.NodeId}
+	if n.id == "" {
+		n.id = cfg.RaftAddr
+	}
+	dir := base.DataPath("raft")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	conf := raft.DefaultConfig()
+	conf.LocalID = raft.ServerID(n.id)
+	conf.LogOutput = os.Stderr
+	conf.LogLevel = raftLogLevel(log.PackageLevel("cluster"))
+
+	addr, err := net.ResolveTCPAddr("tcp", cfg.RaftAddr)
+	if err != nil {
+		return nil, err
+	}
+	if n.transport, err = raft.NewTCPTransport(cfg.RaftAddr, addr, 3, 10*time.Second, os.Stderr); err != nil {
+		return nil, err
+	}
+	snaps, err := raft.NewFileSnapshotStore(dir, 2, os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	if n.store, err = raftboltdb.NewBoltStore(filepath.Join(dir, "raft.db")); err != nil {
+		return nil, err
+	}
+	hasState, err := raft.HasExistingState(n.store, n.store, snaps)
+	if err != nil {
+		return nil, err
+	}
+	if n.fsm, err = newFSM(filepath.Join(dir, "APPLIED")); err != nil {
+		return nil, err
+	}
+	// the data file is newer than the snapshot unless it missed entries of it
+	if metas, err := snaps.List(); err != nil {
+		return nil, err
+	} else if len(metas) == 0 || metas[0].Index <= n.fsm.persisted {
+		conf.NoSnapshotRestoreOnStart = true
+	}
+
+	txn.GetManagerInstance().SetReplicator(n)
+	if n.raft, err = raft.NewRaft(conf, n.fsm, n.store, n.store, snaps, n.transport); err != nil {
+		return nil, err
+	}
+	if hasState {
+		log.Infof("raft node %v restarts with its existing state", n.id)
+		return n, nil
+	}
+	if cfg.RaftBootstrap {
+		servers := []raft.Server{{ID: conf.LocalID, Address: n.transport.LocalAddr()}}
+		if err := n.raft.BootstrapCluster(raft.Configuration{Servers: servers}).Error(); err != nil {
+			return nil, err
+		}
+		log.Infof("raft node %v bootstraps a cluster", n.id)
+	} else if cfg.RaftJoin != "" {
+		if err := n.join(cfg.RaftJoin, string(n.transport.LocalAddr())); err != nil {
+			return nil, err
+		}
+		log.Infof("raft node %v joins the cluster through %v", n.id, cfg.RaftJoin)
+	}
+	return n, nil
+}
+
+// join asks the leader to add this node, retrying while it elects itself
+func (n *Node) join(httpAddr string, raftAddr string) error {
+	body, _ := json.Marshal(member{Id: n.id, Addr: raftAddr})
+	deadline := time.Now().Add(joinTimeout)
+	for {
+		resp, err := http.Post("http://"+httpAddr+"/cluster/join", "application/json", bytes.NewReader(body))
+		if err == nil {
+			var reply map[string]interface{}
+			_ = json.NewDecoder(resp.Body).Decode(&reply)
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return nil
+			}
+			err = fmt.Errorf("join through %v: %v", httpAddr, reply["error"])
+		}
+		if time.Now().After(deadline) {
+			return err
+		}
+		log.Warningf("%v, retry", err)
+		time.Sleep(time.Second)
+	}
+}
+
+func (n *Node) Leader() string {
+	return string(n.raft.Leader())
+}
+
+// Writable implements txn.Replicator
+func (n *Node) Writable() error {
+	if n.raft.State() != raft.Leader {
+		return fmt.Errorf("%w, leader is %q", ErrNotLeader, n.Leader())
+	}
+	return nil
+}
+
+// Replicate implements txn.Replicator, it returns once a quorum has the entry.
+// An entry that made it to the log before the leader stepped down may still
+// commit under the next leader, then tid is in doubt until the log decides.
+func (n *Node) Replicate(tid base.Tid, writes []txn.Write) error {
+	if err := n.Writable(); err != nil {
+		return err
+	}
+	data, err := json.Marshal(entry{tid, writes})
+	if err != nil {
+		return err
+	}
+	f := n.raft.Apply(data, applyTimeout)
+	err = f.Error()
+	if (err == raft.ErrLeadershipLost || err == raft.ErrRaftShutdown) && f.Index() != 0 {
+		n.fsm.addDoubt(f.Index(), tid, writes)
+		return fmt.Errorf("%w: %v at raft index %v", txn.ErrorOutcomeUnknown, err, f.Index())
+	}
+	if err == raft.ErrNotLeader || err == raft.ErrLeadershipLost {
+		return fmt.Errorf("%w, leader is %q", ErrNotLeader, n.Leader())
+	} else if err != nil {
+		return err
+	}
+	if err, ok := f.Response().(error); ok {
+		return err
+	}
+	return nil
+}
+
+// Join adds a voter, only the leader can change the membership
+func (n *Node) Join(id string, addr string) error {
+	if err := n.Writable(); err != nil {
+		return err
+	}
+	return n.raft.AddVoter(raft.ServerID(id), raft.ServerAddress(addr), 0, applyTimeout).Error()
+}
+
+func (n *Node) Remove(id string) error {
+	if err := n.Writable(); err != nil {
+		return err
+	}
+	return n.raft.RemoveServer(raft.ServerID(id), 0, applyTimeout).Error()
+}
+
+// Snapshot compacts the raft log now instead of waiting for the threshold
+func (n *Node) Snapshot() error {
+	return n.raft.Snapshot().Error()
+}
+
+func (n *Node) Shutdown() error {
+	err := n.raft.Shutdown().Error()
+	n.store.Close()
+	return err
+}
+
+// raftLogLevel maps a log level to the hclog one raft logs at, raft has no fatal logs
+func raftLogLevel(level log.Level) string {
+	switch level {
+	case log.DebugLevel:
+		return "DEBUG"
+	case log.InfoLevel:
+		return "INFO"
+	case log.WarningLevel:
+		return "WARN"
+	case log.ErrorLevel:
+		return "ERROR"
+	default:
+		return "OFF"
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"stupid-kv/base"
+	"stupid-kv/kv"
+	"stupid-kv/txn"
+)
+
+// runCheck validates the data dir offline: STATE.txt, PREPARED.json and
+// the invariants of every version chain. -repair fixes what it can and
+// rolls back the versions of interrupted txns like recovery would.
+func runCheck(args []string) error {
+	f := newCmdFlags("check", false)
+	repair := f.Bool("repair", false, "fix the problems found: salvage a damaged memory data file, relink chains, drop versions of interrupted txns, advance the current tid")
+	cfg, err := f.parse(args)
+	if err != nil {
+		return err
+	}
+	quiet()
+
+	problems := make([]string, 0)
+	state, err := txn.ReadState()
+	stateOK := err == nil
+	if err != nil {
+		problems = append(problems, "STATE.txt: "+err.Error())
+	}
+	prepared, err := txn.ReadPrepared()
+	if err != nil {
+		problems = append(problems, "PREPARED.json: "+err.Error())
+	}
+	// active txns that are not prepared never committed
+	interrupted := make(map[base.Tid]bool)
+	for _, tid := range state.ActiveTids {
+		if _, ok := prepared[tid]; !ok {
+			interrupted[tid] = true
+		}
+	}
+	isInterrupted := func(tid base.Tid) bool { return interrupted[tid] }
+	curTid := state.CurTid
+	if !stateOK {
+		curTid = base.MAX_TID // nothing to compare with
+	}
+
+	salvaged := -1
+	store, err := kv.OpenStore(cfg.Engine)
+	if err != nil {
+		problems = append(problems, err.Error())
+		if *repair && cfg.Engine == base.EngineMemory && errors.Is(err, kv.ErrCorrupted) {
+			if salvaged, err = kv.SalvageDataFile(); err != nil {
+				return fmt.Errorf("salvage: %v", err)
+			}
+			if store, err = kv.OpenStore(cfg.Engine); err != nil {
+				return err
+			}
+		}
+	}
+
+	keys := 0
+	maxBegin := base.NIL_TID
+	if store != nil {
+		for _, key := range store.Keys("", "") {
+			slot, ok := store.Load(key)
+			if !ok {
+				continue
+			}
+			keys++
+			found := slot.Problems(curTid, isInterrupted)
+			for _, p := range found {
+				problems = append(problems, fmt.Sprintf("key %q: %v", key, p))
+			}
+			if *repair && len(found) > 0 {
+				if slot = slot.Repair(isInterrupted); slot.Len() == 0 {
+					store.Delete(key)
+					continue
+				}
+				store.Save(key, slot)
+			}
+			if tid := slot.MaxBegin(); tid > maxBegin {
+				maxBegin = tid
+			}
+		}
+		if *repair {
+			if err := store.Flush(); err != nil {
+				return err
+			}
+		}
+		if err := store.Close(); err != nil {
+			return err
+		}
+	}
+
+	if *repair && len(problems) > 0 {
+		// interrupted txns are rolled back now, prepared ones stay active
+		repaired := txn.State{CurTid: state.CurTid, ActiveTids: make([]base.Tid, 0)}
+		for _, tid := range state.ActiveTids {
+			if !interrupted[tid] {
+				repaired.ActiveTids = append(repaired.ActiveTids, tid)
+			}
+		}
+		if repaired.CurTid <= maxBegin {
+			repaired.CurTid = maxBegin + 1
+		}
+		if err := txn.WriteState(repaired); err != nil {
+			return err
+		}
+	}
+
+	result := map[string]interface{}{"keys": keys, "problems": problems, "repaired": *repair && len(problems) > 0}
+	if salvaged >= 0 {
+		result["salvaged"] = salvaged
+	}
+	err = f.output(result, func() {
+		for _, p := range problems {
+			fmt.Println(p)
+		}
+		if salvaged >= 0 {
+			fmt.Printf("salvaged %v keys before the damage, the damaged file is kept as .corrupt\n", salvaged)
+		}
+		fmt.Printf("%v keys, %v problems\n", keys, len(problems))
+		if *repair && len(problems) > 0 {
+			fmt.Println("repaired")
+		}
+	})
+	if err == nil && len(problems) > 0 && !*repair {
+		err = fmt.Errorf("check found %v problems, run check -repair to fix them", len(problems))
+	}
+	return err
+}
+
+func runCompact(args []string) error {
+	f := newCmdFlags("compact", false)
+	if _, err := f.parse(args); err != nil {
+		return err
+	}
+	quiet()
+
+	// loading recovers interrupted txns, so no txn is active and only the
+	// latest version of each key is readable
+	tm := txn.GetManagerInstance()
+	kvStore := kv.GetManagerInstance()
+	before := kvStore.Stats()
+	removed := kvStore.GC(tm.GetCurrentTid())
+	kvStore.Flush()
+	return f.output(map[string]interface{}{"keys": before.Keys, "versions": before.Versions, "removed": removed}, func() {
+		fmt.Printf("removed %v of %v versions of %v keys\n", removed, before.Versions, before.Keys)
+	})
+}
+
+func runRecover(args []string) error {
+	f := newCmdFlags("recover", false)
+	if _, err := f.parse(args); err != nil {
+		return err
+	}
+	quiet()
+
+	report := txn.GetManagerInstance().Recovery()
+	return f.output(map[string]interface{}{"tids": report.Tids, "versions": report.Versions}, func() {
+		if len(report.Tids) == 0 {
+			fmt.Println("nothing to recover")
+			return
+		}
+		fmt.Printf("rolled back %v versions of interrupted txns %v\n", report.Versions, report.Tids)
+	})
+}
+
+// runPromote asks the replica serving http_addr, or -addr, to become a primary
+func runPromote(args []string) error {
+	f := newCmdFlags("promote", false)
+	addr := f.String("addr", "", "http addr of the replica, http_addr of the config if empty")
+	cfg, err := f.parse(args)
+	if err != nil {
+		return err
+	}
+	if *addr == "" {
+		*addr = cfg.HttpAddr
+	}
+
+	resp, err := http.Post("http://"+*addr+"/replica/promote", "application/json", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	status := map[string]interface{}{}
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return fmt.Errorf("promote %v: %v", *addr, resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("promote %v: %v", *addr, status["error"])
+	}
+	return f.output(status, func() {
+		fmt.Printf("%v is the primary now, drop replicate_from from its config\n", *addr)
+	})
+}
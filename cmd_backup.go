@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"stupid-kv/base"
+	"stupid-kv/cdc"
+	"stupid-kv/pb"
+	"stupid-kv/txn"
+	"time"
+)
+
+// runBackup writes a backup of the local data dir or of -remote to a file,
+// through a temp file so an interrupted backup leaves no partial one
+func runBackup(args []string) error {
+	f := newCmdFlags("backup", true)
+	return withClient(f, args, 1, func(client pb.KVClient, args []string) error {
+		stream, err := client.Backup(context.Background(), &pb.BackupRequest{})
+		if err != nil {
+			return err
+		}
+		path := args[0]
+		out, err := os.Create(path + base.TempSuffix)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(path + base.TempSuffix)
+		defer out.Close()
+
+		size, tid := int64(0), int64(-1)
+		for {
+			chunk, err := stream.Recv()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return err
+			}
+			if _, err := out.Write(chunk.Data); err != nil {
+				return err
+			}
+			size += int64(len(chunk.Data))
+			tid = chunk.Tid
+		}
+		if tid < 0 {
+			return fmt.Errorf("backup stream ended early")
+		}
+		if err := out.Sync(); err != nil {
+			return err
+		}
+		if err := out.Close(); err != nil {
+			return err
+		}
+		if err := os.Rename(path+base.TempSuffix, path); err != nil {
+			return err
+		}
+		return f.output(map[string]interface{}{"file": path, "tid": tid, "bytes": size}, func() {
+			fmt.Printf("backup at tid %v, %v bytes written to %v\n", tid, size, path)
+		})
+	})
+}
+
+// runRestore replaces the local data dir with a backup, then replays the
+// txns committed after it from a cdc log up to a tid or time. The server
+// must not be running on the data dir.
+func runRestore(args []string) error {
+	f := newCmdFlags("restore", false)
+	logPath := f.String("log", "", "the cdc_file to replay after the backup")
+	toTid := f.Int64("to-tid", -1, "replay the txns up to this tid, all if -1")
+	toTime := f.String("to-time", "", "replay the txns committed up to this RFC 3339 time")
+	if _, err := f.parse(args); err != nil {
+		return err
+	}
+	if f.NArg() != 1 {
+		f.Usage()
+		os.Exit(2)
+	}
+	var until time.Time
+	if *toTime != "" {
+		t, err := time.Parse(time.RFC3339, *toTime)
+		if err != nil {
+			return fmt.Errorf("bad -to-time: %v", err)
+		}
+		until = t
+	}
+	if *logPath == "" && (*toTid >= 0 || *toTime != "") {
+		return fmt.Errorf("-to-tid and -to-time need the -log to replay")
+	}
+	quiet()
+
+	in, err := os.Open(f.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tid, open, err := txn.GetManagerInstance().Restore(in)
+	if err != nil {
+		return fmt.Errorf("restore %v: %w", f.Arg(0), err)
+	}
+	if *toTid >= 0 && base.Tid(*toTid) < tid {
+		return fmt.Errorf("the backup is at tid %v, after -to-tid %v", tid, *toTid)
+	}
+
+	replayed, last := 0, base.NIL_TID
+	if *logPath != "" {
+		missed := make(map[base.Tid]bool)
+		for _, tid := range open {
+			missed[tid] = true
+		}
+		keep := func(e cdc.Event) bool {
+			return (e.Tid > tid || missed[e.Tid]) &&
+				(*toTid < 0 || e.Tid <= base.Tid(*toTid)) && (until.IsZero() || !e.CommitTime.After(until))
+		}
+		if replayed, last, err = cdc.Replay(*logPath, keep); err != nil {
+			return fmt.Errorf("replay %v: %w", *logPath, err)
+		}
+	}
+	return f.output(map[string]interface{}{"backup_tid": tid, "open_tids": open, "replayed": replayed, "last_tid": last}, func() {
+		fmt.Printf("restored the backup at tid %v", tid)
+		if *logPath != "" {
+			fmt.Printf(", replayed %v txns up to tid %v", replayed, last)
+		}
+		fmt.Println()
+	})
+}
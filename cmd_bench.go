@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"strconv"
+	"stupid-kv/base"
+	"stupid-kv/txn"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+func runBench(args []string) error {
+	f := newCmdFlags("bench", false)
+	workers := f.Int("workers", 4, "concurrent txns")
+	duration := f.Duration("duration", 10*time.Second, "how long to run")
+	keys := f.Int("keys", 100, "number of keys, fewer keys mean more lock conflicts")
+	f.check = func() error {
+		if *keys <= 0 {
+			return fmt.Errorf("-keys must be positive, got %v", *keys)
+		}
+		return nil
+	}
+	// never write bench keys into a real database by accident
+	tempDir := ""
+	f.defaultDataDir = func() (string, error) {
+		dir, err := ioutil.TempDir("", "stupid-kv-bench")
+		tempDir = dir
+		return dir, err
+	}
+	_, err := f.parse(args)
+	if tempDir != "" {
+		defer os.RemoveAll(tempDir)
+	}
+	if err != nil {
+		return err
+	}
+	quiet()
+
+	tm := txn.GetManagerInstance()
+	setup := tm.BeginTxn()
+	for i := 0; i < *keys; i++ {
+		if err := tm.Put(base.KeyT("bench/"+strconv.Itoa(i)), 0, setup); err != nil {
+			return err
+		}
+	}
+	if err := tm.CommitTxn(setup); err != nil {
+		return err
+	}
+
+	var commits, aborts, latency int64
+	deadline := time.Now().Add(*duration)
+	wg := sync.WaitGroup{}
+	for w := 0; w < *workers; w++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(seed))
+			for time.Now().Before(deadline) {
+				start := time.Now()
+				tid := tm.BeginTxn()
+				tm.Get(base.KeyT("bench/"+strconv.Itoa(r.Intn(*keys))), tid)
+				if err := tm.Inc(base.KeyT("bench/"+strconv.Itoa(r.Intn(*keys))), tid); err != nil {
+					_ = tm.AbortTxn(tid)
+					atomic.AddInt64(&aborts, 1)
+					continue
+				}
+				_ = tm.CommitTxn(tid)
+				atomic.AddInt64(&commits, 1)
+				atomic.AddInt64(&latency, int64(time.Since(start)))
+			}
+		}(int64(w))
+	}
+	wg.Wait()
+
+	result := map[string]interface{}{
+		"workers":        *workers,
+		"seconds":        duration.Seconds(),
+		"commits":        commits,
+		"aborts":         aborts,
+		"txn_per_second": float64(commits) / duration.Seconds(),
+	}
+	if commits > 0 {
+		result["avg_latency_ms"] = float64(latency) / float64(commits) / 1e6
+	}
+	return f.output(result, func() {
+		fmt.Printf("%v workers, %v: %v commits, %v aborts, %.1f txn/s",
+			*workers, *duration, commits, aborts, result["txn_per_second"])
+		if commits > 0 {
+			fmt.Printf(", %.3f ms avg latency", result["avg_latency_ms"])
+		}
+		fmt.Println()
+	})
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"stupid-kv/pb"
+	"stupid-kv/shell"
+)
+
+type keyValue struct {
+	Key   string `json:"key"`
+	Value int64  `json:"value"`
+}
+
+type keyVersion struct {
+	Key   string `json:"key"`
+	Value int64  `json:"value"`
+	Begin int64  `json:"begin"`
+	End   int64  `json:"end"`
+}
+
+// withClient parses the flags and runs fn against the local data dir or a server
+func withClient(f *cmdFlags, args []string, nArgs int, fn func(client pb.KVClient, args []string) error) error {
+	return withAdminClient(f, args, nArgs, func(client *shell.Client, args []string) error {
+		return fn(client, args)
+	})
+}
+
+// withAdminClient is withClient for commands that also use the admin service
+func withAdminClient(f *cmdFlags, args []string, nArgs int, fn func(client *shell.Client, args []string) error) error {
+	if _, err := f.parse(args); err != nil {
+		return err
+	}
+	if nArgs >= 0 && f.NArg() != nArgs {
+		f.Usage()
+		os.Exit(2)
+	}
+	quiet()
+	client, closeClient, err := f.dial()
+	if err != nil {
+		return err
+	}
+	defer closeClient()
+	return fn(client, f.Args())
+}
+
+func runGet(args []string) error {
+	f := newCmdFlags("get", true)
+	return withClient(f, args, 1, func(client pb.KVClient, args []string) error {
+		resp, err := client.Get(context.Background(), &pb.GetRequest{Key: args[0]})
+		if err != nil {
+			return err
+		}
+		return f.output(map[string]interface{}{"key": args[0], "found": resp.Found, "value": resp.Value}, func() {
+			if resp.Found {
+				fmt.Println(resp.Value)
+			} else {
+				fmt.Println("(nil)")
+			}
+		})
+	})
+}
+
+func runPut(args []string) error {
+	f := newCmdFlags("put", true)
+	return withClient(f, args, 2, func(client pb.KVClient, args []string) error {
+		value, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("value must be an integer")
+		}
+		if _, err := client.Put(context.Background(), &pb.PutRequest{Key: args[0], Value: value}); err != nil {
+			return err
+		}
+		return f.output(keyValue{args[0], value}, func() { fmt.Println("OK") })
+	})
+}
+
+func runDel(args []string) error {
+	f := newCmdFlags("del", true)
+	return withClient(f, args, 1, func(client pb.KVClient, args []string) error {
+		resp, err := client.Del(context.Background(), &pb.KeyRequest{Key: args[0]})
+		if err != nil {
+			return err
+		}
+		return f.output(map[string]interface{}{"key": args[0], "deleted": resp.Deleted}, func() {
+			fmt.Println(resp.Deleted)
+		})
+	})
+}
+
+func runDump(args []string) error {
+	f := newCmdFlags("dump", true)
+	history := f.Bool("history", false, "dump every retained version instead of the latest values")
+	return withClient(f, args, 0, func(client pb.KVClient, args []string) error {
+		ctx := context.Background()
+		stream, err := client.Scan(ctx, &pb.ScanRequest{})
+		if err != nil {
+			return err
+		}
+		kvs := make([]keyValue, 0)
+		for {
+			pair, err := stream.Recv()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return err
+			}
+			kvs = append(kvs, keyValue{pair.Key, pair.Value})
+		}
+		if !*history {
+			return f.output(kvs, func() {
+				for _, kv := range kvs {
+					fmt.Println(kv.Key, kv.Value)
+				}
+			})
+		}
+
+		versions := make([]keyVersion, 0)
+		for _, kv := range kvs {
+			resp, err := client.History(ctx, &pb.HistoryRequest{Key: kv.Key})
+			if err != nil {
+				return err
+			}
+			for _, v := range resp.Versions {
+				versions = append(versions, keyVersion{kv.Key, v.Value, v.Begin, v.End})
+			}
+		}
+		return f.output(versions, func() {
+			for _, v := range versions {
+				fmt.Println(v.Key, v.Value, v.Begin, v.End)
+			}
+		})
+	})
+}
+
+func runLoad(args []string) error {
+	f := newCmdFlags("load", true)
+	batch := f.Int("batch", 100, "keys put per txn")
+	return withClient(f, args, -1, func(client pb.KVClient, args []string) error {
+		in := os.Stdin
+		if len(args) > 0 {
+			file, err := os.Open(args[0])
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			in = file
+		}
+		kvs := make([]keyValue, 0)
+		if err := json.NewDecoder(in).Decode(&kvs); err != nil {
+			return fmt.Errorf("expect the json output of dump: %v", err)
+		}
+
+		ctx := context.Background()
+		for start := 0; start < len(kvs); start += *batch {
+			begin, err := client.Begin(ctx, &pb.BeginRequest{})
+			if err != nil {
+				return err
+			}
+			end := start + *batch
+			if end > len(kvs) {
+				end = len(kvs)
+			}
+			for _, kv := range kvs[start:end] {
+				if _, err = client.Put(ctx, &pb.PutRequest{Txn: begin.Txn, Key: kv.Key, Value: kv.Value}); err != nil {
+					break
+				}
+			}
+			if err != nil {
+				_, _ = client.Abort(ctx, &pb.TxnRequest{Txn: begin.Txn})
+				return fmt.Errorf("loaded %v of %v keys: %v", start, len(kvs), err)
+			}
+			if _, err := client.Commit(ctx, &pb.TxnRequest{Txn: begin.Txn}); err != nil {
+				return fmt.Errorf("loaded %v of %v keys: %v", start, len(kvs), err)
+			}
+		}
+		return f.output(map[string]interface{}{"loaded": len(kvs)}, func() {
+			fmt.Printf("loaded %v keys\n", len(kvs))
+		})
+	})
+}
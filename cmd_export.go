@@ -0,0 +1,421 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"stupid-kv/base"
+	"stupid-kv/pb"
+	"stupid-kv/shell"
+)
+
+// exportRow is a line of an export: the latest value of a key, or with
+// -history one retained version, deleted for the version a delete wrote
+type exportRow struct {
+	Key     string `json:"key"`
+	Value   int64  `json:"value"`
+	Begin   *int64 `json:"begin,omitempty"`
+	End     *int64 `json:"end,omitempty"`
+	Deleted bool   `json:"deleted,omitempty"`
+}
+
+var (
+	csvHeader        = []string{"key", "value"}
+	csvHistoryHeader = []string{"key", "value", "begin", "end", "deleted"}
+)
+
+// exportFormat is -as, or guessed from the file name
+func exportFormat(as string, path string) (string, error) {
+	if as == "" {
+		if strings.HasSuffix(path, ".csv") {
+			return "csv", nil
+		}
+		return "jsonl", nil
+	}
+	if as != "jsonl" && as != "csv" {
+		return "", fmt.Errorf("unknown -as %q, jsonl or csv", as)
+	}
+	return as, nil
+}
+
+// rowWriter writes rows as json lines or csv records
+type rowWriter struct {
+	w       *bufio.Writer
+	csv     *csv.Writer
+	history bool
+}
+
+func newRowWriter(w io.Writer, format string, history bool) (*rowWriter, error) {
+	rw := &rowWriter{w: bufio.NewWriter(w), history: history}
+	if format == "csv" {
+		rw.csv = csv.NewWriter(rw.w)
+		header := csvHeader
+		if history {
+			header = csvHistoryHeader
+		}
+		if err := rw.csv.Write(header); err != nil {
+			return nil, err
+		}
+	}
+	return rw, nil
+}
+
+func (rw *rowWriter) write(row exportRow) error {
+	if rw.csv == nil {
+		line, err := json.Marshal(row)
+		if err != nil {
+			return err
+		}
+		_, err = rw.w.Write(append(line, '\n'))
+		return err
+	}
+	record := []string{row.Key, strconv.FormatInt(row.Value, 10)}
+	if rw.history {
+		record = append(record, strconv.FormatInt(*row.Begin, 10), strconv.FormatInt(*row.End, 10), strconv.FormatBool(row.Deleted))
+	}
+	return rw.csv.Write(record)
+}
+
+func (rw *rowWriter) flush() error {
+	if rw.csv != nil {
+		rw.csv.Flush()
+		if err := rw.csv.Error(); err != nil {
+			return err
+		}
+	}
+	return rw.w.Flush()
+}
+
+// rowReader reads the rows rowWriter wrote
+type rowReader struct {
+	lines   *bufio.Scanner
+	csv     *csv.Reader
+	history bool
+	line    int
+}
+
+func newRowReader(r io.Reader, format string, history bool) (*rowReader, error) {
+	rr := &rowReader{history: history}
+	if format == "jsonl" {
+		rr.lines = bufio.NewScanner(r)
+		rr.lines.Buffer(make([]byte, 64<<10), 1<<20)
+		return rr, nil
+	}
+	rr.csv = csv.NewReader(r)
+	header, err := rr.csv.Read()
+	if err != nil {
+		return nil, fmt.Errorf("read csv header: %v", err)
+	}
+	want := csvHeader
+	if history {
+		want = csvHistoryHeader
+	}
+	if strings.Join(header, ",") != strings.Join(want, ",") {
+		return nil, fmt.Errorf("csv header is %q, expect %q", strings.Join(header, ","), strings.Join(want, ","))
+	}
+	rr.line = 1
+	return rr, nil
+}
+
+// next returns the next row, io.EOF after the last one
+func (rr *rowReader) next() (exportRow, error) {
+	var row exportRow
+	rr.line++
+	if rr.lines != nil {
+		for {
+			if !rr.lines.Scan() {
+				if err := rr.lines.Err(); err != nil {
+					return row, err
+				}
+				return row, io.EOF
+			}
+			if len(strings.TrimSpace(rr.lines.Text())) > 0 {
+				break
+			}
+			rr.line++
+		}
+		if err := json.Unmarshal(rr.lines.Bytes(), &row); err != nil {
+			return row, fmt.Errorf("line %v: %v", rr.line, err)
+		}
+		if rr.history && (row.Begin == nil || row.End == nil) {
+			return row, fmt.Errorf("line %v: a version needs begin and end", rr.line)
+		}
+		return row, nil
+	}
+
+	record, err := rr.csv.Read()
+	if err != nil {
+		return row, err
+	}
+	row.Key = record[0]
+	if row.Value, err = strconv.ParseInt(record[1], 10, 64); err != nil {
+		return row, fmt.Errorf("line %v: bad value: %v", rr.line, err)
+	}
+	if rr.history {
+		begin, err1 := strconv.ParseInt(record[2], 10, 64)
+		end, err2 := strconv.ParseInt(record[3], 10, 64)
+		deleted, err3 := strconv.ParseBool(record[4])
+		if err1 != nil || err2 != nil || err3 != nil {
+			return row, fmt.Errorf("line %v: bad begin, end or deleted", rr.line)
+		}
+		row.Begin, row.End, row.Deleted = &begin, &end, deleted
+	}
+	return row, nil
+}
+
+// runExport writes the latest committed values, as of one txn, or every
+// retained version with -history, to a file or stdout
+func runExport(args []string) error {
+	f := newCmdFlags("export", true)
+	as := f.String("as", "", "jsonl or csv, guessed from the file name if empty")
+	history := f.Bool("history", false, "export every retained version with its begin and end tid")
+	return withAdminClient(f, args, -1, func(client *shell.Client, args []string) error {
+		out, path := io.Writer(os.Stdout), ""
+		if len(args) > 0 {
+			path = args[0]
+		}
+		format, err := exportFormat(*as, path)
+		if err != nil {
+			return err
+		}
+		if path != "" {
+			file, err := os.Create(path)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			out = file
+		}
+		rw, err := newRowWriter(out, format, *history)
+		if err != nil {
+			return err
+		}
+
+		ctx := context.Background()
+		rows := 0
+		if !*history {
+			stream, err := client.Scan(ctx, &pb.ScanRequest{})
+			if err != nil {
+				return err
+			}
+			for {
+				pair, err := stream.Recv()
+				if err == io.EOF {
+					break
+				} else if err != nil {
+					return err
+				}
+				if err := rw.write(exportRow{Key: pair.Key, Value: pair.Value}); err != nil {
+					return err
+				}
+				rows++
+			}
+		} else {
+			keys, err := client.Admin.Keys(ctx, &pb.KeysRequest{})
+			if err != nil {
+				return err
+			}
+			for _, key := range keys.Keys {
+				resp, err := client.History(ctx, &pb.HistoryRequest{Key: key})
+				if err != nil {
+					return err
+				}
+				for _, v := range resp.Versions {
+					begin, end := v.Begin, v.End
+					row := exportRow{Key: key, Value: v.Value, Begin: &begin, End: &end}
+					if base.ValueT(v.Value) == base.VALUE_NOT_FOUND {
+						row.Value, row.Deleted = 0, true
+					}
+					if err := rw.write(row); err != nil {
+						return err
+					}
+					rows++
+				}
+			}
+		}
+		if err := rw.flush(); err != nil {
+			return err
+		}
+		if path == "" {
+			return nil
+		}
+		return f.output(map[string]interface{}{"file": path, "rows": rows}, func() {
+			fmt.Printf("exported %v rows to %v\n", rows, path)
+		})
+	})
+}
+
+// runImport puts the rows of an export. Latest values are put in txns of
+// -batch rows, versions with -history replace the versions of their key. The
+// rows done are kept in <file>.progress, so a failed import of a file
+// resumes after the last batch that went in.
+func runImport(args []string) error {
+	f := newCmdFlags("import", true)
+	as := f.String("as", "", "jsonl or csv, guessed from the file name if empty")
+	history := f.Bool("history", false, "import the versions of an export -history")
+	batch := f.Int("batch", 100, "rows per txn")
+	return withAdminClient(f, args, -1, func(client *shell.Client, args []string) error {
+		in, path := io.Reader(os.Stdin), ""
+		if len(args) > 0 {
+			path = args[0]
+		}
+		format, err := exportFormat(*as, path)
+		if err != nil {
+			return err
+		}
+		done, progress := 0, ""
+		if path != "" {
+			file, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			in = file
+			progress = path + ".progress"
+			if data, err := ioutil.ReadFile(progress); err == nil {
+				if done, err = strconv.Atoi(strings.TrimSpace(string(data))); err != nil {
+					return fmt.Errorf("bad %v, remove it to start over: %v", progress, err)
+				}
+			}
+		}
+		rr, err := newRowReader(in, format, *history)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < done; i++ {
+			if _, err := rr.next(); err != nil {
+				return fmt.Errorf("skip %v rows done before: %v", done, err)
+			}
+		}
+		if done > 0 {
+			fmt.Fprintf(os.Stderr, "resuming after %v rows\n", done)
+		}
+
+		imp := &importer{client: client, ctx: context.Background(), done: done, progress: progress}
+		if *history {
+			err = imp.versions(rr)
+		} else {
+			err = imp.values(rr, *batch)
+		}
+		if err != nil {
+			if progress != "" {
+				return fmt.Errorf("imported %v rows, run again to resume: %v", imp.done, err)
+			}
+			return fmt.Errorf("imported %v rows: %v", imp.done, err)
+		}
+		if progress != "" {
+			if err := os.Remove(progress); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		return f.output(map[string]interface{}{"rows": imp.done}, func() {
+			fmt.Printf("imported %v rows\n", imp.done)
+		})
+	})
+}
+
+type importer struct {
+	client   *shell.Client
+	ctx      context.Context
+	done     int    // rows in, counting those of earlier runs
+	progress string // file keeping done, none for stdin
+}
+
+// commit records that n more rows went in
+func (imp *importer) commit(n int) error {
+	imp.done += n
+	if imp.progress == "" {
+		return nil
+	}
+	return base.WriteFile(imp.progress, []byte(strconv.Itoa(imp.done)+"\n"))
+}
+
+// values puts rows in txns of batch rows
+func (imp *importer) values(rr *rowReader, batch int) error {
+	rows := make([]exportRow, 0, batch)
+	for eof := false; !eof; {
+		rows = rows[:0]
+		for len(rows) < batch {
+			row, err := rr.next()
+			if err == io.EOF {
+				eof = true
+				break
+			} else if err != nil {
+				return err
+			}
+			rows = append(rows, row)
+		}
+		if len(rows) == 0 {
+			break
+		}
+		if err := imp.putBatch(rows); err != nil {
+			return err
+		}
+		if err := imp.commit(len(rows)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (imp *importer) putBatch(rows []exportRow) error {
+	begin, err := imp.client.Begin(imp.ctx, &pb.BeginRequest{})
+	if err != nil {
+		return err
+	}
+	for _, row := range rows {
+		if _, err = imp.client.Put(imp.ctx, &pb.PutRequest{Txn: begin.Txn, Key: row.Key, Value: row.Value}); err != nil {
+			break
+		}
+	}
+	if err != nil {
+		_, _ = imp.client.Abort(imp.ctx, &pb.TxnRequest{Txn: begin.Txn})
+		return err
+	}
+	_, err = imp.client.Commit(imp.ctx, &pb.TxnRequest{Txn: begin.Txn})
+	return err
+}
+
+// versions imports the versions of each key, in a row, with Import, so
+// they keep their tids
+func (imp *importer) versions(rr *rowReader) error {
+	var key string
+	versions := make([]*pb.Version, 0)
+	flush := func() error {
+		if len(versions) == 0 {
+			return nil
+		}
+		if _, err := imp.client.Admin.Import(imp.ctx, &pb.ImportRequest{Key: key, Versions: versions}); err != nil {
+			return err
+		}
+		n := len(versions)
+		versions = versions[:0]
+		return imp.commit(n)
+	}
+	for {
+		row, err := rr.next()
+		if err == io.EOF {
+			return flush()
+		} else if err != nil {
+			return err
+		}
+		if row.Key != key {
+			if err := flush(); err != nil {
+				return err
+			}
+			key = row.Key
+		}
+		value := row.Value
+		if row.Deleted {
+			value = int64(base.VALUE_NOT_FOUND)
+		}
+		versions = append(versions, &pb.Version{Value: value, Begin: *row.Begin, End: *row.End})
+	}
+}
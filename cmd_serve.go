@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"stupid-kv/cluster"
+	log "stupid-kv/logutil"
+	"stupid-kv/replica"
+	"stupid-kv/server"
+	"stupid-kv/shard"
+	"stupid-kv/shell"
+)
+
+func runServe(args []string) error {
+	cfg, err := newCmdFlags("serve", false).parse(args)
+	if err != nil {
+		return err
+	}
+
+	// the node must replicate before the first txn, and joins through another node
+	httpServer := server.NewHttpServer(cfg.HttpAddr, cfg.TxnIdleTimeout)
+	if cfg.RaftAddr != "" {
+		node, err := cluster.NewNode(cfg)
+		if err != nil {
+			return err
+		}
+		defer node.Shutdown()
+		httpServer.Handle("/cluster/", node.Handler())
+	} else if cfg.ReplAddr != "" || cfg.ReplicateFrom != "" {
+		node, err := replica.NewNode(cfg)
+		if err != nil {
+			return err
+		}
+		defer node.Close()
+		httpServer.Handle("/replica/", node.Handler())
+	}
+
+	errs := make(chan error, 3)
+	go func() {
+		errs <- server.NewRespServer(cfg.RespAddr).ListenAndServe()
+	}()
+	go func() {
+		errs <- httpServer.ListenAndServe()
+	}()
+	go func() {
+		errs <- server.NewGrpcServer(cfg.GrpcAddr, cfg.TxnIdleTimeout).ListenAndServe()
+	}()
+	return <-errs
+}
+
+func runShell(args []string) error {
+	f := newCmdFlags("shell", true)
+	if _, err := f.parse(args); err != nil {
+		return err
+	}
+	quiet()
+
+	client, closeClient, err := f.dial()
+	if err != nil {
+		return err
+	}
+	defer closeClient()
+	return shell.New(client).Run()
+}
+
+// runRoute serves the grpc api on grpc_addr and rebalancing on http_addr,
+// the data dir only keeps the 2pc log.
+func runRoute(args []string) error {
+	cfg, err := newCmdFlags("route", false).parse(args)
+	if err != nil {
+		return err
+	}
+	shards := make([]string, 0)
+	for _, shard := range strings.Split(cfg.Shards, ",") {
+		if shard = strings.TrimSpace(shard); shard != "" {
+			shards = append(shards, shard)
+		}
+	}
+	if len(shards) == 0 {
+		return fmt.Errorf("route needs shards, e.g. shards = \"127.0.0.1:9091,127.0.0.1:9092\"")
+	}
+
+	router, err := shard.NewRouter(cfg.GrpcAddr, shards, cfg.TxnIdleTimeout)
+	if err != nil {
+		return err
+	}
+	defer router.Close()
+	errs := make(chan error, 2)
+	go func() {
+		errs <- router.ListenAndServe()
+	}()
+	go func() {
+		log.Infof("router admin listens on %v", cfg.HttpAddr)
+		errs <- http.ListenAndServe(cfg.HttpAddr, router.Handler())
+	}()
+	return <-errs
+}
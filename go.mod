@@ -1,3 +1,12 @@
 module stupid-kv
 
 go 1.15
+
+require (
+	github.com/boltdb/bolt v1.3.1 // indirect
+	github.com/hashicorp/raft v1.3.1
+	github.com/hashicorp/raft-boltdb v0.0.0-20171010151810-6e5ba93211ea
+	golang.org/x/term v0.0.0-20201126162022-7de9c90e9dd1
+	google.golang.org/grpc v1.43.0
+	google.golang.org/protobuf v1.27.1
+)
@@ -0,0 +1,294 @@
+package kv
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"stupid-kv/base"
+	"sync"
+)
+
+// The data file of the memory engine and the snapshots sent to replicas:
+//
+//	header:  magic "stkvdata" | version u32 | crc32c of the 12 bytes before u32
+//	block:   length u32 | crc32c of the records u32 | records
+//	record:  uvarint key length | key | uvarint chain length | chain (ValueSlot.MarshalBinary)
+//	trailer: 0 u32 | crc32c of the count u32 | count of records u64
+//
+// integers are little endian, a block holds records up to blockSize bytes
+const (
+	DataFile       = "DATA.bin"
+	legacyDataFile = "DATA.json"
+
+	dataMagic   = "stkvdata"
+	dataVersion = 1
+	headerSize  = 16
+	blockSize   = 64 << 10
+)
+
+var (
+	ErrCorrupted = errors.New("kv: corrupted data")
+	castagnoli   = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// DataWriter streams chains in the data file format to w
+type DataWriter struct {
+	w     io.Writer
+	block []byte
+	count uint64
+}
+
+// NewDataWriter writes the header, Add the chains in key order and Close
+func NewDataWriter(w io.Writer) (*DataWriter, error) {
+	var header [headerSize]byte
+	copy(header[:], dataMagic)
+	binary.LittleEndian.PutUint32(header[8:], dataVersion)
+	binary.LittleEndian.PutUint32(header[12:], crc32.Checksum(header[:12], castagnoli))
+	if _, err := w.Write(header[:]); err != nil {
+		return nil, err
+	}
+	return &DataWriter{w: w, block: make([]byte, 0, blockSize)}, nil
+}
+
+func (d *DataWriter) Add(key base.KeyT, slot ValueSlot) error {
+	chain, err := slot.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	var tmp [binary.MaxVarintLen64]byte
+	d.block = append(d.block, tmp[:binary.PutUvarint(tmp[:], uint64(len(key)))]...)
+	d.block = append(d.block, key...)
+	d.block = append(d.block, tmp[:binary.PutUvarint(tmp[:], uint64(len(chain)))]...)
+	d.block = append(d.block, chain...)
+	d.count++
+	if len(d.block) >= blockSize {
+		return d.writeBlock()
+	}
+	return nil
+}
+
+func (d *DataWriter) writeBlock() error {
+	var head [8]byte
+	binary.LittleEndian.PutUint32(head[:4], uint32(len(d.block)))
+	binary.LittleEndian.PutUint32(head[4:], crc32.Checksum(d.block, castagnoli))
+	if _, err := d.w.Write(head[:]); err != nil {
+		return err
+	}
+	_, err := d.w.Write(d.block)
+	d.block = d.block[:0]
+	return err
+}
+
+// Close writes the last block and the trailer, it does not close w
+func (d *DataWriter) Close() error {
+	if len(d.block) > 0 {
+		if err := d.writeBlock(); err != nil {
+			return err
+		}
+	}
+	var trailer [16]byte
+	binary.LittleEndian.PutUint64(trailer[8:], d.count)
+	binary.LittleEndian.PutUint32(trailer[4:], crc32.Checksum(trailer[8:], castagnoli))
+	_, err := d.w.Write(trailer[:])
+	return err
+}
+
+// MarshalData encodes the chains of m sorted by key
+func MarshalData(m *sync.Map) ([]byte, error) {
+	keys := make([]base.KeyT, 0)
+	m.Range(func(k, v interface{}) bool {
+		keys = append(keys, k.(base.KeyT))
+		return true
+	})
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+
+	buf := &bytes.Buffer{}
+	d, err := NewDataWriter(buf)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		v, _ := m.Load(key)
+		if err := d.Add(key, v.(ValueSlot)); err != nil {
+			return nil, err
+		}
+	}
+	if err := d.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalData decodes MarshalData, or the json of DATA.json from before
+// the binary format. Damaged data returns an error wrapping ErrCorrupted.
+func UnmarshalData(data []byte) (*sync.Map, error) {
+	m := &sync.Map{}
+	err := ReadData(bytes.NewReader(data), func(key base.KeyT, slot ValueSlot) error {
+		m.Store(key, slot)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// ReadData calls fn with every chain of the data file format in r, or of the
+// json of DATA.json. A chain is only passed on once its block checked out,
+// but a damaged block stops ReadData with an error wrapping ErrCorrupted
+// after fn got the chains before it.
+func ReadData(r io.Reader, fn func(key base.KeyT, slot ValueSlot) error) error {
+	br := bufio.NewReader(r)
+	if first, err := br.Peek(1); err == nil && first[0] == '{' {
+		data, err := ioutil.ReadAll(br)
+		if err != nil {
+			return err
+		}
+		m, err := unmarshalJSON(data)
+		if err != nil {
+			return err
+		}
+		var ferr error
+		m.Range(func(k, v interface{}) bool {
+			ferr = fn(k.(base.KeyT), v.(ValueSlot))
+			return ferr == nil
+		})
+		return ferr
+	}
+
+	var header [headerSize]byte
+	if _, err := io.ReadFull(br, header[:]); err != nil || string(header[:8]) != dataMagic {
+		return fmt.Errorf("%w: no stupid-kv data header", ErrCorrupted)
+	}
+	if binary.LittleEndian.Uint32(header[12:16]) != crc32.Checksum(header[:12], castagnoli) {
+		return fmt.Errorf("%w: header checksum mismatch", ErrCorrupted)
+	}
+	if v := binary.LittleEndian.Uint32(header[8:12]); v != dataVersion {
+		return fmt.Errorf("unsupported data format version %v", v)
+	}
+
+	count := uint64(0)
+	var head [8]byte
+	for off := int64(headerSize); ; {
+		if _, err := io.ReadFull(br, head[:]); err != nil {
+			return fmt.Errorf("%w: truncated at offset %v", ErrCorrupted, off)
+		}
+		length := binary.LittleEndian.Uint32(head[:4])
+		sum := binary.LittleEndian.Uint32(head[4:])
+		if length == 0 {
+			var n [8]byte
+			if _, err := io.ReadFull(br, n[:]); err != nil || sum != crc32.Checksum(n[:], castagnoli) {
+				return fmt.Errorf("%w: bad trailer at offset %v", ErrCorrupted, off)
+			}
+			if _, err := br.ReadByte(); err != io.EOF {
+				return fmt.Errorf("%w: data after the trailer at offset %v", ErrCorrupted, off)
+			}
+			if n := binary.LittleEndian.Uint64(n[:]); n != count {
+				return fmt.Errorf("%w: %v keys, trailer says %v", ErrCorrupted, count, n)
+			}
+			return nil
+		}
+		if length > 1<<30 {
+			return fmt.Errorf("%w: block at offset %v is %v bytes", ErrCorrupted, off, length)
+		}
+		block := make([]byte, length)
+		if _, err := io.ReadFull(br, block); err != nil {
+			return fmt.Errorf("%w: truncated block at offset %v", ErrCorrupted, off)
+		}
+		if sum != crc32.Checksum(block, castagnoli) {
+			return fmt.Errorf("%w: block at offset %v checksum mismatch", ErrCorrupted, off)
+		}
+		for len(block) > 0 {
+			key, rest, ok := readField(block)
+			chain, rest2, ok2 := readField(rest)
+			if !ok || !ok2 {
+				return fmt.Errorf("%w: bad record in block at offset %v", ErrCorrupted, off)
+			}
+			var slot ValueSlot
+			if err := slot.UnmarshalBinary(chain); err != nil {
+				return fmt.Errorf("%w: key %q: %v", ErrCorrupted, key, err)
+			}
+			if err := fn(base.KeyT(key), slot); err != nil {
+				return err
+			}
+			count++
+			block = rest2
+		}
+		off += 8 + int64(length)
+	}
+}
+
+// readField reads a uvarint length prefixed field
+func readField(data []byte) ([]byte, []byte, bool) {
+	n, l := binary.Uvarint(data)
+	if l <= 0 || n > uint64(len(data)-l) {
+		return nil, nil, false
+	}
+	return data[l : l+int(n)], data[l+int(n):], true
+}
+
+// unmarshalJSON reads the old DATA.json, every chain a string of
+// "value begin end" triples
+func unmarshalJSON(data []byte) (*sync.Map, error) {
+	var tmpMap map[string]string
+	if err := json.Unmarshal(data, &tmpMap); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorrupted, err)
+	}
+	m := &sync.Map{}
+	for key, value := range tmpMap {
+		fields := strings.Fields(value)
+		if len(fields)%3 != 0 {
+			return nil, fmt.Errorf("%w: key %q: %v numbers in chain", ErrCorrupted, key, len(fields))
+		}
+		slot := ValueSlot{
+			values:    make([]base.ValueT, 0, len(fields)/3),
+			tidsBegin: make([]base.Tid, 0, len(fields)/3),
+			tidsEnd:   make([]base.Tid, 0, len(fields)/3),
+		}
+		var nums [3]int
+		for i := 0; i < len(fields); i += 3 {
+			for j := range nums {
+				n, err := strconv.Atoi(fields[i+j])
+				if err != nil {
+					return nil, fmt.Errorf("%w: key %q: %v", ErrCorrupted, key, err)
+				}
+				nums[j] = n
+			}
+			slot.values = append(slot.values, base.ValueT(nums[0]))
+			slot.tidsBegin = append(slot.tidsBegin, base.Tid(nums[1]))
+			slot.tidsEnd = append(slot.tidsEnd, base.Tid(nums[2]))
+		}
+		m.Store(base.KeyT(key), slot)
+	}
+	return m, nil
+}
+
+// ReadDataFile reads the data file of the memory engine, or DATA.json if the
+// data dir has not been flushed in the binary format yet. Without either it
+// returns the not exist error of DATA.json.
+func ReadDataFile() (*sync.Map, error) {
+	path := base.DataPath(DataFile)
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		path = base.DataPath(legacyDataFile)
+		data, err = ioutil.ReadFile(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	m, err := UnmarshalData(data)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", path, err)
+	}
+	return m, nil
+}
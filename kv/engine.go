@@ -0,0 +1,115 @@
+package kv
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"stupid-kv/base"
+	log "stupid-kv/logutil"
+	"sync"
+)
+
+// StorageEngine is the mvcc store txn.Manager runs on. Manager implements it
+// over any Store, other engines only have to keep the same version semantics.
+type StorageEngine interface {
+	Put(key base.KeyT, value base.ValueT, tid base.Tid)
+	Get(key base.KeyT, tid base.Tid, activeTids []base.Tid) (base.ValueT, base.Tid)
+	Inc(key base.KeyT, tid base.Tid) base.ValueT
+	Dec(key base.KeyT, tid base.Tid) base.ValueT
+	Del(key base.KeyT, tid base.Tid)
+	UnrollKeyByTid(key base.KeyT, tid base.Tid)
+	RollbackTid(tid base.Tid) int
+	Flush()
+	Keys(start base.KeyT, end base.KeyT) []base.KeyT
+
+	History(key base.KeyT) []Version
+	Ingest(key base.KeyT, versions []Version)
+	Drop(key base.KeyT) bool
+	GC(watermark base.Tid) int
+	Stats() Stats
+	Snapshot() ([]byte, error)
+	Restore(r io.Reader) error
+	Close() error
+}
+
+// Store keeps the version chain of every key, Manager serializes the access
+// to a key so a Store only has to be safe for different keys at once.
+type Store interface {
+	Load(key base.KeyT) (ValueSlot, bool)
+	Save(key base.KeyT, slot ValueSlot)
+	Delete(key base.KeyT)
+	Keys(start base.KeyT, end base.KeyT) []base.KeyT // sorted, an empty end means no upper bound
+	Flush() error
+	Close() error
+}
+
+// Compacter is a Store that drops old versions while it compacts, Manager.GC
+// hands it the watermark instead of rewriting every chain.
+type Compacter interface {
+	Compact(watermark base.Tid) int
+}
+
+// StatsStore is a Store with its own counters, like block cache hits
+type StatsStore interface {
+	StoreStats() map[string]int64
+}
+
+// StoreOpener opens a Store in the configured data dir
+type StoreOpener func() (Store, error)
+
+var openers = map[string]StoreOpener{
+	base.EngineMemory: func() (Store, error) { return openMemStore() },
+}
+
+// RegisterStore makes a Store available as the storage_engine name, engines
+// in other packages register themselves in init.
+func RegisterStore(name string, open StoreOpener) {
+	openers[name] = open
+}
+
+func Engines() []string {
+	names := make([]string, 0, len(openers))
+	for name := range openers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+var instance StorageEngine
+var once sync.Once
+
+// SetEngine replaces the engine before the first GetManagerInstance, e.g. to
+// run the txn layer on another engine in tests.
+func SetEngine(e StorageEngine) {
+	once.Do(func() {})
+	instance = e
+}
+
+func GetManagerInstance() StorageEngine {
+	once.Do(func() {
+		name := base.GetConfig().Engine
+		log.Info("KV storage engine ", name, " starts to init")
+		if err := base.RemoveTempFiles(base.GetConfig().DataDir); err != nil {
+			log.Warning("remove temp files: ", err)
+		}
+		store, err := OpenStore(name)
+		if err != nil {
+			log.Fatal(err)
+		}
+		instance = NewManager(store)
+	})
+	return instance
+}
+
+func OpenStore(name string) (Store, error) {
+	open, ok := openers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown storage engine %q, have %v", name, Engines())
+	}
+	store, err := open()
+	if err != nil {
+		return nil, fmt.Errorf("open %v storage engine: %w", name, err)
+	}
+	return store, nil
+}
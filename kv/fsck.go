@@ -0,0 +1,119 @@
+package kv
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"stupid-kv/base"
+	"sync"
+)
+
+// Problems lists how the chain breaks its invariants: parallel slices of
+// one length, begin tids in order, each version ending where the next
+// begins and the last at MAX_TID, no begin tid at or after curTid and none
+// of a txn interrupted while active.
+func (slot ValueSlot) Problems(curTid base.Tid, interrupted func(tid base.Tid) bool) []string {
+	problems := make([]string, 0)
+	n := len(slot.values)
+	if len(slot.tidsBegin) != n || len(slot.tidsEnd) != n {
+		problems = append(problems, fmt.Sprintf("%v values but %v begin and %v end tids", n, len(slot.tidsBegin), len(slot.tidsEnd)))
+		n = minLen(slot)
+	}
+	if n == 0 {
+		return append(problems, "no versions")
+	}
+	for i := 0; i < n; i++ {
+		begin := slot.tidsBegin[i]
+		if i > 0 && begin < slot.tidsBegin[i-1] {
+			problems = append(problems, fmt.Sprintf("version %v begins at tid %v, before version %v at %v", i, begin, i-1, slot.tidsBegin[i-1]))
+		}
+		if i < n-1 && slot.tidsEnd[i] != slot.tidsBegin[i+1] {
+			problems = append(problems, fmt.Sprintf("version %v ends at tid %v but the next begins at %v", i, slot.tidsEnd[i], slot.tidsBegin[i+1]))
+		}
+		if begin >= curTid {
+			problems = append(problems, fmt.Sprintf("version %v begins at tid %v, not before the current tid %v", i, begin, curTid))
+		}
+		if interrupted(begin) {
+			problems = append(problems, fmt.Sprintf("version %v was written by tid %v, still active in STATE.txt", i, begin))
+		}
+	}
+	if end := slot.tidsEnd[n-1]; end != base.MAX_TID {
+		problems = append(problems, fmt.Sprintf("the last version ends at tid %v instead of MAX_TID", end))
+	}
+	return problems
+}
+
+// Repair drops the versions past the shortest slice and those of
+// interrupted txns, sorts the rest by begin tid and relinks their end tids.
+// The result may have no versions left.
+func (slot ValueSlot) Repair(interrupted func(tid base.Tid) bool) ValueSlot {
+	versions := make([]Version, 0, len(slot.values))
+	for i := 0; i < minLen(slot); i++ {
+		if !interrupted(slot.tidsBegin[i]) {
+			versions = append(versions, Version{Value: slot.values[i], Begin: slot.tidsBegin[i]})
+		}
+	}
+	sort.SliceStable(versions, func(i, j int) bool { return versions[i].Begin < versions[j].Begin })
+	for i := range versions {
+		versions[i].End = base.MAX_TID
+		if i < len(versions)-1 {
+			versions[i].End = versions[i+1].Begin
+		}
+	}
+	return NewValueSlot(versions)
+}
+
+// MaxBegin is the newest begin tid of the chain, NIL_TID if it has none
+func (slot ValueSlot) MaxBegin() base.Tid {
+	max := base.NIL_TID
+	for _, tid := range slot.tidsBegin {
+		if tid > max {
+			max = tid
+		}
+	}
+	return max
+}
+
+func minLen(slot ValueSlot) int {
+	n := len(slot.values)
+	if len(slot.tidsBegin) < n {
+		n = len(slot.tidsBegin)
+	}
+	if len(slot.tidsEnd) < n {
+		n = len(slot.tidsEnd)
+	}
+	return n
+}
+
+// SalvageDataFile rewrites a damaged data file of the memory engine with the
+// chains before the damage and keeps the damaged file as <file>.corrupt.
+// It returns how many keys were kept.
+func SalvageDataFile() (int, error) {
+	path := base.DataPath(DataFile)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		path = base.DataPath(legacyDataFile)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	m := &sync.Map{}
+	kept := 0
+	err = ReadData(f, func(key base.KeyT, slot ValueSlot) error {
+		m.Store(key, slot)
+		kept++
+		return nil
+	})
+	f.Close()
+	if err == nil {
+		return kept, nil
+	}
+	data, err := MarshalData(m)
+	if err != nil {
+		return 0, err
+	}
+	if err := os.Rename(path, path+".corrupt"); err != nil {
+		return 0, err
+	}
+	return kept, base.WriteFile(base.DataPath(DataFile), data)
+}
@@ -0,0 +1,34 @@
+package kv
+
+import (
+	"hash/fnv"
+	"stupid-kv/base"
+	"sync"
+)
+
+func (m *Manager) getGuard(key base.KeyT) *sync.RWMutex {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return &m.slotGuard[h.Sum32()%slotGuards]
+}
+
+// GC drops versions whose tidsEnd is below watermark (the oldest tid any txn
+// may still read at), returns the number of versions removed.
+func (m *Manager) GC(watermark base.Tid) int {
+	if c, ok := m.store.(Compacter); ok {
+		return c.Compact(watermark)
+	}
+	removed := 0
+	for _, key := range m.store.Keys("", "") {
+		guard := m.getGuard(key)
+		guard.Lock()
+		if slotCopy, ok := m.store.Load(key); ok {
+			if trimmed, n := slotCopy.Trim(watermark); n > 0 {
+				m.store.Save(key, trimmed)
+				removed += n
+			}
+		}
+		guard.Unlock()
+	}
+	return removed
+}
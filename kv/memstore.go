@@ -0,0 +1,74 @@
+package kv
+
+import (
+	"os"
+	"sort"
+	"stupid-kv/base"
+	"sync"
+)
+
+// memStore keeps every chain in memory and rewrites DATA.bin on flush
+type memStore struct {
+	kv *sync.Map
+}
+
+func openMemStore() (*memStore, error) {
+	s := &memStore{kv: &sync.Map{}}
+	m, err := ReadDataFile()
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	s.kv = m
+	return s, nil
+}
+
+func (s *memStore) Load(key base.KeyT) (ValueSlot, bool) {
+	slot, ok := s.kv.Load(key)
+	if !ok {
+		return ValueSlot{}, false
+	}
+	return slot.(ValueSlot), true
+}
+
+func (s *memStore) Save(key base.KeyT, slot ValueSlot) {
+	s.kv.Store(key, slot)
+}
+
+func (s *memStore) Delete(key base.KeyT) {
+	s.kv.Delete(key)
+}
+
+func (s *memStore) Keys(start base.KeyT, end base.KeyT) []base.KeyT {
+	keys := make([]base.KeyT, 0)
+	s.kv.Range(func(k, v interface{}) bool {
+		key := k.(base.KeyT)
+		if key >= start && (end == "" || key < end) {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys
+}
+
+func (s *memStore) Flush() error {
+	data, err := MarshalData(s.kv)
+	if err != nil {
+		return err
+	}
+	if err := base.WriteFile(base.DataPath(DataFile), data); err != nil {
+		return err
+	}
+	FlushBytes.Add(int64(len(data)))
+	// DATA.json is only read while DATA.bin does not exist
+	if err := os.Remove(base.DataPath(legacyDataFile)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *memStore) Close() error {
+	return nil
+}
@@ -0,0 +1,15 @@
+package kv
+
+import (
+	"stupid-kv/metrics"
+)
+
+var (
+	// FlushBytes is added to by every storage engine for the bytes a Flush writes
+	FlushBytes = metrics.NewCounter("stupidkv_flush_bytes_total", "Bytes written by storage engine flushes.")
+
+	flushDuration = metrics.NewHistogram("stupidkv_flush_duration_seconds",
+		"Duration of kv.Manager flushes.", metrics.DurationBuckets)
+	chainLength = metrics.NewHistogram("stupidkv_version_chain_length",
+		"Version chain length of a key after a write.", metrics.ExpBuckets(1, 2, 11))
+)
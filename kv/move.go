@@ -0,0 +1,43 @@
+package kv
+
+import (
+	"stupid-kv/base"
+)
+
+// NewValueSlot makes a chain of versions, oldest first
+func NewValueSlot(versions []Version) ValueSlot {
+	slot := ValueSlot{
+		values:    make([]base.ValueT, 0, len(versions)),
+		tidsBegin: make([]base.Tid, 0, len(versions)),
+		tidsEnd:   make([]base.Tid, 0, len(versions)),
+	}
+	for _, v := range versions {
+		slot.values = append(slot.values, v.Value)
+		slot.tidsBegin = append(slot.tidsBegin, v.Begin)
+		slot.tidsEnd = append(slot.tidsEnd, v.End)
+	}
+	return slot
+}
+
+// Ingest replaces every version of key, for keys moved in from another store
+func (m *Manager) Ingest(key base.KeyT, versions []Version) {
+	slot := NewValueSlot(versions)
+	guard := m.getGuard(key)
+	guard.Lock()
+	defer guard.Unlock()
+	if len(slot.values) == 0 {
+		m.store.Delete(key)
+	} else {
+		m.store.Save(key, slot)
+	}
+}
+
+// Drop removes key with all its versions, returns false if there was none
+func (m *Manager) Drop(key base.KeyT) bool {
+	guard := m.getGuard(key)
+	guard.Lock()
+	defer guard.Unlock()
+	_, ok := m.store.Load(key)
+	m.store.Delete(key)
+	return ok
+}
@@ -0,0 +1,11 @@
+package kv
+
+import (
+	"stupid-kv/base"
+)
+
+// Keys returns the sorted keys in [start, end), an empty end means no upper bound.
+// Keys whose versions are all invisible or deleted are included, callers Get them.
+func (m *Manager) Keys(start base.KeyT, end base.KeyT) []base.KeyT {
+	return m.store.Keys(start, end)
+}
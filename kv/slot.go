@@ -0,0 +1,81 @@
+package kv
+
+import (
+	"encoding/binary"
+	"errors"
+	"stupid-kv/base"
+)
+
+var ErrBadSlot = errors.New("kv: corrupted version chain")
+
+// MarshalBinary encodes the chain as uvarint count and varint value, begin, end
+// of every version, for stores that keep chains as bytes
+func (slot ValueSlot) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, binary.MaxVarintLen64*(1+3*len(slot.values)))
+	n := binary.PutUvarint(buf, uint64(len(slot.values)))
+	for i := range slot.values {
+		n += binary.PutVarint(buf[n:], int64(slot.values[i]))
+		n += binary.PutVarint(buf[n:], int64(slot.tidsBegin[i]))
+		n += binary.PutVarint(buf[n:], int64(slot.tidsEnd[i]))
+	}
+	return buf[:n], nil
+}
+
+func (slot *ValueSlot) UnmarshalBinary(data []byte) error {
+	n, l := binary.Uvarint(data)
+	if l <= 0 || n > uint64(len(data)) {
+		return ErrBadSlot
+	}
+	data = data[l:]
+	values := make([]base.ValueT, n)
+	tidsBegin := make([]base.Tid, n)
+	tidsEnd := make([]base.Tid, n)
+	for i := uint64(0); i < n; i++ {
+		var fields [3]int64
+		for j := range fields {
+			if fields[j], l = binary.Varint(data); l <= 0 {
+				return ErrBadSlot
+			}
+			data = data[l:]
+		}
+		values[i], tidsBegin[i], tidsEnd[i] = base.ValueT(fields[0]), base.Tid(fields[1]), base.Tid(fields[2])
+	}
+	if len(data) != 0 {
+		return ErrBadSlot
+	}
+	slot.values, slot.tidsBegin, slot.tidsEnd = values, tidsBegin, tidsEnd
+	return nil
+}
+
+// Len is the number of versions in the chain
+func (slot ValueSlot) Len() int {
+	return len(slot.values)
+}
+
+// clone returns a copy of the slot that later writes to it do not touch
+func (slot ValueSlot) clone() ValueSlot {
+	return ValueSlot{
+		values:    append([]base.ValueT{}, slot.values...),
+		tidsBegin: append([]base.Tid{}, slot.tidsBegin...),
+		tidsEnd:   append([]base.Tid{}, slot.tidsEnd...),
+	}
+}
+
+// Trim returns the slot without the versions ending below watermark, the
+// latest version is always kept.
+func (slot ValueSlot) Trim(watermark base.Tid) (ValueSlot, int) {
+	i := 0
+	for ; i < len(slot.values)-1; i++ {
+		if slot.tidsEnd[i] >= watermark {
+			break
+		}
+	}
+	if i == 0 {
+		return slot, 0
+	}
+	return ValueSlot{
+		values:    append([]base.ValueT{}, slot.values[i:]...),
+		tidsBegin: append([]base.Tid{}, slot.tidsBegin[i:]...),
+		tidsEnd:   append([]base.Tid{}, slot.tidsEnd[i:]...),
+	}, i
+}
@@ -0,0 +1,44 @@
+package kv
+
+import (
+	"io"
+	"stupid-kv/base"
+	"sync"
+)
+
+// Snapshot returns the whole store in the data file format, each slot is
+// copied under its guard since Put changes the newest version in place
+func (m *Manager) Snapshot() ([]byte, error) {
+	m.flushGuard.Lock()
+	defer m.flushGuard.Unlock()
+	tmpMap := &sync.Map{}
+	for _, key := range m.store.Keys("", "") {
+		guard := m.getGuard(key)
+		guard.RLock()
+		if slot, ok := m.store.Load(key); ok {
+			tmpMap.Store(key, slot.clone())
+		}
+		guard.RUnlock()
+	}
+	return MarshalData(tmpMap)
+}
+
+// Restore replaces the whole store with a Snapshot read from r and flushes it.
+// A damaged snapshot stops it with the keys before the damage restored.
+func (m *Manager) Restore(r io.Reader) error {
+	for i := range m.slotGuard {
+		m.slotGuard[i].Lock()
+	}
+	for _, key := range m.store.Keys("", "") {
+		m.store.Delete(key)
+	}
+	err := ReadData(r, func(key base.KeyT, slot ValueSlot) error {
+		m.store.Save(key, slot)
+		return nil
+	})
+	for i := range m.slotGuard {
+		m.slotGuard[i].Unlock()
+	}
+	m.Flush()
+	return err
+}
@@ -0,0 +1,47 @@
+package kv
+
+import "stupid-kv/base"
+
+// Version is one mvcc version of a key, visible to tids in [Begin, End]
+type Version struct {
+	Value base.ValueT
+	Begin base.Tid
+	End   base.Tid
+}
+
+// History returns the retained versions of key, oldest first.
+func (m *Manager) History(key base.KeyT) []Version {
+	guard := m.getGuard(key)
+	guard.RLock()
+	defer guard.RUnlock()
+
+	slotCopy, ok := m.store.Load(key)
+	if !ok {
+		return []Version{}
+	}
+	versions := make([]Version, 0, len(slotCopy.values))
+	for i := range slotCopy.values {
+		versions = append(versions, Version{slotCopy.values[i], slotCopy.tidsBegin[i], slotCopy.tidsEnd[i]})
+	}
+	return versions
+}
+
+type Stats struct {
+	Keys     int
+	Versions int
+	Engine   map[string]int64 // counters of the store, see StatsStore
+}
+
+func (m *Manager) Stats() Stats {
+	stats := Stats{Engine: map[string]int64{}}
+	if s, ok := m.store.(StatsStore); ok {
+		stats.Engine = s.StoreStats()
+	}
+	for _, key := range m.store.Keys("", "") {
+		if slot, ok := m.store.Load(key); ok {
+			stats.Keys++
+			stats.Versions += len(slot.values)
+		}
+	}
+	return stats
+}
@@ -1,7 +1,6 @@
 package kv
 
 import (
-	"io/ioutil"
 	"stupid-kv/base"
 	log "stupid-kv/logutil"
 	"sync"
@@ -13,65 +12,47 @@ type ValueSlot struct {
 	tidsEnd   []base.Tid // support mvcc
 }
 
+// Manager runs mvcc over the version chains of a Store
 type Manager struct {
-	//kv map[base.KeyT]ValueSlot
-	kv         *sync.Map
-	slotGuard  map[base.KeyT]*sync.RWMutex
-	mapGuard   *sync.Mutex // used for guarding slotguard (concurrent map modify)
+	store      Store
+	slotGuard  [slotGuards]sync.RWMutex // striped by key, so disk stores keep no per key state
 	flushGuard *sync.Mutex
 }
 
-var instance *Manager
-var once sync.Once
-
-func GetManagerInstance() *Manager {
-	once.Do(func() {
-		log.Info("KV manager starts to init")
-		instance = &Manager{
-			//kv: make(map[base.KeyT]ValueSlot),
-			kv:         &sync.Map{},
-			flushGuard: &sync.Mutex{},
-			slotGuard:  make(map[base.KeyT]*sync.RWMutex),
-			mapGuard:   &sync.Mutex{},
-		}
-		if _, err := ioutil.ReadFile("DATA.json"); err == nil {
-			instance.Load()
-		}
-	})
-	return instance
+const slotGuards = 256
+
+func NewManager(store Store) *Manager {
+	return &Manager{
+		store:      store,
+		flushGuard: &sync.Mutex{},
+	}
 }
 
 func (m *Manager) Put(key base.KeyT, value base.ValueT, tid base.Tid) {
-	m.mapGuard.Lock()
-	_, ok := m.slotGuard[key]
-	if !ok {
-		m.slotGuard[key] = &sync.RWMutex{}
-	}
-	guard, _ := m.slotGuard[key]
+	guard := m.getGuard(key)
 	guard.Lock()
 	defer guard.Unlock()
-	m.mapGuard.Unlock()
-	if slotCopy, ok := m.kv.Load(key); ok {
-		slotCopy := slotCopy.(ValueSlot)
-
+	if slotCopy, ok := m.store.Load(key); ok {
 		length := len(slotCopy.values)
 		slotCopy.tidsEnd[length-1] = tid // update last tid
 
 		if tid < slotCopy.tidsBegin[length-1] {
-			log.Error("write cover with older tid")
+			log.With("key", key, "tid", tid, "last_begin", slotCopy.tidsBegin[length-1]).Error("write cover with older tid")
 		}
 
 		slotCopy.values = append(slotCopy.values, value)
 		slotCopy.tidsBegin = append(slotCopy.tidsBegin, tid)
 		slotCopy.tidsEnd = append(slotCopy.tidsEnd, base.MAX_TID)
 
-		m.kv.Store(key, slotCopy)
+		m.store.Save(key, slotCopy)
+		chainLength.Observe(float64(length + 1))
 	} else {
-		m.kv.Store(key, ValueSlot{
+		m.store.Save(key, ValueSlot{
 			[]base.ValueT{value},
 			[]base.Tid{tid},
 			[]base.Tid{base.MAX_TID},
 		})
+		chainLength.Observe(1)
 	}
 }
 
@@ -85,15 +66,11 @@ func contains(s []base.Tid, e base.Tid) bool {
 }
 
 func (m *Manager) Get(key base.KeyT, tid base.Tid, activeTids []base.Tid) (base.ValueT, base.Tid) {
-	guard, ok := m.slotGuard[key]
-	if !ok {
-		return base.VALUE_NOT_FOUND, base.NIL_TID
-	}
+	guard := m.getGuard(key)
 	guard.RLock()
 	defer guard.RUnlock()
 
-	if slotCopy, ok := m.kv.Load(key); ok {
-		slotCopy := slotCopy.(ValueSlot)
+	if slotCopy, ok := m.store.Load(key); ok {
 		length := len(slotCopy.values)
 
 		for i := length - 1; i >= 0; i-- {
@@ -113,22 +90,23 @@ func (m *Manager) Get(key base.KeyT, tid base.Tid, activeTids []base.Tid) (base.
 }
 
 func (m *Manager) Inc(key base.KeyT, tid base.Tid) base.ValueT {
-	guard, _ := m.slotGuard[key]
+	guard := m.getGuard(key)
 	guard.Lock()
 	defer guard.Unlock()
 
-	if slotCopy, ok := m.kv.Load(key); ok {
-		slotCopy := slotCopy.(ValueSlot)
-
+	if slotCopy, ok := m.store.Load(key); ok {
 		length := len(slotCopy.values)
+		oldValue := slotCopy.values[length-1]
+		if oldValue == base.VALUE_NOT_FOUND {
+			return base.VALUE_NOT_FOUND // deleted
+		}
 		slotCopy.tidsEnd[length-1] = tid // update last tid
 
-		oldValue := slotCopy.values[length-1]
 		slotCopy.values = append(slotCopy.values, oldValue+1)
 		slotCopy.tidsBegin = append(slotCopy.tidsBegin, tid)
 		slotCopy.tidsEnd = append(slotCopy.tidsEnd, base.MAX_TID)
 
-		m.kv.Store(key, slotCopy)
+		m.store.Save(key, slotCopy)
 		return oldValue + 1
 	} else {
 		log.Warning("inc op has no key")
@@ -137,25 +115,26 @@ func (m *Manager) Inc(key base.KeyT, tid base.Tid) base.ValueT {
 }
 
 func (m *Manager) Dec(key base.KeyT, tid base.Tid) base.ValueT {
-	guard, _ := m.slotGuard[key]
+	guard := m.getGuard(key)
 	guard.Lock()
 	defer guard.Unlock()
 
-	if slotCopy, ok := m.kv.Load(key); ok {
-		slotCopy := slotCopy.(ValueSlot)
-
+	if slotCopy, ok := m.store.Load(key); ok {
 		length := len(slotCopy.values)
+		oldValue := slotCopy.values[length-1]
+		if oldValue == base.VALUE_NOT_FOUND {
+			return base.VALUE_NOT_FOUND // deleted
+		}
 		slotCopy.tidsEnd[length-1] = tid // update last tid
 
-		oldValue := slotCopy.values[length-1]
 		slotCopy.values = append(slotCopy.values, oldValue-1)
 		slotCopy.tidsBegin = append(slotCopy.tidsBegin, tid)
 		slotCopy.tidsEnd = append(slotCopy.tidsEnd, base.MAX_TID)
 
-		m.kv.Store(key, slotCopy)
-		return oldValue + 1
+		m.store.Save(key, slotCopy)
+		return oldValue - 1
 	} else {
-		log.Warning("inc op has no key")
+		log.Warning("dec op has no key")
 		return base.VALUE_NOT_FOUND
 	}
 }
@@ -165,13 +144,11 @@ func (m *Manager) Del(key base.KeyT, tid base.Tid) {
 }
 
 func (m *Manager) UnrollKeyByTid(key base.KeyT, tid base.Tid) {
-	guard, _ := m.slotGuard[key]
+	guard := m.getGuard(key)
 	guard.Lock()
 	defer guard.Unlock()
 
-	if slotCopy, ok := m.kv.Load(key); ok {
-		slotCopy := slotCopy.(ValueSlot)
-
+	if slotCopy, ok := m.store.Load(key); ok {
 		length := len(slotCopy.values)
 
 		i := length - 1
@@ -180,7 +157,12 @@ func (m *Manager) UnrollKeyByTid(key base.KeyT, tid base.Tid) {
 				break
 			}
 		}
-		if i != 0 && i != length-1 {
+		if i < 0 {
+			return
+		} else if length == 1 {
+			m.store.Delete(key) // the key was created by this tid
+			return
+		} else if i != 0 && i != length-1 {
 			slotCopy.tidsEnd[i-1] = slotCopy.tidsBegin[i+1]
 			slotCopy.values = append(slotCopy.values[:i], slotCopy.values[i+1:]...)
 			slotCopy.tidsBegin = append(slotCopy.tidsBegin[:i], slotCopy.tidsBegin[i+1:]...)
@@ -195,8 +177,22 @@ func (m *Manager) UnrollKeyByTid(key base.KeyT, tid base.Tid) {
 			slotCopy.tidsEnd = slotCopy.tidsEnd[0 : length-1]
 			slotCopy.tidsEnd[length-2] = base.MAX_TID
 		}
-		m.kv.Store(key, slotCopy)
+		m.store.Save(key, slotCopy)
 	} else {
 		log.Warning("unroll has no key")
 	}
 }
+
+// RollbackTid removes every version tid wrote, returns how many were removed.
+func (m *Manager) RollbackTid(tid base.Tid) int {
+	removed := 0
+	for _, key := range m.Keys("", "") {
+		for _, v := range m.History(key) {
+			if v.Begin == tid {
+				m.UnrollKeyByTid(key, tid)
+				removed++
+			}
+		}
+	}
+	return removed
+}
@@ -6,116 +6,194 @@ package log
 
 import (
 	"io"
-	"log"
 	"os"
-)
-
-// Level is log level type
-type Level = uint
+	"runtime"
+	"strings"
+	"sync"
 
-type modeType = string
-
-const (
-	modeDebug   modeType = "debug"
-	modeRelease modeType = "release"
+	"golang.org/x/term"
 )
 
 var (
-	loggers *Logger
+	guard = &sync.RWMutex{}
+
+	logLevel      = DebugLevel
+	packageLevels = map[string]Level{}
+	logFormat     = TextFormat
 
-	logLevel Level = 1 // block the logs
+	// outputs by level, fatal shares the error output
+	outputs [FatalLevel + 1]io.Writer
+	// colors tells the outputs that are terminals
+	colors [FatalLevel + 1]bool
 
-	mode modeType = modeDebug
+	// writeGuard keeps the lines of concurrent loggers apart
+	writeGuard = &sync.Mutex{}
+
+	std = &Logger{}
 )
 
 func init() {
-	loggers = &Logger{
-		debugLogger:   log.New(os.Stderr, "\x1b[32m [DEBUG] \x1b[0m", log.LstdFlags|log.Lmicroseconds),
-		infoLogger:    log.New(os.Stdout, "\x1b[34m [INFO] \x1b[0m", log.LstdFlags|log.Lmicroseconds),
-		warningLogger: log.New(os.Stdout, "\x1b[33m [WARNING] \x1b[0m", log.LstdFlags|log.Lmicroseconds),
-		errorLogger:   log.New(os.Stderr, "\x1b[31m [ERROR] \x1b[0m", log.LstdFlags|log.Lmicroseconds),
-	}
+	SetOutput(os.Stderr, os.Stdout, os.Stdout, os.Stderr)
 }
 
-// SetDebugMode sets debug mode
-func SetDebugMode(debug bool) {
-	if debug {
-		mode = modeDebug
-	} else {
-		mode = modeRelease
+// SetOutput sets log's output, fatal messages go to errorOutput.
+// The text format is colored on outputs that are terminals.
+func SetOutput(debugOutput, infoOutput, warningOutput, errorOutput io.Writer) {
+	guard.Lock()
+	defer guard.Unlock()
+	outputs = [FatalLevel + 1]io.Writer{debugOutput, infoOutput, warningOutput, errorOutput, errorOutput}
+	for level, w := range outputs {
+		colors[level] = isTerminal(w)
 	}
 }
 
-// SetOutput sets log's output
-func SetOutput(debugOutput, infoOutput, warningOutput, errorOutput io.Writer) {
-	loggers.debugLogger.SetOutput(debugOutput)
-	loggers.infoLogger.SetOutput(infoOutput)
-	loggers.warningLogger.SetOutput(warningOutput)
-	loggers.errorLogger.SetOutput(errorOutput)
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	return ok && term.IsTerminal(int(f.Fd()))
 }
 
-// SetLevel sets log's level
+// SetLevel sets the lowest level logged, OffLevel blocks the logs
 func SetLevel(level Level) {
+	guard.Lock()
+	defer guard.Unlock()
 	logLevel = level
 }
 
-// V gets logger by level
-func V(level Level) *Logger {
-	return get(level, 2)
+// GetLevel gets the level set by SetLevel
+func GetLevel() Level {
+	guard.RLock()
+	defer guard.RUnlock()
+	return logLevel
 }
 
-func get(level Level, depth int) *Logger {
-	if level&logLevel == 0 {
-		return &Logger{}
+// PackageLevel gets the level of the package named pkg, for loggers of
+// other libraries that run on behalf of it
+func PackageLevel(pkg string) Level {
+	guard.RLock()
+	defer guard.RUnlock()
+	if level, ok := packageLevels[pkg]; ok {
+		return level
 	}
-	return &Logger{
-		debugLogger:   loggers.debugLogger,
-		infoLogger:    loggers.infoLogger,
-		warningLogger: loggers.warningLogger,
-		errorLogger:   loggers.errorLogger,
+	return logLevel
+}
 
-		depth: depth,
+// SetPackageLevels overrides the level for the packages named by the last
+// element of their import path, e.g. {"txn": DebugLevel}
+func SetPackageLevels(levels map[string]Level) {
+	copied := make(map[string]Level, len(levels))
+	for pkg, level := range levels {
+		copied[pkg] = level
 	}
+	guard.Lock()
+	defer guard.Unlock()
+	packageLevels = copied
+}
+
+// SetFormat sets the output format
+func SetFormat(format Format) {
+	guard.Lock()
+	defer guard.Unlock()
+	logFormat = format
+}
+
+// caller is where a message was logged
+type caller struct {
+	file string
+	line int
+}
+
+// check reports whether a message at level is logged for the function skip
+// frames above check, and where that function is
+func check(level Level, skip int) (caller, bool) {
+	guard.RLock()
+	global, perPackage := logLevel, len(packageLevels) > 0
+	guard.RUnlock()
+	if !perPackage && level < global {
+		return caller{}, false
+	}
+	pc, file, line, ok := runtime.Caller(skip + 1)
+	if !ok {
+		file, line = "???", 0
+	}
+	if perPackage && ok {
+		guard.RLock()
+		if l, found := packageLevels[packageOf(pc)]; found {
+			global = l
+		}
+		guard.RUnlock()
+	}
+	return caller{file, line}, level >= global
+}
+
+// packageOf names the package of the function at pc, "stupid-kv/txn.(*Manager).Get" is "txn"
+func packageOf(pc uintptr) string {
+	f := runtime.FuncForPC(pc)
+	if f == nil {
+		return ""
+	}
+	name := f.Name()
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name = name[i+1:]
+	}
+	if i := strings.Index(name, "."); i >= 0 {
+		name = name[:i]
+	}
+	return name
+}
+
+// With returns a logger that adds the key/value pairs to its messages
+func With(keyValues ...interface{}) *Logger {
+	return std.With(keyValues...)
 }
 
 // Debug logs important message
 func Debug(v ...interface{}) {
-	get(logLevel, 3).Debug(v...)
+	std.output(DebugLevel, "", v)
 }
 
 // Debugf logs important message
 func Debugf(format string, v ...interface{}) {
-	get(logLevel, 3).Debugf(format, v...)
+	std.output(DebugLevel, format, v)
 }
 
 // Info logs important message
 func Info(v ...interface{}) {
-	get(logLevel, 3).Info(v...)
+	std.output(InfoLevel, "", v)
 }
 
 // Infof logs important message
 func Infof(format string, v ...interface{}) {
-	get(logLevel, 3).Infof(format, v...)
+	std.output(InfoLevel, format, v)
 }
 
 // Warning logs warning message
 func Warning(v ...interface{}) {
-	get(logLevel, 3).Warning(v...)
+	std.output(WarningLevel, "", v)
 }
 
 // Warningf logs important message
 func Warningf(format string, v ...interface{}) {
-	get(logLevel, 3).Warningf(format, v...)
+	std.output(WarningLevel, format, v)
 }
 
-// Error logs error message
+// Error logs error message, the caller goes on
 func Error(v ...interface{}) {
-	get(logLevel, 3).Error(v...)
-	os.Exit(1)
+	std.output(ErrorLevel, "", v)
 }
 
-// Errorf logs important message
+// Errorf logs error message, the caller goes on
 func Errorf(format string, v ...interface{}) {
-	get(logLevel, 3).Errorf(format, v...)
+	std.output(ErrorLevel, format, v)
+}
+
+// Fatal logs fatal message and exits the process
+func Fatal(v ...interface{}) {
+	std.output(FatalLevel, "", v)
+	os.Exit(1)
+}
+
+// Fatalf logs fatal message and exits the process
+func Fatalf(format string, v ...interface{}) {
+	std.output(FatalLevel, format, v)
 	os.Exit(1)
 }
@@ -5,89 +5,167 @@ Copyright (c) 2020, pigeonligh.
 package log
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
-	"log"
-	"runtime"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
-const (
-	prefixString string = ""
-	suffixString string = ""
-)
+var prefixes = [FatalLevel + 1]string{" [DEBUG] ", " [INFO] ", " [WARNING] ", " [ERROR] ", " [FATAL] "}
+
+// colorCodes color the prefixes on terminals
+var colorCodes = [FatalLevel + 1]string{"\x1b[32m", "\x1b[34m", "\x1b[33m", "\x1b[31m", "\x1b[35m"}
 
-// Logger is used to log
+// Logger is used to log, with the fields added by With
 type Logger struct {
-	debugLogger   *log.Logger
-	infoLogger    *log.Logger
-	warningLogger *log.Logger
-	errorLogger   *log.Logger
-	depth         int
+	fields []interface{} // key, value, key, value...
+}
+
+// With returns a logger that also adds the key/value pairs, e.g.
+// log.With("tid", tid, "key", key).Info("write")
+func (logger *Logger) With(keyValues ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(logger.fields)+len(keyValues)+1)
+	fields = append(fields, logger.fields...)
+	fields = append(fields, keyValues...)
+	if len(keyValues)%2 == 1 {
+		fields = append(fields, nil)
+	}
+	return &Logger{fields: fields}
 }
 
-func (logger *Logger) prefix() string {
-	_, file, line, ok := runtime.Caller(logger.depth + 1)
+// output writes a message of the caller of the exported method or function
+func (logger *Logger) output(level Level, format string, v []interface{}) {
+	at, ok := check(level, 2)
 	if !ok {
-		return "???: "
+		return
+	}
+	var msg string
+	if format == "" {
+		msg = strings.TrimSuffix(fmt.Sprintln(v...), "\n")
+	} else {
+		msg = fmt.Sprintf(format, v...)
+	}
+
+	guard.RLock()
+	w, color, style := outputs[level], colors[level], logFormat
+	guard.RUnlock()
+	if w == nil {
+		return
+	}
+	var line []byte
+	if style == JSONFormat {
+		line = logger.json(level, at, msg)
+	} else {
+		line = logger.text(level, color, at, msg)
+	}
+	writeGuard.Lock()
+	_, _ = w.Write(line)
+	writeGuard.Unlock()
+}
+
+func (logger *Logger) text(level Level, color bool, at caller, msg string) []byte {
+	var b bytes.Buffer
+	if color {
+		b.WriteString(colorCodes[level] + prefixes[level] + "\x1b[0m")
+	} else {
+		b.WriteString(prefixes[level])
+	}
+	b.WriteString(time.Now().Format("2006/01/02 15:04:05.000000 "))
+	fmt.Fprintf(&b, "%s:%d: %s", at.file, at.line, msg)
+	for i := 0; i+1 < len(logger.fields); i += 2 {
+		value := fmt.Sprint(logger.fields[i+1])
+		if value == "" || strings.ContainsAny(value, " \t\n\"=") {
+			value = strconv.Quote(value)
+		}
+		fmt.Fprintf(&b, " %v=%s", logger.fields[i], value)
+	}
+	b.WriteByte('\n')
+	return b.Bytes()
+}
+
+func (logger *Logger) json(level Level, at caller, msg string) []byte {
+	var b bytes.Buffer
+	b.WriteString(`{"time":`)
+	writeJSON(&b, time.Now().Format(time.RFC3339Nano))
+	b.WriteString(`,"level":`)
+	writeJSON(&b, level.String())
+	b.WriteString(`,"caller":`)
+	writeJSON(&b, fmt.Sprintf("%s:%d", at.file, at.line))
+	b.WriteString(`,"msg":`)
+	writeJSON(&b, msg)
+	for i := 0; i+1 < len(logger.fields); i += 2 {
+		b.WriteByte(',')
+		writeJSON(&b, fmt.Sprint(logger.fields[i]))
+		b.WriteByte(':')
+		writeJSON(&b, logger.fields[i+1])
 	}
-	return fmt.Sprintf("%s:%d: ", file, line)
+	b.WriteString("}\n")
+	return b.Bytes()
 }
 
-func (logger *Logger) wrap(s string) string {
-	return logger.prefix() + prefixString + s + suffixString
+// writeJSON writes v as json, errors and values json cannot encode as their text
+func writeJSON(b *bytes.Buffer, v interface{}) {
+	if err, ok := v.(error); ok {
+		v = err.Error()
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		data, _ = json.Marshal(fmt.Sprint(v))
+	}
+	b.Write(data)
 }
 
 // Debug logs important message
 func (logger *Logger) Debug(v ...interface{}) {
-	if logger.debugLogger != nil && mode == modeDebug {
-		_ = logger.debugLogger.Output(logger.depth, logger.wrap(fmt.Sprintln(v...)))
-	}
+	logger.output(DebugLevel, "", v)
 }
 
 // Debugf logs important message
 func (logger *Logger) Debugf(format string, v ...interface{}) {
-	if logger.debugLogger != nil && mode == modeDebug {
-		_ = logger.debugLogger.Output(logger.depth, logger.wrap(fmt.Sprintf(format, v...)+"\n"))
-	}
+	logger.output(DebugLevel, format, v)
 }
 
 // Info logs important message
 func (logger *Logger) Info(v ...interface{}) {
-	if logger.infoLogger != nil {
-		_ = logger.infoLogger.Output(logger.depth, logger.wrap(fmt.Sprintln(v...)))
-	}
+	logger.output(InfoLevel, "", v)
 }
 
 // Infof logs important message
 func (logger *Logger) Infof(format string, v ...interface{}) {
-	if logger.infoLogger != nil {
-		_ = logger.infoLogger.Output(logger.depth, logger.wrap(fmt.Sprintf(format, v...)+"\n"))
-	}
+	logger.output(InfoLevel, format, v)
 }
 
 // Warning logs warning message
 func (logger *Logger) Warning(v ...interface{}) {
-	if logger.warningLogger != nil {
-		_ = logger.warningLogger.Output(logger.depth, logger.wrap(fmt.Sprintln(v...)))
-	}
+	logger.output(WarningLevel, "", v)
 }
 
 // Warningf logs important message
 func (logger *Logger) Warningf(format string, v ...interface{}) {
-	if logger.warningLogger != nil {
-		_ = logger.warningLogger.Output(logger.depth, logger.wrap(fmt.Sprintf(format, v...)+"\n"))
-	}
+	logger.output(WarningLevel, format, v)
 }
 
-// Error logs error message
+// Error logs error message, the caller goes on
 func (logger *Logger) Error(v ...interface{}) {
-	if logger.errorLogger != nil {
-		_ = logger.errorLogger.Output(logger.depth, logger.wrap(fmt.Sprintln(v...)))
-	}
+	logger.output(ErrorLevel, "", v)
 }
 
-// Errorf logs important message
+// Errorf logs error message, the caller goes on
 func (logger *Logger) Errorf(format string, v ...interface{}) {
-	if logger.errorLogger != nil {
-		_ = logger.errorLogger.Output(logger.depth, logger.wrap(fmt.Sprintf(format, v...)+"\n"))
-	}
+	logger.output(ErrorLevel, format, v)
+}
+
+// Fatal logs fatal message and exits the process
+func (logger *Logger) Fatal(v ...interface{}) {
+	logger.output(FatalLevel, "", v)
+	os.Exit(1)
+}
+
+// Fatalf logs fatal message and exits the process
+func (logger *Logger) Fatalf(format string, v ...interface{}) {
+	logger.output(FatalLevel, format, v)
+	os.Exit(1)
 }
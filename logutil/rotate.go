@@ -0,0 +1,228 @@
+/*
+Copyright (c) 2020, pigeonligh.
+*/
+
+package log
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rotatedTime is the time a rotated file was cut, in its name
+const rotatedTime = "20060102T150405.000"
+
+// RotateOptions bound a log file, a zero field disables its bound
+type RotateOptions struct {
+	MaxSize    int64         // rotate before the file grows past it
+	Every      time.Duration // rotate once the file was open that long
+	MaxAge     time.Duration // remove rotated files older than it
+	MaxBackups int           // remove the oldest rotated files beyond it
+	Compress   bool          // gzip rotated files
+}
+
+// RotatingFile is a log output that moves the file aside as
+// <name>-<time><ext> when it is full or old, and prunes the moved files
+type RotatingFile struct {
+	guard *sync.Mutex
+	path  string
+	opts  RotateOptions
+
+	f      *os.File
+	size   int64
+	opened time.Time
+
+	// millGuard runs one compress and prune at a time
+	millGuard *sync.Mutex
+}
+
+// OpenRotatingFile appends to the file at path, creating it and its dir
+func OpenRotatingFile(path string, opts RotateOptions) (*RotatingFile, error) {
+	r := &RotatingFile{
+		guard:     &sync.Mutex{},
+		path:      path,
+		opts:      opts,
+		millGuard: &sync.Mutex{},
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *RotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f, r.size, r.opened = f, info.Size(), time.Now()
+	return nil
+}
+
+func (r *RotatingFile) Write(p []byte) (int, error) {
+	r.guard.Lock()
+	defer r.guard.Unlock()
+	if r.f == nil {
+		return 0, os.ErrClosed
+	}
+	full := r.opts.MaxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.opts.MaxSize
+	old := r.opts.Every > 0 && time.Since(r.opened) >= r.opts.Every
+	var rotateErr error
+	if full || old {
+		if rotateErr = r.rotate(); rotateErr != nil {
+			// go on in the file as if it was new, so the next writes do not fail too
+			r.size, r.opened = 0, time.Now()
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	if err == nil {
+		err = rotateErr
+	}
+	return n, err
+}
+
+// Rotate moves the file aside now and starts a new one
+func (r *RotatingFile) Rotate() error {
+	r.guard.Lock()
+	defer r.guard.Unlock()
+	if r.f == nil {
+		return os.ErrClosed
+	}
+	return r.rotate()
+}
+
+// rotate keeps writing to the current file if the rename or the new file fails
+func (r *RotatingFile) rotate() error {
+	ext := filepath.Ext(r.path)
+	rotated := strings.TrimSuffix(r.path, ext) + "-" + time.Now().Format(rotatedTime) + ext
+	if err := os.Rename(r.path, rotated); err != nil {
+		return err
+	}
+	old := r.f
+	if err := r.open(); err != nil {
+		// the open file is the rotated one now, move it back
+		_ = os.Rename(rotated, r.path)
+		return err
+	}
+	_ = old.Close()
+	go r.mill(rotated)
+	return nil
+}
+
+// mill compresses the file just rotated and prunes the rotated files
+func (r *RotatingFile) mill(rotated string) {
+	r.millGuard.Lock()
+	defer r.millGuard.Unlock()
+	if r.opts.Compress {
+		// a failed compress leaves the plain file, it is pruned like the others
+		_ = compress(rotated)
+	}
+	_ = r.prune()
+}
+
+func compress(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(path+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	w := gzip.NewWriter(dst)
+	if _, err := io.Copy(w, src); err != nil {
+		dst.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := w.Close(); err != nil {
+		dst.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+	return os.Remove(path)
+}
+
+// backup is a rotated file and when it was cut
+type backup struct {
+	path string
+	cut  time.Time
+}
+
+// backups lists the rotated files of the log file, newest first
+func (r *RotatingFile) backups() ([]backup, error) {
+	dir := filepath.Dir(r.path)
+	ext := filepath.Ext(r.path)
+	prefix := strings.TrimSuffix(filepath.Base(r.path), ext) + "-"
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	backups := make([]backup, 0)
+	for _, info := range infos {
+		name := strings.TrimSuffix(info.Name(), ".gz")
+		if info.IsDir() || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, ext) {
+			continue
+		}
+		cut, err := time.ParseInLocation(rotatedTime, strings.TrimSuffix(name[len(prefix):], ext), time.Local)
+		if err != nil {
+			continue
+		}
+		backups = append(backups, backup{filepath.Join(dir, info.Name()), cut})
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].cut.After(backups[j].cut) })
+	return backups, nil
+}
+
+func (r *RotatingFile) prune() error {
+	if r.opts.MaxBackups <= 0 && r.opts.MaxAge <= 0 {
+		return nil
+	}
+	backups, err := r.backups()
+	if err != nil {
+		return err
+	}
+	for i, b := range backups {
+		tooMany := r.opts.MaxBackups > 0 && i >= r.opts.MaxBackups
+		tooOld := r.opts.MaxAge > 0 && time.Since(b.cut) > r.opts.MaxAge
+		if tooMany || tooOld {
+			if err := os.Remove(b.path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Close closes the file, later writes fail
+func (r *RotatingFile) Close() error {
+	r.guard.Lock()
+	defer r.guard.Unlock()
+	if r.f == nil {
+		return nil
+	}
+	err := r.f.Close()
+	r.f = nil
+	return err
+}
@@ -4,8 +4,89 @@ Copyright (c) 2020, pigeonligh.
 
 package log
 
+import (
+	"fmt"
+	"strings"
+)
+
+// Level is log level type, a logger writes the messages at or above its level
+type Level int
+
 const (
-	// BufferLevel is buffer log level
-	DefaultLevel Level = 1 << iota
+	// DebugLevel logs everything
+	DebugLevel Level = iota
+	// InfoLevel is the default level
+	InfoLevel
+	// WarningLevel logs conditions worth a look
+	WarningLevel
+	// ErrorLevel logs failed operations the process survives
+	ErrorLevel
+	// FatalLevel logs the reason right before the process exits
+	FatalLevel
+	// OffLevel blocks the logs
+	OffLevel
+)
+
+var levelNames = []string{"debug", "info", "warning", "error", "fatal", "off"}
+
+func (l Level) String() string {
+	if l < DebugLevel || l > OffLevel {
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+	return levelNames[l]
+}
 
+// ParseLevel parses the name of a level, e.g. from the log_level config key
+func ParseLevel(s string) (Level, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "warn" {
+		return WarningLevel, nil
+	}
+	for l, name := range levelNames {
+		if s == name {
+			return Level(l), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q", s)
+}
+
+// ParsePackageLevels parses per-package levels like "txn=debug,lsm=warning"
+func ParsePackageLevels(s string) (map[string]Level, error) {
+	levels := make(map[string]Level)
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		i := strings.Index(item, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("package level %q is not <package>=<level>", item)
+		}
+		level, err := ParseLevel(item[i+1:])
+		if err != nil {
+			return nil, err
+		}
+		levels[strings.TrimSpace(item[:i])] = level
+	}
+	return levels, nil
+}
+
+// Format is the output format of the logs
+type Format int
+
+const (
+	// TextFormat writes a colored line per message with its fields as key=value
+	TextFormat Format = iota
+	// JSONFormat writes a json object per line
+	JSONFormat
 )
+
+// ParseFormat parses "text" or "json"
+func ParseFormat(s string) (Format, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "text":
+		return TextFormat, nil
+	case "json":
+		return JSONFormat, nil
+	}
+	return 0, fmt.Errorf("unknown log format %q", s)
+}
@@ -0,0 +1,57 @@
+package lsm
+
+import (
+	"hash/fnv"
+	"stupid-kv/base"
+)
+
+const (
+	bloomBitsPerKey = 10
+	bloomProbes     = 7 // about 1% false positives at 10 bits per key
+)
+
+// bloom is a filter over the keys of a table, its last byte holds the
+// number of probes
+type bloom []byte
+
+func bloomHash(key base.KeyT) (uint32, uint32) {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(key))
+	sum := h.Sum64()
+	return uint32(sum), uint32(sum >> 32)
+}
+
+// newBloom builds a filter from the hashes of the keys, see bloomHash
+func newBloom(hashes [][2]uint32) bloom {
+	bits := len(hashes) * bloomBitsPerKey
+	if bits < 64 {
+		bits = 64
+	}
+	filter := make(bloom, (bits+7)/8+1)
+	bits = (len(filter) - 1) * 8
+	for _, h := range hashes {
+		// double hashing, probe i is h1 + i*h2
+		for i := uint32(0); i < bloomProbes; i++ {
+			pos := (h[0] + i*h[1]) % uint32(bits)
+			filter[pos/8] |= 1 << (pos % 8)
+		}
+	}
+	filter[len(filter)-1] = bloomProbes
+	return filter
+}
+
+// mayContain is false only if key is surely not in the table
+func (f bloom) mayContain(key base.KeyT) bool {
+	if len(f) < 2 {
+		return true
+	}
+	bits := uint32(len(f)-1) * 8
+	h1, h2 := bloomHash(key)
+	for i := uint32(0); i < uint32(f[len(f)-1]); i++ {
+		pos := (h1 + i*h2) % bits
+		if f[pos/8]&(1<<(pos%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
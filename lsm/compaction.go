@@ -0,0 +1,305 @@
+package lsm
+
+import (
+	"os"
+	"sort"
+	"stupid-kv/base"
+	"stupid-kv/kv"
+	log "stupid-kv/logutil"
+)
+
+// compaction merges inputs, files per level, into out
+type compaction struct {
+	inputs [maxLevels][]fileMeta
+	out    int
+	bottom bool // no deeper file overlaps the inputs, so tombstones can go
+}
+
+func (t *Tree) maybeCompact() {
+	select {
+	case t.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (t *Tree) compactLoop() {
+	defer close(t.done)
+	for {
+		select {
+		case <-t.stop:
+			return
+		case <-t.wake:
+		}
+		for {
+			select {
+			case <-t.stop:
+				return
+			default:
+			}
+			t.compactGuard.Lock()
+			t.mu.RLock()
+			c := t.pick()
+			t.mu.RUnlock()
+			if c == nil {
+				t.compactGuard.Unlock()
+				break
+			}
+			dropped, err := t.run(c)
+			t.dropped += dropped
+			t.compactGuard.Unlock()
+			if err != nil {
+				log.Warning("lsm compaction error: ", err)
+				break
+			}
+		}
+	}
+}
+
+// pick chooses the next compaction, nil if every level is within its target.
+// The caller holds compactGuard and mu.
+func (t *Tree) pick() *compaction {
+	levels := t.man.Levels
+	if len(levels[0]) >= t.opts.L0Files {
+		c := &compaction{out: 1}
+		c.inputs[0] = append([]fileMeta{}, levels[0]...)
+		smallest, largest := keyRange(c.inputs[0])
+		c.inputs[1] = overlapping(levels[1], smallest, largest)
+		c.bottom = !t.overlapsBelow(1, smallest, largest)
+		return c
+	}
+	target := t.opts.LevelBase
+	for level := 1; level < maxLevels-1; level, target = level+1, target*10 {
+		if levelSize(levels[level]) <= target {
+			continue
+		}
+		// round robin over the level, so every key range gets its turn
+		files := levels[level]
+		i := sort.Search(len(files), func(i int) bool { return files[i].Smallest > t.pointers[level] })
+		if i == len(files) {
+			i = 0
+		}
+		f := files[i]
+		t.pointers[level] = f.Largest
+		c := &compaction{out: level + 1}
+		c.inputs[level] = []fileMeta{f}
+		c.inputs[level+1] = overlapping(levels[level+1], f.Smallest, f.Largest)
+		smallest, largest := keyRange(append(c.inputs[level+1], f))
+		c.bottom = !t.overlapsBelow(level+1, smallest, largest)
+		return c
+	}
+	return nil
+}
+
+func (t *Tree) overlapsBelow(level int, smallest base.KeyT, largest base.KeyT) bool {
+	for _, files := range t.man.Levels[level+1:] {
+		if len(overlapping(files, smallest, largest)) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func keyRange(files []fileMeta) (base.KeyT, base.KeyT) {
+	smallest, largest := files[0].Smallest, files[0].Largest
+	for _, f := range files[1:] {
+		if f.Smallest < smallest {
+			smallest = f.Smallest
+		}
+		if f.Largest > largest {
+			largest = f.Largest
+		}
+	}
+	return smallest, largest
+}
+
+// run merges the inputs of c into new files of c.out and installs them,
+// returns the number of versions dropped below the watermark. Only
+// compactions change the inputs, so they are read without mu.
+func (t *Tree) run(c *compaction) (int, error) {
+	t.mu.RLock()
+	sources := make([]iterator, 0)
+	for _, f := range c.inputs[0] {
+		sources = append(sources, newTableIter(t.tables[f.Num], ""))
+	}
+	for _, files := range c.inputs[1:] {
+		tables := make([]*table, 0, len(files))
+		for _, f := range files {
+			tables = append(tables, t.tables[f.Num])
+		}
+		sources = append(sources, newLevelIter(tables, ""))
+	}
+	t.mu.RUnlock()
+
+	outputs := make([]fileMeta, 0)
+	var w *tableWriter
+	var num uint64
+	abort := func() {
+		if w != nil {
+			w.abort()
+		}
+		for _, f := range outputs {
+			_ = os.Remove(t.path(f.Num, "sst"))
+		}
+	}
+	finish := func() error {
+		meta, err := w.finish(num)
+		w = nil
+		if err != nil {
+			return err
+		}
+		outputs = append(outputs, meta)
+		return nil
+	}
+
+	dropped := 0
+	it := newMergeIter(sources)
+	for it.next() {
+		e := it.entry()
+		if e.deleted && c.bottom {
+			continue
+		}
+		if !e.deleted && t.watermark > 0 {
+			var slot kv.ValueSlot
+			if err := slot.UnmarshalBinary(e.value); err != nil {
+				abort()
+				return 0, err
+			}
+			if trimmed, n := slot.Trim(t.watermark); n > 0 {
+				e.value, _ = trimmed.MarshalBinary()
+				dropped += n
+			}
+		}
+		if w == nil {
+			t.mu.Lock()
+			num = t.nextFile()
+			t.mu.Unlock()
+			var err error
+			if w, err = newTableWriter(t.path(num, "sst")); err != nil {
+				abort()
+				return 0, err
+			}
+		}
+		if err := w.add(e); err != nil {
+			abort()
+			return 0, err
+		}
+		if w.size() >= t.opts.FileSize {
+			if err := finish(); err != nil {
+				abort()
+				return 0, err
+			}
+		}
+	}
+	if err := it.err(); err != nil {
+		abort()
+		return 0, err
+	}
+	if w != nil {
+		if err := finish(); err != nil {
+			abort()
+			return 0, err
+		}
+	}
+	if err := t.install(c, outputs); err != nil {
+		abort()
+		return 0, err
+	}
+	return dropped, nil
+}
+
+// install swaps the inputs of c for outputs in the manifest and removes them
+func (t *Tree) install(c *compaction, outputs []fileMeta) error {
+	opened := make([]*table, 0, len(outputs))
+	for _, f := range outputs {
+		tbl, err := openTable(t.path(f.Num, "sst"), f.Num, t.reader)
+		if err != nil {
+			for _, tbl := range opened {
+				_ = tbl.close()
+			}
+			return err
+		}
+		opened = append(opened, tbl)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	removed := make(map[uint64]bool)
+	for _, files := range c.inputs {
+		for _, f := range files {
+			removed[f.Num] = true
+		}
+	}
+	man := t.man.clone()
+	for level, files := range man.Levels {
+		kept := make([]fileMeta, 0, len(files))
+		for _, f := range files {
+			if !removed[f.Num] {
+				kept = append(kept, f)
+			}
+		}
+		man.Levels[level] = kept
+	}
+	man.Levels[c.out] = append(man.Levels[c.out], outputs...)
+	sort.Slice(man.Levels[c.out], func(i, j int) bool {
+		return man.Levels[c.out][i].Smallest < man.Levels[c.out][j].Smallest
+	})
+	if err := man.save(t.dir); err != nil {
+		for _, tbl := range opened {
+			_ = tbl.close()
+		}
+		return err
+	}
+	t.man = man
+	for _, tbl := range opened {
+		t.tables[tbl.num] = tbl
+	}
+	for num := range removed {
+		_ = t.tables[num].close()
+		delete(t.tables, num)
+		t.reader.cache.Forget(num)
+		_ = os.Remove(t.path(num, "sst"))
+	}
+	log.Debugf("lsm compacts %v files into %v files of level %v", len(removed), len(outputs), c.out)
+	return nil
+}
+
+// Compact flushes the memtable and merges every file into the deepest level,
+// dropping the versions below watermark. Later compactions keep using the
+// watermark. Returns the versions dropped, counting the ones the background
+// compactions dropped since the last call.
+func (t *Tree) Compact(watermark base.Tid) int {
+	t.compactGuard.Lock()
+	defer t.compactGuard.Unlock()
+	t.watermark = watermark
+
+	t.mu.Lock()
+	err := t.flushMemtable()
+	c := &compaction{out: 1, bottom: true}
+	empty := true
+	for level, files := range t.man.Levels {
+		c.inputs[level] = append([]fileMeta{}, files...)
+		if len(files) > 0 {
+			empty = false
+			if level > c.out {
+				c.out = level
+			}
+		}
+	}
+	t.mu.Unlock()
+	if err != nil {
+		log.Warning("lsm flush memtable error: ", err)
+		return 0
+	}
+	if empty {
+		return 0
+	}
+
+	dropped, err := t.run(c)
+	if err != nil {
+		log.Warning("lsm compaction error: ", err)
+		return 0
+	}
+	dropped += t.dropped
+	t.dropped = 0
+	return dropped
+}
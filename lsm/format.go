@@ -0,0 +1,62 @@
+package lsm
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"stupid-kv/base"
+)
+
+var (
+	ErrCorrupted = errors.New("lsm: corrupted file")
+	castagnoli   = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// entry is the newest chain of a key, or a tombstone if it was deleted
+type entry struct {
+	key     base.KeyT
+	value   []byte
+	deleted bool
+}
+
+func (e entry) size() int {
+	return len(e.key) + len(e.value) + 8
+}
+
+// appendEntry encodes e as uvarint key length, key, deleted flag, uvarint
+// value length and value
+func appendEntry(buf []byte, e entry) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	buf = append(buf, tmp[:binary.PutUvarint(tmp[:], uint64(len(e.key)))]...)
+	buf = append(buf, e.key...)
+	if e.deleted {
+		buf = append(buf, 1)
+	} else {
+		buf = append(buf, 0)
+	}
+	buf = append(buf, tmp[:binary.PutUvarint(tmp[:], uint64(len(e.value)))]...)
+	return append(buf, e.value...)
+}
+
+// readEntry decodes the entry at the start of data, returns its length
+func readEntry(data []byte) (entry, int, error) {
+	keyLen, n := binary.Uvarint(data)
+	if n <= 0 || uint64(len(data)-n) < keyLen+1 {
+		return entry{}, 0, ErrCorrupted
+	}
+	e := entry{key: base.KeyT(data[n : n+int(keyLen)])}
+	pos := n + int(keyLen)
+	e.deleted = data[pos] == 1
+	pos++
+	valueLen, n := binary.Uvarint(data[pos:])
+	if n <= 0 || uint64(len(data)-pos-n) < valueLen {
+		return entry{}, 0, ErrCorrupted
+	}
+	pos += n
+	e.value = append([]byte{}, data[pos:pos+int(valueLen)]...)
+	return e, pos + int(valueLen), nil
+}
+
+func checksum(data []byte) uint32 {
+	return crc32.Checksum(data, castagnoli)
+}
@@ -0,0 +1,189 @@
+package lsm
+
+import (
+	"container/heap"
+	"sort"
+	"stupid-kv/base"
+)
+
+// iterator walks entries in key order, next must be called before the first entry
+type iterator interface {
+	next() bool
+	entry() entry
+	err() error
+}
+
+type sliceIter struct {
+	entries []entry
+	pos     int
+}
+
+func newSliceIter(entries []entry) *sliceIter {
+	return &sliceIter{entries: entries, pos: -1}
+}
+
+func (it *sliceIter) next() bool {
+	it.pos++
+	return it.pos < len(it.entries)
+}
+
+func (it *sliceIter) entry() entry {
+	return it.entries[it.pos]
+}
+
+func (it *sliceIter) err() error {
+	return nil
+}
+
+// tableIter walks the entries of a table from start on, one block at a time
+type tableIter struct {
+	t       *table
+	block   int
+	entries []entry
+	pos     int
+	start   base.KeyT
+	e       error
+}
+
+func newTableIter(t *table, start base.KeyT) *tableIter {
+	return &tableIter{t: t, block: t.seekBlock(start) - 1, pos: -1, start: start}
+}
+
+func (it *tableIter) next() bool {
+	if it.e != nil {
+		return false
+	}
+	it.pos++
+	for it.pos >= len(it.entries) {
+		it.block++
+		if it.block >= len(it.t.index) {
+			return false
+		}
+		if it.entries, it.e = it.t.readBlock(it.block); it.e != nil {
+			return false
+		}
+		it.pos = sort.Search(len(it.entries), func(j int) bool { return it.entries[j].key >= it.start })
+	}
+	return true
+}
+
+func (it *tableIter) entry() entry {
+	return it.entries[it.pos]
+}
+
+func (it *tableIter) err() error {
+	return it.e
+}
+
+// levelIter walks the non-overlapping tables of a level one after another
+type levelIter struct {
+	tables []*table
+	cur    *tableIter
+	start  base.KeyT
+	e      error
+}
+
+func newLevelIter(tables []*table, start base.KeyT) *levelIter {
+	return &levelIter{tables: tables, start: start}
+}
+
+func (it *levelIter) next() bool {
+	for {
+		if it.cur != nil && it.cur.next() {
+			return true
+		}
+		if it.cur != nil && it.cur.err() != nil {
+			it.e = it.cur.err()
+			return false
+		}
+		if len(it.tables) == 0 {
+			return false
+		}
+		it.cur = newTableIter(it.tables[0], it.start)
+		it.tables = it.tables[1:]
+	}
+}
+
+func (it *levelIter) entry() entry {
+	return it.cur.entry()
+}
+
+func (it *levelIter) err() error {
+	return it.e
+}
+
+// mergeIter merges sources ordered newest first, of entries with the same key
+// only the newest one is returned
+type mergeIter struct {
+	h   iterHeap
+	cur entry
+	e   error
+}
+
+func newMergeIter(sources []iterator) *mergeIter {
+	it := &mergeIter{}
+	for prio, source := range sources {
+		it.push(heapItem{source, prio})
+	}
+	heap.Init(&it.h)
+	return it
+}
+
+// push advances item and keeps it if it has an entry left
+func (it *mergeIter) push(item heapItem) {
+	if item.it.next() {
+		it.h = append(it.h, item)
+	} else if err := item.it.err(); err != nil && it.e == nil {
+		it.e = err
+	}
+}
+
+func (it *mergeIter) next() bool {
+	if it.e != nil || len(it.h) == 0 {
+		return false
+	}
+	top := heap.Pop(&it.h).(heapItem)
+	it.cur = top.it.entry()
+	it.advance(top)
+	for len(it.h) > 0 && it.h[0].it.entry().key == it.cur.key {
+		it.advance(heap.Pop(&it.h).(heapItem))
+	}
+	return it.e == nil
+}
+
+func (it *mergeIter) advance(item heapItem) {
+	if item.it.next() {
+		heap.Push(&it.h, item)
+	} else if err := item.it.err(); err != nil && it.e == nil {
+		it.e = err
+	}
+}
+
+func (it *mergeIter) entry() entry {
+	return it.cur
+}
+
+func (it *mergeIter) err() error {
+	return it.e
+}
+
+type heapItem struct {
+	it   iterator
+	prio int
+}
+
+type iterHeap []heapItem
+
+func (h iterHeap) Len() int { return len(h) }
+func (h iterHeap) Less(i, j int) bool {
+	ki, kj := h[i].it.entry().key, h[j].it.entry().key
+	return ki < kj || ki == kj && h[i].prio < h[j].prio
+}
+func (h iterHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *iterHeap) Push(x interface{}) { *h = append(*h, x.(heapItem)) }
+func (h *iterHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
@@ -0,0 +1,354 @@
+package lsm
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"stupid-kv/base"
+	"stupid-kv/cache"
+	"stupid-kv/kv"
+	log "stupid-kv/logutil"
+	"sync"
+	"sync/atomic"
+)
+
+// Options sizes the tree, DefaultOptions suits datasets up to a few GB
+type Options struct {
+	MemtableSize int   // bytes buffered in memory before a flush to level 0
+	L0Files      int   // level 0 files that trigger a compaction into level 1
+	FileSize     int64 // target size of a compacted file
+	LevelBase    int64 // target size of level 1, each deeper level is 10 times larger
+	BlockCache   int64 // bytes of decoded blocks cached for reads
+}
+
+func DefaultOptions() Options {
+	return Options{
+		MemtableSize: 4 << 20,
+		L0Files:      4,
+		FileSize:     2 << 20,
+		LevelBase:    10 << 20,
+		BlockCache:   8 << 20,
+	}
+}
+
+func init() {
+	kv.RegisterStore(base.EngineLSM, func() (kv.Store, error) {
+		opts := DefaultOptions()
+		opts.BlockCache = base.GetConfig().BlockCacheSize
+		return Open(base.DataPath("lsm"), opts)
+	})
+}
+
+// Tree is a kv.Store that keeps the chain of each key as an entry of a log
+// structured merge tree: writes go to a wal and a memtable, full memtables
+// become sstables in level 0 and compactions merge them down the levels.
+type Tree struct {
+	dir  string
+	opts Options
+
+	mu     *sync.RWMutex // guards mem, log, man and tables
+	mem    *memtable
+	log    *wal
+	man    *manifest
+	tables map[uint64]*table
+	reader *blockReader
+
+	compactGuard *sync.Mutex // one compaction at a time, guards the fields below
+	watermark    base.Tid
+	pointers     [maxLevels]base.KeyT // where the next compaction of a level starts
+	dropped      int                  // versions dropped since the last Compact
+
+	wake chan struct{}
+	stop chan struct{}
+	done chan struct{}
+}
+
+func Open(dir string, opts Options) (*Tree, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	man, err := loadManifest(dir)
+	if err != nil {
+		return nil, fmt.Errorf("lsm manifest: %w", err)
+	}
+	t := &Tree{
+		dir:          dir,
+		opts:         opts,
+		mu:           &sync.RWMutex{},
+		mem:          newMemtable(),
+		man:          man,
+		tables:       make(map[uint64]*table),
+		reader:       &blockReader{cache: cache.NewLRU(opts.BlockCache)},
+		compactGuard: &sync.Mutex{},
+		wake:         make(chan struct{}, 1),
+		stop:         make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+	for _, files := range man.Levels {
+		for _, f := range files {
+			tbl, err := openTable(t.path(f.Num, "sst"), f.Num, t.reader)
+			if err != nil {
+				t.closeTables()
+				return nil, err
+			}
+			t.tables[f.Num] = tbl
+		}
+	}
+	if man.Wal == 0 {
+		man.Wal = t.nextFile()
+		if err := man.save(dir); err != nil {
+			t.closeTables()
+			return nil, err
+		}
+	}
+	t.removeObsolete()
+	if err := replayWal(t.path(man.Wal, "wal"), t.mem); err != nil {
+		t.closeTables()
+		return nil, err
+	}
+	if t.log, err = createWal(t.path(man.Wal, "wal")); err != nil {
+		t.closeTables()
+		return nil, err
+	}
+	go t.compactLoop()
+	t.maybeCompact()
+	return t, nil
+}
+
+func (t *Tree) path(num uint64, ext string) string {
+	return filepath.Join(t.dir, fmt.Sprintf("%06d.%v", num, ext))
+}
+
+// nextFile allocates a file number, the caller holds mu
+func (t *Tree) nextFile() uint64 {
+	num := t.man.NextFile
+	t.man.NextFile++
+	return num
+}
+
+// removeObsolete deletes the files a crash left behind before the manifest named them
+func (t *Tree) removeObsolete() {
+	if err := base.RemoveTempFiles(t.dir); err != nil {
+		log.Warning("lsm remove temp files: ", err)
+	}
+	files, err := ioutil.ReadDir(t.dir)
+	if err != nil {
+		return
+	}
+	for _, info := range files {
+		name := info.Name()
+		parts := strings.SplitN(name, ".", 2)
+		num, err := strconv.ParseUint(parts[0], 10, 64)
+		if err != nil || len(parts) != 2 {
+			continue
+		}
+		if _, live := t.tables[num]; (parts[1] == "sst" && !live) || (parts[1] == "wal" && num != t.man.Wal) {
+			log.Infof("lsm removes obsolete %v", name)
+			_ = os.Remove(filepath.Join(t.dir, name))
+		}
+	}
+}
+
+func (t *Tree) Load(key base.KeyT) (kv.ValueSlot, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	e, ok, err := t.find(key)
+	if err != nil {
+		log.Fatal("lsm read ", key, " error: ", err)
+	}
+	if !ok || e.deleted {
+		return kv.ValueSlot{}, false
+	}
+	var slot kv.ValueSlot
+	if err := slot.UnmarshalBinary(e.value); err != nil {
+		log.Fatal("lsm read ", key, " error: ", err)
+	}
+	return slot, true
+}
+
+// find returns the newest entry of key, the caller holds mu
+func (t *Tree) find(key base.KeyT) (entry, bool, error) {
+	if e, ok := t.mem.get(key); ok {
+		return e, true, nil
+	}
+	for _, f := range t.man.Levels[0] {
+		if key < f.Smallest || key > f.Largest {
+			continue
+		}
+		if e, ok, err := t.tables[f.Num].get(key); ok || err != nil {
+			return e, ok, err
+		}
+	}
+	for _, files := range t.man.Levels[1:] {
+		i := sort.Search(len(files), func(i int) bool { return files[i].Largest >= key })
+		if i == len(files) || files[i].Smallest > key {
+			continue
+		}
+		if e, ok, err := t.tables[files[i].Num].get(key); ok || err != nil {
+			return e, ok, err
+		}
+	}
+	return entry{}, false, nil
+}
+
+func (t *Tree) Save(key base.KeyT, slot kv.ValueSlot) {
+	value, _ := slot.MarshalBinary()
+	t.write(entry{key: key, value: value})
+}
+
+func (t *Tree) Delete(key base.KeyT) {
+	t.write(entry{key: key, deleted: true})
+}
+
+func (t *Tree) write(e entry) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := t.log.append(e); err != nil {
+		log.Fatal("lsm wal append error: ", err)
+	}
+	t.mem.put(e)
+	if t.mem.size >= t.opts.MemtableSize {
+		if err := t.flushMemtable(); err != nil {
+			log.Fatal("lsm flush memtable error: ", err)
+		}
+	}
+}
+
+// flushMemtable writes the memtable to a new level 0 table and starts a new
+// wal, the caller holds mu
+func (t *Tree) flushMemtable() error {
+	if len(t.mem.entries) == 0 {
+		return nil
+	}
+	num := t.nextFile()
+	w, err := newTableWriter(t.path(num, "sst"))
+	if err != nil {
+		return err
+	}
+	for _, e := range t.mem.sorted("", "") {
+		if err := w.add(e); err != nil {
+			w.abort()
+			return err
+		}
+	}
+	meta, err := w.finish(num)
+	if err != nil {
+		return err
+	}
+	tbl, err := openTable(t.path(num, "sst"), num, t.reader)
+	if err != nil {
+		return err
+	}
+	walNum := t.nextFile()
+	newLog, err := createWal(t.path(walNum, "wal"))
+	if err != nil {
+		tbl.close()
+		return err
+	}
+
+	man := t.man.clone()
+	man.Levels[0] = append([]fileMeta{meta}, man.Levels[0]...)
+	man.Wal = walNum
+	if err := man.save(t.dir); err != nil {
+		tbl.close()
+		newLog.close()
+		return err
+	}
+	oldWal := t.man.Wal
+	t.man = man
+	t.tables[num] = tbl
+	_ = t.log.close()
+	_ = os.Remove(t.path(oldWal, "wal"))
+	t.log, t.mem = newLog, newMemtable()
+	t.maybeCompact()
+	return nil
+}
+
+// Keys merges the memtable and every level, deleted keys are skipped
+func (t *Tree) Keys(start base.KeyT, end base.KeyT) []base.KeyT {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	it := newMergeIter(t.sources(start))
+	keys := make([]base.KeyT, 0)
+	for it.next() {
+		e := it.entry()
+		if end != "" && e.key >= end {
+			break
+		}
+		if !e.deleted {
+			keys = append(keys, e.key)
+		}
+	}
+	if err := it.err(); err != nil {
+		log.Fatal("lsm scan error: ", err)
+	}
+	return keys
+}
+
+// sources returns iterators from start on over the memtable and every level,
+// newest first, the caller holds mu
+func (t *Tree) sources(start base.KeyT) []iterator {
+	sources := []iterator{newSliceIter(t.mem.sorted(start, ""))}
+	for _, f := range t.man.Levels[0] {
+		if f.Largest >= start {
+			sources = append(sources, newTableIter(t.tables[f.Num], start))
+		}
+	}
+	for _, files := range t.man.Levels[1:] {
+		tables := make([]*table, 0, len(files))
+		for _, f := range files {
+			if f.Largest >= start {
+				tables = append(tables, t.tables[f.Num])
+			}
+		}
+		sources = append(sources, newLevelIter(tables, start))
+	}
+	return sources
+}
+
+// Flush makes the writes so far durable in the wal
+func (t *Tree) Flush() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.log.sync()
+}
+
+func (t *Tree) Close() error {
+	close(t.stop)
+	<-t.done
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	err := t.log.close()
+	t.closeTables()
+	return err
+}
+
+// StoreStats reports the block cache, the bloom filters and the files per level
+func (t *Tree) StoreStats() map[string]int64 {
+	c := t.reader.cache.Stats()
+	stats := map[string]int64{
+		"block_cache_hits":      c.Hits,
+		"block_cache_misses":    c.Misses,
+		"block_cache_evictions": c.Evictions,
+		"block_cache_bytes":     c.Size,
+		"block_cache_capacity":  c.Capacity,
+		"bloom_skips":           atomic.LoadInt64(&t.reader.filterSkips),
+		"bloom_false_positives": atomic.LoadInt64(&t.reader.filterPositive),
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for level, files := range t.man.Levels {
+		stats[fmt.Sprintf("lsm_level_%v_files", level)] = int64(len(files))
+	}
+	return stats
+}
+
+func (t *Tree) closeTables() {
+	for _, tbl := range t.tables {
+		_ = tbl.close()
+	}
+}
@@ -0,0 +1,79 @@
+package lsm
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"stupid-kv/base"
+)
+
+const maxLevels = 7
+
+type fileMeta struct {
+	Num      uint64    `json:"num"`
+	Smallest base.KeyT `json:"smallest"`
+	Largest  base.KeyT `json:"largest"`
+	Size     int64     `json:"size"`
+}
+
+// manifest lists the live files, level 0 newest first and the deeper levels
+// sorted by key without overlaps
+type manifest struct {
+	NextFile uint64       `json:"next_file"`
+	Wal      uint64       `json:"wal"`
+	Levels   [][]fileMeta `json:"levels"`
+}
+
+func loadManifest(dir string) (*manifest, error) {
+	man := &manifest{NextFile: 1, Levels: make([][]fileMeta, maxLevels)}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "MANIFEST"))
+	if os.IsNotExist(err) {
+		return man, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, man); err != nil {
+		return nil, err
+	}
+	for len(man.Levels) < maxLevels {
+		man.Levels = append(man.Levels, []fileMeta{})
+	}
+	return man, nil
+}
+
+// save replaces MANIFEST by renaming a complete copy over it
+func (m *manifest) save(dir string) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return base.WriteFile(filepath.Join(dir, "MANIFEST"), data)
+}
+
+func (m *manifest) clone() *manifest {
+	c := &manifest{NextFile: m.NextFile, Wal: m.Wal, Levels: make([][]fileMeta, len(m.Levels))}
+	for i, files := range m.Levels {
+		c.Levels[i] = append([]fileMeta{}, files...)
+	}
+	return c
+}
+
+func levelSize(files []fileMeta) int64 {
+	size := int64(0)
+	for _, f := range files {
+		size += f.Size
+	}
+	return size
+}
+
+// overlapping returns the files of a sorted level that overlap [smallest, largest]
+func overlapping(files []fileMeta, smallest base.KeyT, largest base.KeyT) []fileMeta {
+	res := make([]fileMeta, 0)
+	for _, f := range files {
+		if f.Largest >= smallest && f.Smallest <= largest {
+			res = append(res, f)
+		}
+	}
+	return res
+}
@@ -0,0 +1,41 @@
+package lsm
+
+import (
+	"sort"
+	"stupid-kv/base"
+)
+
+// memtable buffers the latest writes until they are flushed to level 0
+type memtable struct {
+	entries map[base.KeyT]entry
+	size    int
+}
+
+func newMemtable() *memtable {
+	return &memtable{entries: make(map[base.KeyT]entry)}
+}
+
+func (m *memtable) put(e entry) {
+	if old, ok := m.entries[e.key]; ok {
+		m.size -= old.size()
+	}
+	m.entries[e.key] = e
+	m.size += e.size()
+}
+
+func (m *memtable) get(key base.KeyT) (entry, bool) {
+	e, ok := m.entries[key]
+	return e, ok
+}
+
+// sorted returns the entries in [start, end) in key order, an empty end means no upper bound
+func (m *memtable) sorted(start base.KeyT, end base.KeyT) []entry {
+	entries := make([]entry, 0, len(m.entries))
+	for key, e := range m.entries {
+		if key >= start && (end == "" || key < end) {
+			entries = append(entries, e)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].key < entries[j].key })
+	return entries
+}
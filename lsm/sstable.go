@@ -0,0 +1,345 @@
+package lsm
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sort"
+	"stupid-kv/base"
+	"stupid-kv/cache"
+	"sync/atomic"
+)
+
+// An sstable is a sorted immutable file of entries:
+//
+//	data blocks:  entries, crc32c of the entries
+//	filter block: bloom filter of the keys, crc32c
+//	index block:  uvarint length and last key, uvarint offset and length of every data block, crc32c
+//	footer:       index offset, index length, filter offset, filter length, entry count, magic, 8 bytes each
+//
+// Tables of the first version have no filter block and a 32 byte footer
+// without the filter fields.
+const (
+	blockSize    = 4 << 10
+	footerSize   = 48
+	footerSizeV1 = 32
+	tableMagic   = 0x73746b766c736d32 // "stkvlsm2"
+	tableMagicV1 = 0x73746b766c736d31 // "stkvlsm1"
+	checksumLen  = 4
+)
+
+type blockHandle struct {
+	lastKey base.KeyT
+	offset  int64
+	length  int64
+}
+
+type tableWriter struct {
+	f        *os.File
+	w        *bufio.Writer
+	offset   int64
+	block    []byte
+	lastKey  base.KeyT
+	index    []blockHandle
+	count    uint64
+	smallest base.KeyT
+	hashes   [][2]uint32 // of every key, for the bloom filter
+}
+
+func newTableWriter(path string) (*tableWriter, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &tableWriter{f: f, w: bufio.NewWriter(f)}, nil
+}
+
+// add appends e, entries must come in increasing key order
+func (t *tableWriter) add(e entry) error {
+	if t.count == 0 {
+		t.smallest = e.key
+	}
+	t.block = appendEntry(t.block, e)
+	t.lastKey = e.key
+	h1, h2 := bloomHash(e.key)
+	t.hashes = append(t.hashes, [2]uint32{h1, h2})
+	t.count++
+	if len(t.block) >= blockSize {
+		return t.finishBlock()
+	}
+	return nil
+}
+
+func (t *tableWriter) size() int64 {
+	return t.offset + int64(len(t.block))
+}
+
+func (t *tableWriter) finishBlock() error {
+	if len(t.block) == 0 {
+		return nil
+	}
+	var sum [checksumLen]byte
+	binary.LittleEndian.PutUint32(sum[:], checksum(t.block))
+	t.block = append(t.block, sum[:]...)
+	if _, err := t.w.Write(t.block); err != nil {
+		return err
+	}
+	t.index = append(t.index, blockHandle{t.lastKey, t.offset, int64(len(t.block))})
+	t.offset += int64(len(t.block))
+	t.block = t.block[:0]
+	return nil
+}
+
+// finish writes the index and footer and returns the meta of the table
+func (t *tableWriter) finish(num uint64) (fileMeta, error) {
+	if err := t.finishBlock(); err != nil {
+		t.f.Close()
+		return fileMeta{}, err
+	}
+	var sum [checksumLen]byte
+	filter := []byte(newBloom(t.hashes))
+	binary.LittleEndian.PutUint32(sum[:], checksum(filter))
+	filter = append(filter, sum[:]...)
+	filterOffset := t.offset
+	if _, err := t.w.Write(filter); err != nil {
+		t.f.Close()
+		return fileMeta{}, err
+	}
+	t.offset += int64(len(filter))
+
+	var tmp [binary.MaxVarintLen64]byte
+	index := make([]byte, 0)
+	for _, h := range t.index {
+		index = append(index, tmp[:binary.PutUvarint(tmp[:], uint64(len(h.lastKey)))]...)
+		index = append(index, h.lastKey...)
+		index = append(index, tmp[:binary.PutUvarint(tmp[:], uint64(h.offset))]...)
+		index = append(index, tmp[:binary.PutUvarint(tmp[:], uint64(h.length))]...)
+	}
+	binary.LittleEndian.PutUint32(sum[:], checksum(index))
+	index = append(index, sum[:]...)
+
+	var footer [footerSize]byte
+	binary.LittleEndian.PutUint64(footer[0:8], uint64(t.offset))
+	binary.LittleEndian.PutUint64(footer[8:16], uint64(len(index)))
+	binary.LittleEndian.PutUint64(footer[16:24], uint64(filterOffset))
+	binary.LittleEndian.PutUint64(footer[24:32], uint64(len(filter)))
+	binary.LittleEndian.PutUint64(footer[32:40], t.count)
+	binary.LittleEndian.PutUint64(footer[40:48], tableMagic)
+	if _, err := t.w.Write(index); err != nil {
+		t.f.Close()
+		return fileMeta{}, err
+	}
+	if _, err := t.w.Write(footer[:]); err != nil {
+		t.f.Close()
+		return fileMeta{}, err
+	}
+	if err := t.w.Flush(); err != nil {
+		t.f.Close()
+		return fileMeta{}, err
+	}
+	if base.GetConfig().Fsync == base.FsyncAlways {
+		if err := t.f.Sync(); err != nil {
+			t.f.Close()
+			return fileMeta{}, err
+		}
+	}
+	size := t.offset + int64(len(index)) + footerSize
+	meta := fileMeta{Num: num, Smallest: t.smallest, Largest: t.lastKey, Size: size}
+	return meta, t.f.Close()
+}
+
+func (t *tableWriter) abort() {
+	t.f.Close()
+	os.Remove(t.f.Name())
+}
+
+// blockReader is shared by the tables of a tree
+type blockReader struct {
+	cache          *cache.LRU
+	filterSkips    int64 // point reads a bloom filter answered without a block
+	filterPositive int64 // point reads a bloom filter let through that found nothing
+}
+
+// table reads an sstable, the index and filter stay in memory
+type table struct {
+	num    uint64
+	f      *os.File
+	index  []blockHandle
+	filter bloom // nil for first version tables
+	reader *blockReader
+}
+
+func openTable(path string, num uint64, reader *blockReader) (*table, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	t := &table{num: num, f: f, reader: reader}
+	if err := t.readIndex(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%v: %w", path, err)
+	}
+	return t, nil
+}
+
+func (t *table) readIndex() error {
+	info, err := t.f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() < footerSizeV1 {
+		return ErrCorrupted
+	}
+	var magic [8]byte
+	if _, err := t.f.ReadAt(magic[:], info.Size()-8); err != nil {
+		return err
+	}
+	size := footerSize
+	switch binary.LittleEndian.Uint64(magic[:]) {
+	case tableMagic:
+	case tableMagicV1:
+		size = footerSizeV1
+	default:
+		return ErrCorrupted
+	}
+	if info.Size() < int64(size) {
+		return ErrCorrupted
+	}
+	footer := make([]byte, size)
+	if _, err := t.f.ReadAt(footer, info.Size()-int64(size)); err != nil {
+		return err
+	}
+	offset := int64(binary.LittleEndian.Uint64(footer[0:8]))
+	length := int64(binary.LittleEndian.Uint64(footer[8:16]))
+	if offset < 0 || length < checksumLen || offset+length+int64(size) != info.Size() {
+		return ErrCorrupted
+	}
+	if size == footerSize {
+		if err := t.readFilter(int64(binary.LittleEndian.Uint64(footer[16:24])), int64(binary.LittleEndian.Uint64(footer[24:32]))); err != nil {
+			return err
+		}
+	}
+	index := make([]byte, length)
+	if _, err := t.f.ReadAt(index, offset); err != nil {
+		return err
+	}
+	index, sum := index[:length-checksumLen], index[length-checksumLen:]
+	if checksum(index) != binary.LittleEndian.Uint32(sum) {
+		return ErrCorrupted
+	}
+	for len(index) > 0 {
+		keyLen, n := binary.Uvarint(index)
+		if n <= 0 || uint64(len(index)-n) < keyLen {
+			return ErrCorrupted
+		}
+		h := blockHandle{lastKey: base.KeyT(index[n : n+int(keyLen)])}
+		index = index[n+int(keyLen):]
+		off, n := binary.Uvarint(index)
+		if n <= 0 {
+			return ErrCorrupted
+		}
+		index = index[n:]
+		l, n := binary.Uvarint(index)
+		if n <= 0 {
+			return ErrCorrupted
+		}
+		index = index[n:]
+		h.offset, h.length = int64(off), int64(l)
+		t.index = append(t.index, h)
+	}
+	return nil
+}
+
+func (t *table) readFilter(offset int64, length int64) error {
+	if offset < 0 || length < checksumLen {
+		return ErrCorrupted
+	}
+	filter := make([]byte, length)
+	if _, err := t.f.ReadAt(filter, offset); err != nil {
+		return err
+	}
+	filter, sum := filter[:length-checksumLen], filter[length-checksumLen:]
+	if checksum(filter) != binary.LittleEndian.Uint32(sum) {
+		return ErrCorrupted
+	}
+	t.filter = bloom(filter)
+	return nil
+}
+
+// readBlock returns the entries of the i-th block, through the block cache
+func (t *table) readBlock(i int) ([]entry, error) {
+	h := t.index[i]
+	key := cache.Key{File: t.num, Offset: h.offset}
+	if entries, ok := t.reader.cache.Get(key); ok {
+		return entries.([]entry), nil
+	}
+	entries, err := t.decodeBlock(i)
+	if err != nil {
+		return nil, err
+	}
+	t.reader.cache.Add(key, entries, h.length)
+	return entries, nil
+}
+
+func (t *table) decodeBlock(i int) ([]entry, error) {
+	h := t.index[i]
+	if h.length < checksumLen {
+		return nil, ErrCorrupted
+	}
+	data := make([]byte, h.length)
+	if _, err := t.f.ReadAt(data, h.offset); err != nil {
+		return nil, err
+	}
+	data, sum := data[:h.length-checksumLen], data[h.length-checksumLen:]
+	if checksum(data) != binary.LittleEndian.Uint32(sum) {
+		return nil, fmt.Errorf("%v block %v: %w", t.f.Name(), i, ErrCorrupted)
+	}
+	entries := make([]entry, 0)
+	for len(data) > 0 {
+		e, n, err := readEntry(data)
+		if err != nil {
+			return nil, fmt.Errorf("%v block %v: %w", t.f.Name(), i, err)
+		}
+		entries = append(entries, e)
+		data = data[n:]
+	}
+	return entries, nil
+}
+
+// seekBlock returns the first block that may hold key
+func (t *table) seekBlock(key base.KeyT) int {
+	return sort.Search(len(t.index), func(i int) bool { return t.index[i].lastKey >= key })
+}
+
+func (t *table) get(key base.KeyT) (entry, bool, error) {
+	if t.filter != nil && !t.filter.mayContain(key) {
+		atomic.AddInt64(&t.reader.filterSkips, 1)
+		return entry{}, false, nil
+	}
+	i := t.seekBlock(key)
+	if i == len(t.index) {
+		t.missed()
+		return entry{}, false, nil
+	}
+	entries, err := t.readBlock(i)
+	if err != nil {
+		return entry{}, false, err
+	}
+	j := sort.Search(len(entries), func(j int) bool { return entries[j].key >= key })
+	if j < len(entries) && entries[j].key == key {
+		return entries[j], true, nil
+	}
+	t.missed()
+	return entry{}, false, nil
+}
+
+func (t *table) missed() {
+	if t.filter != nil {
+		atomic.AddInt64(&t.reader.filterPositive, 1)
+	}
+}
+
+func (t *table) close() error {
+	return t.f.Close()
+}
@@ -0,0 +1,94 @@
+package lsm
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"os"
+	"stupid-kv/base"
+	"stupid-kv/kv"
+)
+
+// wal logs every memtable write as crc32c, length and entry, so the
+// memtable survives a restart. It is dropped once the memtable is flushed.
+type wal struct {
+	f *os.File
+	w *bufio.Writer
+	// bytes appended since the last sync
+	unsynced int64
+}
+
+func createWal(path string) (*wal, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &wal{f: f, w: bufio.NewWriter(f)}, nil
+}
+
+func (l *wal) append(e entry) error {
+	payload := appendEntry(nil, e)
+	var header [8]byte
+	binary.LittleEndian.PutUint32(header[0:4], checksum(payload))
+	binary.LittleEndian.PutUint32(header[4:8], uint32(len(payload)))
+	if _, err := l.w.Write(header[:]); err != nil {
+		return err
+	}
+	_, err := l.w.Write(payload)
+	l.unsynced += int64(len(header) + len(payload))
+	return err
+}
+
+func (l *wal) sync() error {
+	if err := l.w.Flush(); err != nil {
+		return err
+	}
+	kv.FlushBytes.Add(l.unsynced)
+	l.unsynced = 0
+	if base.GetConfig().Fsync == base.FsyncAlways {
+		return l.f.Sync()
+	}
+	return nil
+}
+
+func (l *wal) close() error {
+	if err := l.sync(); err != nil {
+		l.f.Close()
+		return err
+	}
+	return l.f.Close()
+}
+
+// replayWal puts every intact record of the wal at path into mem and cuts
+// off a torn tail, left by a crash in the middle of a write
+func replayWal(path string, mem *memtable) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	good := int64(0)
+	for {
+		var header [8]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			break
+		}
+		payload := make([]byte, binary.LittleEndian.Uint32(header[4:8]))
+		if _, err := io.ReadFull(r, payload); err != nil {
+			break
+		}
+		if checksum(payload) != binary.LittleEndian.Uint32(header[0:4]) {
+			break
+		}
+		e, n, err := readEntry(payload)
+		if err != nil || n != len(payload) {
+			break
+		}
+		mem.put(e)
+		good += int64(len(header) + len(payload))
+	}
+	return f.Truncate(good)
+}
@@ -1,15 +1,182 @@
 package main
 
-func main() {
-	println("VALUE_NOT_VALID : ", 0xdddddd)
-	println("VALUE_NOT_COMMIT: ", 0xeeeeee)
-	println("VALUE_NOT_FOUND : ", 0xffffff)
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"stupid-kv/base"
+	_ "stupid-kv/btree" // registers the btree storage engine
+	log "stupid-kv/logutil"
+	_ "stupid-kv/lsm" // registers the lsm storage engine
+	"stupid-kv/shell"
+)
+
+type command struct {
+	usage string
+	run   func(args []string) error
+}
+
+var commands = map[string]command{
+	"serve":   {"serve the resp, http and grpc apis", runServe},
+	"route":   {"serve the grpc api over the configured shards", runRoute},
+	"shell":   {"interactive queries", runShell},
+	"get":     {"get key", runGet},
+	"put":     {"put key value", runPut},
+	"del":     {"del key", runDel},
+	"dump":    {"print every key, or every version with -history", runDump},
+	"load":    {"load [file], put the keys of a json dump, stdin if no file", runLoad},
+	"export":  {"export [file], write the latest values or -history as jsonl or csv", runExport},
+	"import":  {"import [file], put the rows of an export in batched txns, resumable", runImport},
+	"check":   {"check that the data dir files parse", runCheck},
+	"compact": {"drop mvcc versions no txn can read any more", runCompact},
+	"bench":   {"run a concurrent txn workload and report throughput", runBench},
+	"recover": {"roll back txns interrupted by a shutdown", runRecover},
+	"promote": {"turn a running replica into a primary", runPromote},
+	"backup":  {"backup file, write a consistent backup without stopping writers", runBackup},
+	"restore": {"restore file, replace the data dir with a backup, then replay a cdc log", runRestore},
+}
+
+// cmdFlags are the flags every command takes
+type cmdFlags struct {
+	*flag.FlagSet
+	config      string
+	dataDir     string
+	format      string
+	remote      string
+	printConfig bool
+
+	// check, if set, validates the flags of the command, a failure is a usage error
+	check func() error
+	// defaultDataDir, if set, makes the data dir when -data-dir is not given,
+	// not for -print-config
+	defaultDataDir func() (string, error)
+}
+
+func newCmdFlags(name string, remote bool) *cmdFlags {
+	f := &cmdFlags{FlagSet: flag.NewFlagSet(name, flag.ExitOnError)}
+	f.StringVar(&f.config, "config", "", "path to a .toml or .yaml config file")
+	f.StringVar(&f.dataDir, "data-dir", "", "data dir, overrides the config")
+	f.StringVar(&f.format, "format", "text", "output format, text or json")
+	f.BoolVar(&f.printConfig, "print-config", false, "print the effective config and exit")
+	if remote {
+		f.StringVar(&f.remote, "remote", "", "grpc address of a running server, the data dir is opened locally if empty")
+	}
+	return f
+}
 
-	//TestCase1()
-	//TestCase2()
-	//TestCase3()
+// parse parses args and sets up the config, logs and data dir.
+func (f *cmdFlags) parse(args []string) (*base.Config, error) {
+	_ = f.Parse(args)
+	if f.format != "text" && f.format != "json" {
+		return nil, fmt.Errorf("unknown format %q", f.format)
+	}
+	if f.check != nil {
+		if err := f.check(); err != nil {
+			fmt.Fprintln(f.Output(), err)
+			f.Usage()
+			os.Exit(2)
+		}
+	}
+	cfg, err := base.LoadConfig(f.config)
+	if err != nil {
+		return nil, fmt.Errorf("load config error: %v", err)
+	}
+	if f.dataDir != "" {
+		cfg.DataDir = f.dataDir
+	}
+	if f.printConfig {
+		fmt.Print(cfg)
+		os.Exit(0)
+	}
+	if f.dataDir == "" && f.defaultDataDir != nil {
+		if cfg.DataDir, err = f.defaultDataDir(); err != nil {
+			return nil, err
+		}
+	}
 
-	//TestCase52()
+	// validated by LoadConfig
+	level, _ := log.ParseLevel(cfg.LogLevel)
+	packageLevels, _ := log.ParsePackageLevels(cfg.LogLevels)
+	format, _ := log.ParseFormat(cfg.LogFormat)
+	log.SetLevel(level)
+	log.SetPackageLevels(packageLevels)
+	log.SetFormat(format)
+	if cfg.LogFile != "" {
+		f, err := log.OpenRotatingFile(cfg.LogFile, log.RotateOptions{
+			MaxSize:    cfg.LogMaxSize,
+			Every:      cfg.LogRotateInterval,
+			MaxAge:     cfg.LogMaxAge,
+			MaxBackups: cfg.LogMaxBackups,
+			Compress:   cfg.LogCompress,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("open log file error: %v", err)
+		}
+		log.SetOutput(f, f, f, f)
+	}
+	base.SetConfig(cfg)
+	if err := os.MkdirAll(cfg.DataDir, 0755); err != nil {
+		return nil, fmt.Errorf("setup data dir error: %v", err)
+	}
+	return cfg, nil
+}
+
+// quiet keeps txn logs out of command output, a log file already does
+func quiet() {
+	if base.GetConfig().LogFile != "" {
+		return
+	}
+	log.SetOutput(ioutil.Discard, ioutil.Discard, os.Stderr, os.Stderr)
+}
+
+func (f *cmdFlags) dial() (*shell.Client, func(), error) {
+	if f.remote != "" {
+		return shell.DialRemote(f.remote)
+	}
+	return shell.DialLocal()
+}
 
-	TestCase5()
+// output prints v as json, or calls text for the text format
+func (f *cmdFlags) output(v interface{}, text func()) error {
+	if f.format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+	text()
+	return nil
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: stupid-kv <command> [flags] [args]")
+	fmt.Fprintln(os.Stderr, "commands:")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-8v %v\n", name, commands[name].usage)
+	}
+	fmt.Fprintln(os.Stderr, "run `stupid-kv <command> -h` for its flags")
+}
+
+func main() {
+	if len(os.Args) < 2 || os.Args[1] == "-h" || os.Args[1] == "help" {
+		usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", os.Args[1])
+		usage()
+		os.Exit(2)
+	}
+	if err := cmd.run(os.Args[2:]); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
 }
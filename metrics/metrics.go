@@ -0,0 +1,229 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Registry holds metrics by name and writes them in the Prometheus text
+// exposition format. Series of one name differ by their labels.
+type Registry struct {
+	guard    *sync.Mutex
+	families map[string]*family
+}
+
+type family struct {
+	name, help, kind string
+	series           []series
+}
+
+type series interface {
+	write(w io.Writer, name string, labels string)
+	labelString() string
+}
+
+func NewRegistry() *Registry {
+	return &Registry{guard: &sync.Mutex{}, families: make(map[string]*family)}
+}
+
+// Default is the registry the New functions register with and Handler serves
+var Default = NewRegistry()
+
+func (r *Registry) register(name, help, kind string, s series) {
+	r.guard.Lock()
+	defer r.guard.Unlock()
+	f, ok := r.families[name]
+	if !ok {
+		f = &family{name: name, help: help, kind: kind}
+		r.families[name] = f
+	} else if f.kind != kind {
+		panic(fmt.Sprintf("metrics: %v registered as %v and %v", name, f.kind, kind))
+	}
+	f.series = append(f.series, s)
+}
+
+// WriteText writes every metric, sorted by name
+func (r *Registry) WriteText(w io.Writer) error {
+	r.guard.Lock()
+	families := make([]*family, 0, len(r.families))
+	for _, f := range r.families {
+		families = append(families, f)
+	}
+	r.guard.Unlock()
+	sort.Slice(families, func(i, j int) bool { return families[i].name < families[j].name })
+
+	bw := bufio.NewWriter(w)
+	for _, f := range families {
+		fmt.Fprintf(bw, "# HELP %v %v\n", f.name, strings.Replace(f.help, "\n", " ", -1))
+		fmt.Fprintf(bw, "# TYPE %v %v\n", f.name, f.kind)
+		for _, s := range f.series {
+			s.write(bw, f.name, s.labelString())
+		}
+	}
+	return bw.Flush()
+}
+
+// Handler serves Default for a Prometheus scrape
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_ = Default.WriteText(w)
+	})
+}
+
+// labels renders name, value pairs as `a="x",b="y"`
+type labels string
+
+func makeLabels(pairs []string) labels {
+	if len(pairs)%2 != 0 {
+		panic("metrics: labels must be name, value pairs")
+	}
+	parts := make([]string, 0, len(pairs)/2)
+	for i := 0; i < len(pairs); i += 2 {
+		parts = append(parts, pairs[i]+"="+strconv.Quote(pairs[i+1]))
+	}
+	return labels(strings.Join(parts, ","))
+}
+
+func (l labels) labelString() string { return string(l) }
+
+// withLabels renders name{labels,extra}, leaving out empty parts
+func withLabels(name string, labels string, extra string) string {
+	if labels != "" && extra != "" {
+		labels += ","
+	}
+	labels += extra
+	if labels == "" {
+		return name
+	}
+	return name + "{" + labels + "}"
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Counter only goes up
+type Counter struct {
+	labels
+	value uint64
+}
+
+// NewCounter registers a counter, labels are name, value pairs
+func NewCounter(name, help string, labelPairs ...string) *Counter {
+	c := &Counter{labels: makeLabels(labelPairs)}
+	Default.register(name, help, "counter", c)
+	return c
+}
+
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.value, 1)
+}
+
+func (c *Counter) Add(n int64) {
+	if n > 0 {
+		atomic.AddUint64(&c.value, uint64(n))
+	}
+}
+
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.value)
+}
+
+func (c *Counter) write(w io.Writer, name string, labels string) {
+	fmt.Fprintf(w, "%v %v\n", withLabels(name, labels, ""), c.Value())
+}
+
+// GaugeFunc reads its value when scraped
+type GaugeFunc struct {
+	labels
+	fn func() float64
+}
+
+func NewGaugeFunc(name, help string, fn func() float64, labelPairs ...string) *GaugeFunc {
+	g := &GaugeFunc{labels: makeLabels(labelPairs), fn: fn}
+	Default.register(name, help, "gauge", g)
+	return g
+}
+
+func (g *GaugeFunc) write(w io.Writer, name string, labels string) {
+	fmt.Fprintf(w, "%v %v\n", withLabels(name, labels, ""), formatFloat(g.fn()))
+}
+
+var (
+	// DurationBuckets suit latencies in seconds, from 50µs to 10s
+	DurationBuckets = []float64{.00005, .0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+)
+
+// ExpBuckets returns n upper bounds from start, each factor times the one before
+func ExpBuckets(start, factor float64, n int) []float64 {
+	buckets := make([]float64, n)
+	for i := range buckets {
+		buckets[i] = start
+		start *= factor
+	}
+	return buckets
+}
+
+// Histogram counts observations in buckets by upper bound
+type Histogram struct {
+	labels
+	bounds []float64
+	counts []uint64 // per bucket, the last one past every bound
+	sum    uint64   // float64 bits
+}
+
+// NewHistogram registers a histogram with the sorted upper bounds of its buckets
+func NewHistogram(name, help string, bounds []float64, labelPairs ...string) *Histogram {
+	h := &Histogram{
+		labels: makeLabels(labelPairs),
+		bounds: bounds,
+		counts: make([]uint64, len(bounds)+1),
+	}
+	Default.register(name, help, "histogram", h)
+	return h
+}
+
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.bounds, v)
+	atomic.AddUint64(&h.counts[i], 1)
+	for {
+		old := atomic.LoadUint64(&h.sum)
+		sum := math.Float64bits(math.Float64frombits(old) + v)
+		if atomic.CompareAndSwapUint64(&h.sum, old, sum) {
+			return
+		}
+	}
+}
+
+// Since observes the seconds passed since start
+func (h *Histogram) Since(start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
+
+func (h *Histogram) write(w io.Writer, name string, labels string) {
+	cumulative := uint64(0)
+	for i, bound := range h.bounds {
+		cumulative += atomic.LoadUint64(&h.counts[i])
+		fmt.Fprintf(w, "%v %v\n", withLabels(name+"_bucket", labels, `le="`+formatFloat(bound)+`"`), cumulative)
+	}
+	cumulative += atomic.LoadUint64(&h.counts[len(h.bounds)])
+	fmt.Fprintf(w, "%v %v\n", withLabels(name+"_bucket", labels, `le="+Inf"`), cumulative)
+	fmt.Fprintf(w, "%v %v\n", withLabels(name+"_sum", labels, ""), formatFloat(math.Float64frombits(atomic.LoadUint64(&h.sum))))
+	fmt.Fprintf(w, "%v %v\n", withLabels(name+"_count", labels, ""), cumulative)
+}
@@ -0,0 +1,4 @@
+// Package pb holds the grpc api of stupid-kv, generated from stupidkv.proto.
+package pb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative stupidkv.proto
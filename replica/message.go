@@ -0,0 +1,22 @@
+package replica
+
+import (
+	"stupid-kv/base"
+	"stupid-kv/txn"
+)
+
+const (
+	msgSnapshot  = "snapshot"  // the whole store, sent first on every connection
+	msgCommit    = "commit"    // the writes of a committed txn
+	msgHeartbeat = "heartbeat" // the replica has every commit up to Time
+)
+
+// message is a line of the replication stream, json encoded
+type message struct {
+	Type     string      `json:"type"`
+	Time     int64       `json:"time"` // unix nano on the primary
+	Tid      base.Tid    `json:"tid"`  // the committed tid, or the next tid of the primary
+	Writes   []txn.Write `json:"writes,omitempty"`
+	Data     []byte      `json:"data,omitempty"`     // kv snapshot in the binary data format, base64
+	Rollback []base.Tid  `json:"rollback,omitempty"` // tids Data may hold in part
+}
@@ -0,0 +1,148 @@
+package replica
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"stupid-kv/base"
+	log "stupid-kv/logutil"
+	"stupid-kv/txn"
+	"sync"
+)
+
+// Node is the primary-backup role of this server: a replica when
+// replicate_from is set, otherwise a primary when repl_addr is set
+type Node struct {
+	guard    *sync.Mutex
+	replAddr string
+	primary  *Primary
+	replica  *Replica
+}
+
+// Status is what GET /replica/status reports
+type Status struct {
+	Role       string   `json:"role"` // primary or replica
+	Primary    string   `json:"primary,omitempty"`
+	Connected  bool     `json:"connected"`
+	AppliedTid base.Tid `json:"applied_tid"`
+	PrimaryTid base.Tid `json:"primary_tid"`
+	LagMs      int64    `json:"lag_ms"` // -1 before the first message
+	Replicas   []string `json:"replicas,omitempty"`
+}
+
+func NewNode(cfg *base.Config) (*Node, error) {
+	n := &Node{guard: &sync.Mutex{}, replAddr: cfg.ReplAddr}
+	if cfg.ReplicateFrom != "" {
+		n.replica = NewReplica(cfg.ReplicateFrom)
+		log.Infof("replica of %v", cfg.ReplicateFrom)
+		return n, nil
+	}
+	if err := n.startPrimary(); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// startPrimary listens on repl_addr if set, the caller holds guard or owns n
+func (n *Node) startPrimary() error {
+	if n.replAddr == "" {
+		return nil
+	}
+	l, err := net.Listen("tcp", n.replAddr)
+	if err != nil {
+		return err
+	}
+	n.primary = NewPrimary()
+	go func() {
+		if err := n.primary.Serve(l); err != nil {
+			log.Warning("replication primary stops: ", err)
+		}
+	}()
+	return nil
+}
+
+// Promote turns a replica into a primary for manual failover. Writes are
+// taken from now on, the config must drop replicate_from before a restart.
+func (n *Node) Promote() error {
+	n.guard.Lock()
+	defer n.guard.Unlock()
+	if n.replica == nil {
+		return errors.New("not a replica")
+	}
+	n.replica.Stop()
+	n.replica = nil
+	txn.GetManagerInstance().SetReplicator(nil)
+	log.Warning("promoted to primary")
+	return n.startPrimary()
+}
+
+func (n *Node) Status() Status {
+	n.guard.Lock()
+	defer n.guard.Unlock()
+	if n.replica == nil {
+		s := Status{Role: "primary", Connected: true, LagMs: 0}
+		s.AppliedTid = txn.GetManagerInstance().Stats().CurTid - 1
+		s.PrimaryTid = s.AppliedTid + 1
+		if n.primary != nil {
+			s.Replicas = n.primary.Replicas()
+		}
+		return s
+	}
+	r := n.replica
+	lag := r.Lag()
+	r.guard.Lock()
+	defer r.guard.Unlock()
+	s := Status{
+		Role:       "replica",
+		Primary:    r.primary,
+		Connected:  r.conn != nil,
+		AppliedTid: r.appliedTid,
+		PrimaryTid: r.primaryTid,
+		LagMs:      int64(lag / 1e6),
+	}
+	if lag < 0 {
+		s.LagMs = -1
+	}
+	return s
+}
+
+func (n *Node) Close() error {
+	n.guard.Lock()
+	defer n.guard.Unlock()
+	if n.replica != nil {
+		n.replica.Stop()
+	}
+	if n.primary != nil {
+		return n.primary.Close()
+	}
+	return nil
+}
+
+// Handler serves GET /replica/status and POST /replica/promote
+func (n *Node) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/replica/status", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, n.Status())
+	})
+	mux.HandleFunc("/replica/promote", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]interface{}{"error": "use POST"})
+			return
+		}
+		if err := n.Promote(); err != nil {
+			writeJSON(w, http.StatusConflict, map[string]interface{}{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, n.Status())
+	})
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Warning("http write error: ", err)
+	}
+}
@@ -0,0 +1,173 @@
+package replica
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"stupid-kv/base"
+	"stupid-kv/kv"
+	log "stupid-kv/logutil"
+	"stupid-kv/txn"
+	"sync"
+	"time"
+)
+
+const (
+	heartbeatInterval = time.Second
+	writeTimeout      = 10 * time.Second
+	// sendBuffer is how many commits a replica may lag behind before it is
+	// dropped, it reconnects and starts over from a snapshot
+	sendBuffer = 4096
+)
+
+// Primary streams the commits of this node to replicas over tcp. A replica
+// gets a snapshot first, then every commit since the snapshot.
+type Primary struct {
+	guard    *sync.Mutex
+	listener net.Listener
+	replicas map[string]time.Time // remote addr -> connected since
+	closed   bool
+}
+
+func NewPrimary() *Primary {
+	return &Primary{
+		guard:    &sync.Mutex{},
+		replicas: make(map[string]time.Time),
+	}
+}
+
+func (p *Primary) Serve(l net.Listener) error {
+	p.guard.Lock()
+	p.listener = l
+	p.guard.Unlock()
+	log.Infof("replication primary listens on %v", l.Addr())
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			p.guard.Lock()
+			closed := p.closed
+			p.guard.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+		go p.serve(conn)
+	}
+}
+
+func (p *Primary) Close() error {
+	p.guard.Lock()
+	defer p.guard.Unlock()
+	p.closed = true
+	if p.listener != nil {
+		return p.listener.Close()
+	}
+	return nil
+}
+
+// Replicas returns the addrs of the connected replicas
+func (p *Primary) Replicas() []string {
+	p.guard.Lock()
+	defer p.guard.Unlock()
+	addrs := make([]string, 0, len(p.replicas))
+	for addr := range p.replicas {
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
+
+func (p *Primary) serve(conn net.Conn) {
+	addr := conn.RemoteAddr().String()
+	defer conn.Close()
+
+	// listen before the snapshot, commits in both are skipped by the replica
+	events := make(chan message, sendBuffer)
+	overflow := make(chan struct{})
+	var once sync.Once
+	tm := txn.GetManagerInstance()
+	id := tm.AddCommitListener(func(tid base.Tid, writes []txn.Write) {
+		select {
+		case events <- message{Type: msgCommit, Time: time.Now().UnixNano(), Tid: tid, Writes: writes}:
+		default:
+			once.Do(func() { close(overflow) })
+		}
+	})
+	defer tm.RemoveCommitListener(id)
+
+	snap, err := snapshot()
+	if err != nil {
+		log.Warning("replication snapshot error: ", err)
+		return
+	}
+	w := bufio.NewWriter(conn)
+	enc := json.NewEncoder(w)
+	send := func(msg message) error {
+		_ = conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		if err := enc.Encode(msg); err != nil {
+			return err
+		}
+		return w.Flush()
+	}
+	if err := send(snap); err != nil {
+		log.Warningf("replica %v: %v", addr, err)
+		return
+	}
+	p.guard.Lock()
+	p.replicas[addr] = time.Now()
+	p.guard.Unlock()
+	log.Infof("replica %v connected", addr)
+	defer func() {
+		p.guard.Lock()
+		delete(p.replicas, addr)
+		p.guard.Unlock()
+		log.Infof("replica %v disconnected", addr)
+	}()
+
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	for {
+		var msg message
+		select {
+		case msg = <-events:
+		case <-ticker.C:
+			if len(events) > 0 {
+				continue // the heartbeat would claim commits still queued
+			}
+			msg = message{Type: msgHeartbeat, Time: time.Now().UnixNano(), Tid: tm.Stats().CurTid}
+		case <-overflow:
+			log.Warningf("replica %v lags more than %v commits, drop it", addr, sendBuffer)
+			return
+		}
+		if err := send(msg); err != nil {
+			log.Warningf("replica %v: %v", addr, err)
+			return
+		}
+	}
+}
+
+// snapshot copies the store with the tids active or begun around the copy,
+// the replica rolls them back and applies them again if they commit.
+func snapshot() (message, error) {
+	tm := txn.GetManagerInstance()
+	before := tm.Stats()
+	data, err := kv.GetManagerInstance().Snapshot()
+	if err != nil {
+		return message{}, err
+	}
+	stats := tm.Stats()
+	rollback := make([]base.Tid, 0)
+	seen := make(map[base.Tid]bool)
+	for _, tid := range append(before.ActiveTids, stats.ActiveTids...) {
+		if !seen[tid] {
+			rollback = append(rollback, tid)
+			seen[tid] = true
+		}
+	}
+	for tid := before.CurTid; tid < stats.CurTid; tid++ {
+		if !seen[tid] {
+			rollback = append(rollback, tid)
+		}
+	}
+	return message{Type: msgSnapshot, Time: time.Now().UnixNano(), Tid: stats.CurTid, Data: data, Rollback: rollback}, nil
+}
@@ -0,0 +1,182 @@
+package replica
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net"
+	"stupid-kv/base"
+	"stupid-kv/kv"
+	log "stupid-kv/logutil"
+	"stupid-kv/txn"
+	"sync"
+	"time"
+)
+
+const (
+	dialTimeout       = 5 * time.Second
+	reconnectInterval = time.Second
+	// readTimeout drops a primary that misses a few heartbeats
+	readTimeout = 3 * heartbeatInterval
+)
+
+var ErrReadOnly = errors.New("read-only replica, write to the primary")
+
+// Replica applies the stream of a primary and rejects writes, the servers of
+// this node serve snapshot reads of what it applied so far.
+type Replica struct {
+	primary string
+
+	guard       *sync.Mutex
+	conn        net.Conn
+	appliedTid  base.Tid // newest commit applied
+	primaryTid  base.Tid // next tid of the primary as far as known
+	primaryTime int64    // unix nano on the primary of the newest applied message
+	stopped     bool
+	stop        chan struct{}
+}
+
+// NewReplica makes txn.Manager read-only and follows primary until Stop
+func NewReplica(primary string) *Replica {
+	r := &Replica{
+		primary: primary,
+		guard:   &sync.Mutex{},
+		stop:    make(chan struct{}),
+	}
+	txn.GetManagerInstance().SetReplicator(r)
+	go r.loop()
+	return r
+}
+
+// Writable implements txn.Replicator
+func (r *Replica) Writable() error {
+	return ErrReadOnly
+}
+
+// Replicate implements txn.Replicator
+func (r *Replica) Replicate(tid base.Tid, writes []txn.Write) error {
+	return ErrReadOnly
+}
+
+func (r *Replica) loop() {
+	for {
+		err := r.follow()
+		select {
+		case <-r.stop:
+			return
+		default:
+		}
+		log.Warningf("replication from %v: %v, reconnect", r.primary, err)
+		select {
+		case <-r.stop:
+			return
+		case <-time.After(reconnectInterval):
+		}
+	}
+}
+
+func (r *Replica) follow() error {
+	conn, err := net.DialTimeout("tcp", r.primary, dialTimeout)
+	if err != nil {
+		return err
+	}
+	r.guard.Lock()
+	if r.stopped {
+		r.guard.Unlock()
+		return conn.Close()
+	}
+	r.conn = conn
+	r.guard.Unlock()
+	defer func() {
+		r.guard.Lock()
+		r.conn = nil
+		r.guard.Unlock()
+		conn.Close()
+	}()
+
+	tm := txn.GetManagerInstance()
+	dec := json.NewDecoder(bufio.NewReader(conn))
+	// commits before the snapshot are in it, but for those it rolled back
+	var from base.Tid
+	redo := make(map[base.Tid]bool)
+	dirty := false
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(readTimeout))
+		var msg message
+		if err := dec.Decode(&msg); err != nil {
+			return err
+		}
+		switch msg.Type {
+		case msgSnapshot:
+			if err := restore(msg); err != nil {
+				return err
+			}
+			log.Infof("replica restored the snapshot of %v, next tid %v", r.primary, msg.Tid)
+			from, redo = msg.Tid, make(map[base.Tid]bool)
+			for _, tid := range msg.Rollback {
+				redo[tid] = true
+			}
+		case msgCommit:
+			if msg.Tid >= from || redo[msg.Tid] {
+				tm.ApplyReplicated(msg.Tid, msg.Writes)
+				dirty = true
+			}
+		case msgHeartbeat:
+			if dirty {
+				kv.GetManagerInstance().Flush()
+				dirty = false
+			}
+		}
+
+		r.guard.Lock()
+		r.primaryTime = msg.Time
+		if msg.Type == msgCommit {
+			r.appliedTid = msg.Tid
+			if r.primaryTid <= msg.Tid {
+				r.primaryTid = msg.Tid + 1
+			}
+		} else {
+			r.primaryTid = msg.Tid
+		}
+		r.guard.Unlock()
+	}
+}
+
+func restore(msg message) error {
+	kvStore := kv.GetManagerInstance()
+	if err := kvStore.Restore(bytes.NewReader(msg.Data)); err != nil {
+		return err
+	}
+	for _, tid := range msg.Rollback {
+		kvStore.RollbackTid(tid)
+	}
+	kvStore.Flush()
+	txn.GetManagerInstance().AdvanceTid(msg.Tid - 1)
+	return nil
+}
+
+// Lag is how far behind the primary the applied state may be, measured from
+// the newest applied message, so it grows up to heartbeatInterval when idle
+func (r *Replica) Lag() time.Duration {
+	r.guard.Lock()
+	defer r.guard.Unlock()
+	if r.primaryTime == 0 {
+		return -1
+	}
+	return time.Since(time.Unix(0, r.primaryTime))
+}
+
+// Stop ends the replication, the caller decides what replicates txn.Manager next
+func (r *Replica) Stop() {
+	r.guard.Lock()
+	defer r.guard.Unlock()
+	if r.stopped {
+		return
+	}
+	r.stopped = true
+	close(r.stop)
+	if r.conn != nil {
+		r.conn.Close()
+	}
+}
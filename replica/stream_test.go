@@ -0,0 +1,62 @@
+package replica
+
+import (
+	"encoding/json"
+	"net"
+	"stupid-kv/base"
+	"stupid-kv/testutil"
+	"stupid-kv/txn"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	testutil.Main(m)
+}
+
+// TestStreamRoundTrip reads the stream of a primary like a replica and
+// applies it over the store the primary changed meanwhile
+func TestStreamRoundTrip(t *testing.T) {
+	tm := txn.GetManagerInstance()
+	tid := tm.BeginTxn()
+	testutil.MustDo(t, tm.Put("a", 1, tid))
+	testutil.MustDo(t, tm.Put("b", 2, tid))
+	testutil.MustDo(t, tm.CommitTxn(tid))
+
+	primaryConn, replicaConn := net.Pipe()
+	defer replicaConn.Close()
+	go NewPrimary().serve(primaryConn)
+	dec := json.NewDecoder(replicaConn)
+	next := func(typ string) message {
+		t.Helper()
+		for {
+			_ = replicaConn.SetReadDeadline(time.Now().Add(readTimeout))
+			var msg message
+			if err := dec.Decode(&msg); err != nil {
+				t.Fatal(err)
+			}
+			if msg.Type == typ {
+				return msg
+			}
+		}
+	}
+
+	snap := next(msgSnapshot)
+	tid = tm.BeginTxn()
+	testutil.MustDo(t, tm.Put("a", 10, tid))
+	testutil.MustDo(t, tm.Del("b", tid))
+	testutil.MustDo(t, tm.CommitTxn(tid))
+	commit := next(msgCommit)
+	if commit.Tid != tid {
+		t.Fatalf("commit of tid %v, want %v", commit.Tid, tid)
+	}
+
+	if err := restore(snap); err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectCommitted(t, "a", 1)
+	testutil.ExpectCommitted(t, "b", 2)
+	tm.ApplyReplicated(commit.Tid, commit.Writes)
+	testutil.ExpectCommitted(t, "a", 10)
+	testutil.ExpectCommitted(t, "b", base.VALUE_NOT_FOUND)
+}
@@ -0,0 +1,50 @@
+package server
+
+import (
+	"context"
+	"stupid-kv/base"
+	"stupid-kv/kv"
+	"stupid-kv/pb"
+	"stupid-kv/txn"
+)
+
+// AdminServer serves the internal pb.Admin service next to pb.KV
+type AdminServer struct {
+	pb.UnimplementedAdminServer
+}
+
+func (a *AdminServer) Keys(ctx context.Context, req *pb.KeysRequest) (*pb.KeysResponse, error) {
+	if err := pb.AuthorizeAdmin(ctx, base.GetConfig().AdminToken); err != nil {
+		return nil, err
+	}
+	resp := &pb.KeysResponse{}
+	for _, key := range kv.GetManagerInstance().Keys(base.KeyT(req.Start), base.KeyT(req.End)) {
+		resp.Keys = append(resp.Keys, string(key))
+	}
+	return resp, nil
+}
+
+func (a *AdminServer) Import(ctx context.Context, req *pb.ImportRequest) (*pb.ImportResponse, error) {
+	if err := pb.AuthorizeAdmin(ctx, base.GetConfig().AdminToken); err != nil {
+		return nil, err
+	}
+	versions := make([]kv.Version, 0, len(req.Versions))
+	for _, v := range req.Versions {
+		versions = append(versions, kv.Version{Value: base.ValueT(v.Value), Begin: base.Tid(v.Begin), End: base.Tid(v.End)})
+	}
+	if err := txn.GetManagerInstance().ImportVersions(base.KeyT(req.Key), versions); err != nil {
+		return nil, grpcError(err)
+	}
+	return &pb.ImportResponse{}, nil
+}
+
+func (a *AdminServer) Drop(ctx context.Context, req *pb.KeyRequest) (*pb.DelResponse, error) {
+	if err := pb.AuthorizeAdmin(ctx, base.GetConfig().AdminToken); err != nil {
+		return nil, err
+	}
+	dropped, err := txn.GetManagerInstance().DropKey(base.KeyT(req.Key))
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &pb.DelResponse{Deleted: dropped}, nil
+}
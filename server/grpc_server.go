@@ -0,0 +1,249 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"stupid-kv/base"
+	"stupid-kv/cluster"
+	"stupid-kv/kv"
+	log "stupid-kv/logutil"
+	"stupid-kv/pb"
+	"stupid-kv/replica"
+	"stupid-kv/txn"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// GrpcServer serves txn.Manager as the pb.KV grpc service
+type GrpcServer struct {
+	pb.UnimplementedKVServer
+
+	addr     string
+	server   *grpc.Server
+	sessions *txnSessions
+}
+
+func NewGrpcServer(addr string, idleTimeout time.Duration) *GrpcServer {
+	s := &GrpcServer{
+		addr:     addr,
+		server:   grpc.NewServer(),
+		sessions: newTxnSessions(idleTimeout),
+	}
+	pb.RegisterKVServer(s.server, s)
+	pb.RegisterAdminServer(s.server, &AdminServer{})
+	return s
+}
+
+func (s *GrpcServer) ListenAndServe() error {
+	l, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+func (s *GrpcServer) Serve(l net.Listener) error {
+	log.Infof("grpc server listens on %v", l.Addr())
+	return s.server.Serve(l)
+}
+
+// Close stops the server and aborts every open txn session.
+func (s *GrpcServer) Close() error {
+	s.server.Stop()
+	s.sessions.close()
+	return nil
+}
+
+// grpcError maps txn errors to status codes, ABORTED means the txn may be retried
+func grpcError(err error) error {
+	if errors.Is(err, cluster.ErrNotLeader) || errors.Is(err, replica.ErrReadOnly) {
+		return status.Error(codes.FailedPrecondition, err.Error())
+	}
+	if errors.Is(err, txn.ErrorOutcomeUnknown) {
+		return status.Error(codes.Unknown, err.Error())
+	}
+	switch err {
+	case nil:
+		return nil
+	case txn.ErrorLockTimeout:
+		return status.Error(codes.Aborted, err.Error())
+	case txn.ErrorTxnNotExist, errTxnNotFound:
+		return status.Error(codes.NotFound, err.Error())
+	case txn.ErrorTxnPrepared:
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errReservedValue:
+		return status.Error(codes.InvalidArgument, err.Error())
+	default:
+		return status.Error(codes.Internal, err.Error())
+	}
+}
+
+func (s *GrpcServer) Get(ctx context.Context, req *pb.GetRequest) (*pb.GetResponse, error) {
+	resp := &pb.GetResponse{}
+	err := s.sessions.run(req.Txn, func(tm *txn.Manager, tid base.Tid) error {
+		value := tm.Get(base.KeyT(req.Key), tid)
+		resp.Found, resp.Value = exists(value), int64(value)
+		if !resp.Found {
+			resp.Value = 0
+		}
+		return nil
+	})
+	return resp, grpcError(err)
+}
+
+func (s *GrpcServer) Put(ctx context.Context, req *pb.PutRequest) (*pb.PutResponse, error) {
+	value := base.ValueT(req.Value)
+	if reserved(value) {
+		return nil, grpcError(errReservedValue)
+	}
+	err := s.sessions.run(req.Txn, func(tm *txn.Manager, tid base.Tid) error {
+		return tm.Put(base.KeyT(req.Key), value, tid)
+	})
+	return &pb.PutResponse{}, grpcError(err)
+}
+
+func (s *GrpcServer) incrBy(req *pb.KeyRequest, delta base.ValueT) (*pb.ValueResponse, error) {
+	resp := &pb.ValueResponse{}
+	err := s.sessions.run(req.Txn, func(tm *txn.Manager, tid base.Tid) error {
+		value, err := incrBy(tm, tid, base.KeyT(req.Key), delta)
+		resp.Value = int64(value)
+		return err
+	})
+	return resp, grpcError(err)
+}
+
+func (s *GrpcServer) Inc(ctx context.Context, req *pb.KeyRequest) (*pb.ValueResponse, error) {
+	return s.incrBy(req, 1)
+}
+
+func (s *GrpcServer) Dec(ctx context.Context, req *pb.KeyRequest) (*pb.ValueResponse, error) {
+	return s.incrBy(req, -1)
+}
+
+func (s *GrpcServer) Del(ctx context.Context, req *pb.KeyRequest) (*pb.DelResponse, error) {
+	resp := &pb.DelResponse{}
+	err := s.sessions.run(req.Txn, func(tm *txn.Manager, tid base.Tid) error {
+		if !exists(tm.Get(base.KeyT(req.Key), tid)) {
+			return nil
+		}
+		resp.Deleted = true
+		return tm.Del(base.KeyT(req.Key), tid)
+	})
+	return resp, grpcError(err)
+}
+
+func (s *GrpcServer) Begin(ctx context.Context, req *pb.BeginRequest) (*pb.BeginResponse, error) {
+	return &pb.BeginResponse{Txn: s.sessions.begin()}, nil
+}
+
+func (s *GrpcServer) Commit(ctx context.Context, req *pb.TxnRequest) (*pb.TxnResponse, error) {
+	return &pb.TxnResponse{}, grpcError(s.sessions.end(req.Txn, true))
+}
+
+func (s *GrpcServer) Abort(ctx context.Context, req *pb.TxnRequest) (*pb.TxnResponse, error) {
+	return &pb.TxnResponse{}, grpcError(s.sessions.end(req.Txn, false))
+}
+
+func (s *GrpcServer) Prepare(ctx context.Context, req *pb.TxnRequest) (*pb.TxnResponse, error) {
+	if req.Txn == "" {
+		return nil, status.Error(codes.InvalidArgument, "prepare needs the txn returned by Begin")
+	}
+	err := s.sessions.run(req.Txn, func(tm *txn.Manager, tid base.Tid) error {
+		return tm.PrepareTxn(tid)
+	})
+	return &pb.TxnResponse{}, grpcError(err)
+}
+
+func (s *GrpcServer) Scan(req *pb.ScanRequest, stream pb.KV_ScanServer) error {
+	err := s.sessions.run(req.Txn, func(tm *txn.Manager, tid base.Tid) error {
+		for _, pair := range tm.Scan(base.KeyT(req.Start), base.KeyT(req.End), tid) {
+			if err := stream.Send(&pb.KeyValue{Key: string(pair.Key), Value: int64(pair.Value)}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if _, ok := status.FromError(err); ok {
+		return err // stream errors already carry a status
+	}
+	return grpcError(err)
+}
+
+func (s *GrpcServer) Watch(req *pb.WatchRequest, stream pb.KV_WatchServer) error {
+	from := txn.WatchNow
+	if req.Replay {
+		from = base.Tid(req.StartTid)
+	}
+	ctx := stream.Context()
+	for change := range txn.GetManagerInstance().WatchFrom(ctx, base.KeyT(req.Key), req.Prefix, from) {
+		event := &pb.WatchEvent{Tid: int64(change.Tid), Key: string(change.Key), Op: pb.WatchEvent_PUT, Value: int64(change.Value)}
+		if change.Value == base.VALUE_NOT_FOUND {
+			event.Op, event.Value = pb.WatchEvent_DELETE, 0
+		}
+		if err := stream.Send(event); err != nil {
+			return err
+		}
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	return status.Error(codes.ResourceExhausted, "watcher fell too far behind")
+}
+
+func (s *GrpcServer) History(ctx context.Context, req *pb.HistoryRequest) (*pb.HistoryResponse, error) {
+	resp := &pb.HistoryResponse{}
+	for _, v := range kv.GetManagerInstance().History(base.KeyT(req.Key)) {
+		resp.Versions = append(resp.Versions, &pb.Version{Value: int64(v.Value), Begin: int64(v.Begin), End: int64(v.End)})
+	}
+	return resp, nil
+}
+
+func (s *GrpcServer) Stats(ctx context.Context, req *pb.StatsRequest) (*pb.StatsResponse, error) {
+	kvStats := kv.GetManagerInstance().Stats()
+	txnStats := txn.GetManagerInstance().Stats()
+	resp := &pb.StatsResponse{
+		Keys:     int64(kvStats.Keys),
+		Versions: int64(kvStats.Versions),
+		CurTid:   int64(txnStats.CurTid),
+		Engine:   kvStats.Engine,
+	}
+	for _, tid := range txnStats.ActiveTids {
+		resp.ActiveTids = append(resp.ActiveTids, int64(tid))
+	}
+	return resp, nil
+}
+
+// backupChunkSize is how many bytes of a backup go in one BackupChunk
+const backupChunkSize = 256 << 10
+
+// chunkWriter sends what is written to it in BackupChunks
+type chunkWriter struct {
+	stream pb.KV_BackupServer
+	buf    []byte
+}
+
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for len(w.buf) >= backupChunkSize {
+		if err := w.stream.Send(&pb.BackupChunk{Data: w.buf[:backupChunkSize]}); err != nil {
+			return 0, err
+		}
+		w.buf = append(w.buf[:0], w.buf[backupChunkSize:]...)
+	}
+	return len(p), nil
+}
+
+func (s *GrpcServer) Backup(req *pb.BackupRequest, stream pb.KV_BackupServer) error {
+	w := &chunkWriter{stream: stream, buf: make([]byte, 0, 2*backupChunkSize)}
+	tid, err := txn.GetManagerInstance().Backup(w)
+	if _, ok := status.FromError(err); ok && err != nil {
+		return err // stream errors already carry a status
+	} else if err != nil {
+		return grpcError(err)
+	}
+	return stream.Send(&pb.BackupChunk{Data: w.buf, Tid: int64(tid)})
+}
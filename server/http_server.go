@@ -0,0 +1,191 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"stupid-kv/base"
+	"stupid-kv/cluster"
+	log "stupid-kv/logutil"
+	"stupid-kv/metrics"
+	"stupid-kv/replica"
+	"stupid-kv/txn"
+	"time"
+)
+
+// TxnHeader carries the id returned by POST /txn, the `txn` query parameter works too
+const TxnHeader = "X-Txn-Id"
+
+var errBadValue = errors.New(`body must be {"value": <int>}`)
+
+// HttpServer serves txn.Manager as a json REST api:
+//
+//	GET/PUT/DELETE /kv/{key}, POST /kv/{key}/inc, POST /kv/{key}/dec,
+//	POST /txn, POST /txn/{id}/commit, POST /txn/{id}/abort
+type HttpServer struct {
+	server   *http.Server
+	mux      *http.ServeMux
+	sessions *txnSessions
+}
+
+func NewHttpServer(addr string, idleTimeout time.Duration) *HttpServer {
+	s := &HttpServer{
+		sessions: newTxnSessions(idleTimeout),
+	}
+	s.mux = http.NewServeMux()
+	s.mux.HandleFunc("/kv/", s.handleKV)
+	s.mux.HandleFunc("/txn", s.handleTxn)
+	s.mux.HandleFunc("/txn/", s.handleTxn)
+	s.mux.Handle("/metrics", metrics.Handler())
+	s.server = &http.Server{Addr: addr, Handler: s.mux}
+	return s
+}
+
+// Handle mounts another api, e.g. the cluster membership, before serving
+func (s *HttpServer) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
+}
+
+func (s *HttpServer) ListenAndServe() error {
+	log.Infof("http server listens on %v", s.server.Addr)
+	if err := s.server.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// Close stops the server and aborts every open txn session.
+func (s *HttpServer) Close() error {
+	err := s.server.Close()
+	s.sessions.close()
+	return err
+}
+
+func (s *HttpServer) handleTxn(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, errors.New("use POST"))
+		return
+	}
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/txn"), "/")
+	if path == "" {
+		writeJSON(w, http.StatusCreated, map[string]interface{}{"txn": s.sessions.begin()})
+		return
+	}
+
+	parts := strings.Split(path, "/")
+	if len(parts) != 2 || (parts[1] != "commit" && parts[1] != "abort") {
+		writeJSONError(w, http.StatusNotFound, errors.New("unknown txn endpoint"))
+		return
+	}
+	if err := s.sessions.end(parts[0], parts[1] == "commit"); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"txn": parts[0], "status": parts[1]})
+}
+
+func (s *HttpServer) handleKV(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/kv/")
+	op := ""
+	if strings.HasSuffix(path, "/inc") || strings.HasSuffix(path, "/dec") {
+		op = path[len(path)-3:]
+		path = path[:len(path)-4]
+	}
+	if path == "" || strings.Contains(path, "/") {
+		writeJSONError(w, http.StatusNotFound, errors.New("expect /kv/{key}"))
+		return
+	}
+	key := base.KeyT(path)
+
+	var exec func(tm *txn.Manager, tid base.Tid) (int, interface{}, error)
+	switch {
+	case op != "" && r.Method == http.MethodPost:
+		delta := base.ValueT(1)
+		if op == "dec" {
+			delta = -1
+		}
+		exec = func(tm *txn.Manager, tid base.Tid) (int, interface{}, error) {
+			value, err := incrBy(tm, tid, key, delta)
+			return http.StatusOK, map[string]interface{}{"key": key, "value": value}, err
+		}
+	case op == "" && r.Method == http.MethodGet:
+		exec = func(tm *txn.Manager, tid base.Tid) (int, interface{}, error) {
+			value := tm.Get(key, tid)
+			if !exists(value) {
+				return http.StatusNotFound, map[string]interface{}{"key": key, "error": "key not found"}, nil
+			}
+			return http.StatusOK, map[string]interface{}{"key": key, "value": value}, nil
+		}
+	case op == "" && r.Method == http.MethodPut:
+		var body struct {
+			Value *base.ValueT `json:"value"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Value == nil || reserved(*body.Value) {
+			writeJSONError(w, http.StatusBadRequest, errBadValue)
+			return
+		}
+		exec = func(tm *txn.Manager, tid base.Tid) (int, interface{}, error) {
+			err := tm.Put(key, *body.Value, tid)
+			return http.StatusOK, map[string]interface{}{"key": key, "value": *body.Value}, err
+		}
+	case op == "" && r.Method == http.MethodDelete:
+		exec = func(tm *txn.Manager, tid base.Tid) (int, interface{}, error) {
+			if !exists(tm.Get(key, tid)) {
+				return http.StatusOK, map[string]interface{}{"key": key, "deleted": false}, nil
+			}
+			err := tm.Del(key, tid)
+			return http.StatusOK, map[string]interface{}{"key": key, "deleted": true}, err
+		}
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+
+	id := r.Header.Get(TxnHeader)
+	if id == "" {
+		id = r.URL.Query().Get("txn")
+	}
+	var status int
+	var ret interface{}
+	if err := s.sessions.run(id, func(tm *txn.Manager, tid base.Tid) error {
+		var err error
+		status, ret, err = exec(tm, tid)
+		return err
+	}); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, status, ret)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	if errors.Is(err, cluster.ErrNotLeader) || errors.Is(err, replica.ErrReadOnly) {
+		writeJSONError(w, http.StatusMisdirectedRequest, err)
+		return
+	}
+	if errors.Is(err, txn.ErrorOutcomeUnknown) {
+		writeJSONError(w, http.StatusGatewayTimeout, err)
+		return
+	}
+	switch err {
+	case txn.ErrorLockTimeout, txn.ErrorTxnPrepared:
+		writeJSONError(w, http.StatusConflict, err)
+	case txn.ErrorTxnNotExist, errTxnNotFound:
+		writeJSONError(w, http.StatusNotFound, err)
+	default:
+		writeJSONError(w, http.StatusInternalServerError, err)
+	}
+}
+
+func writeJSONError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]interface{}{"error": err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Warning("http write error: ", err)
+	}
+}
@@ -0,0 +1,32 @@
+package server
+
+import (
+	"stupid-kv/base"
+	"stupid-kv/txn"
+)
+
+func exists(value base.ValueT) bool {
+	return value != base.VALUE_NOT_FOUND && value != base.VALUE_NOT_VALID
+}
+
+func reserved(value base.ValueT) bool {
+	return value == base.VALUE_NOT_FOUND || value == base.VALUE_NOT_VALID || value == base.VALUE_NOT_COMMIT
+}
+
+// incrBy adds delta (1 or -1) to key and returns the new value,
+// a missing key counts as 0 like redis does.
+func incrBy(tm *txn.Manager, tid base.Tid, key base.KeyT, delta base.ValueT) (base.ValueT, error) {
+	var err error
+	if delta > 0 {
+		err = tm.Inc(key, tid)
+	} else {
+		err = tm.Dec(key, tid)
+	}
+	if err == txn.ErrorKeyNotFound {
+		err = tm.Put(key, delta, tid) // the write lock is held by now
+	}
+	if err != nil {
+		return 0, err
+	}
+	return tm.Get(key, tid), nil
+}
@@ -0,0 +1,275 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"stupid-kv/base"
+	log "stupid-kv/logutil"
+	"stupid-kv/txn"
+	"sync"
+)
+
+var (
+	errNotInteger    = errors.New("value is not an integer or out of range")
+	errReservedValue = errors.New("value is reserved by stupid-kv")
+)
+
+type respCommand struct {
+	arity int // negative means at least -arity args, command name included
+	exec  func(tm *txn.Manager, tid base.Tid, args []string) (interface{}, error)
+}
+
+var respCommands = map[string]respCommand{
+	"GET":  {2, respGet},
+	"SET":  {3, respSet},
+	"INCR": {2, respIncr},
+	"DECR": {2, respDecr},
+	"DEL":  {-2, respDel},
+}
+
+// respSession is the per-connection transaction state between MULTI and EXEC/DISCARD
+type respSession struct {
+	inMulti bool
+	dirty   bool // a queued command was rejected, EXEC must abort
+	tid     base.Tid
+	queued  [][]string
+}
+
+// RespServer serves txn.Manager over the redis RESP protocol
+type RespServer struct {
+	addr     string
+	listener net.Listener
+
+	connsGuard sync.Mutex
+	conns      map[net.Conn]struct{}
+	closed     bool
+}
+
+func NewRespServer(addr string) *RespServer {
+	return &RespServer{
+		addr:  addr,
+		conns: make(map[net.Conn]struct{}),
+	}
+}
+
+func (s *RespServer) ListenAndServe() error {
+	l, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+func (s *RespServer) Serve(l net.Listener) error {
+	s.connsGuard.Lock()
+	s.listener = l
+	s.connsGuard.Unlock()
+	log.Infof("resp server listens on %v", l.Addr())
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.connsGuard.Lock()
+			closed := s.closed
+			s.connsGuard.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+		s.connsGuard.Lock()
+		s.conns[conn] = struct{}{}
+		s.connsGuard.Unlock()
+		go s.serveConn(conn)
+	}
+}
+
+// Close stops accepting and closes every connection, open MULTIs are aborted.
+func (s *RespServer) Close() error {
+	s.connsGuard.Lock()
+	defer s.connsGuard.Unlock()
+	s.closed = true
+	for conn := range s.conns {
+		conn.Close()
+	}
+	if s.listener != nil {
+		return s.listener.Close()
+	}
+	return nil
+}
+
+func (s *RespServer) serveConn(conn net.Conn) {
+	session := &respSession{}
+	defer func() {
+		if session.inMulti {
+			_ = txn.GetManagerInstance().AbortTxn(session.tid)
+		}
+		conn.Close()
+		s.connsGuard.Lock()
+		delete(s.conns, conn)
+		s.connsGuard.Unlock()
+	}()
+
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			if err != io.EOF && !s.isClosed() {
+				log.Warning("resp read error: ", err)
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		name := strings.ToUpper(args[0])
+		if name == "QUIT" {
+			writeReply(w, respStatus("OK"))
+			w.Flush()
+			return
+		}
+		writeReply(w, session.handle(name, args))
+		if r.Buffered() == 0 { // flush once a pipeline is drained
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *RespServer) isClosed() bool {
+	s.connsGuard.Lock()
+	defer s.connsGuard.Unlock()
+	return s.closed
+}
+
+func (session *respSession) handle(name string, args []string) interface{} {
+	tm := txn.GetManagerInstance()
+	switch name {
+	case "PING":
+		if len(args) > 1 {
+			return args[1]
+		}
+		return respStatus("PONG")
+	case "COMMAND": // redis-cli asks for command docs on connect
+		return []interface{}{}
+	case "MULTI":
+		if session.inMulti {
+			return respError("ERR MULTI calls can not be nested")
+		}
+		session.inMulti, session.dirty, session.queued = true, false, nil
+		session.tid = tm.BeginTxn()
+		return respStatus("OK")
+	case "DISCARD":
+		if !session.inMulti {
+			return respError("ERR DISCARD without MULTI")
+		}
+		session.inMulti = false
+		if err := tm.AbortTxn(session.tid); err != nil {
+			return err
+		}
+		return respStatus("OK")
+	case "EXEC":
+		if !session.inMulti {
+			return respError("ERR EXEC without MULTI")
+		}
+		session.inMulti = false
+		return session.exec(tm)
+	}
+
+	cmd, ok := respCommands[name]
+	if !ok {
+		session.dirty = session.inMulti
+		return respError("ERR unknown command '" + args[0] + "'")
+	}
+	if (cmd.arity > 0 && len(args) != cmd.arity) || (cmd.arity < 0 && len(args) < -cmd.arity) {
+		session.dirty = session.inMulti
+		return respError("ERR wrong number of arguments for '" + strings.ToLower(name) + "' command")
+	}
+	if session.inMulti {
+		session.queued = append(session.queued, args)
+		return respStatus("QUEUED")
+	}
+
+	// outside MULTI every command runs in its own txn
+	tid := tm.BeginTxn()
+	ret, err := cmd.exec(tm, tid, args)
+	if err != nil {
+		_ = tm.AbortTxn(tid)
+		return err
+	}
+	if err := tm.CommitTxn(tid); err != nil {
+		return err
+	}
+	return ret
+}
+
+func (session *respSession) exec(tm *txn.Manager) interface{} {
+	if session.dirty {
+		_ = tm.AbortTxn(session.tid)
+		return respError("EXECABORT Transaction discarded because of previous errors.")
+	}
+	results := make([]interface{}, 0, len(session.queued))
+	for _, args := range session.queued {
+		ret, err := respCommands[strings.ToUpper(args[0])].exec(tm, session.tid, args)
+		if err != nil {
+			_ = tm.AbortTxn(session.tid)
+			return respError("EXECABORT Transaction discarded because of: " + err.Error())
+		}
+		results = append(results, ret)
+	}
+	if err := tm.CommitTxn(session.tid); err != nil {
+		return err
+	}
+	return results
+}
+
+func respGet(tm *txn.Manager, tid base.Tid, args []string) (interface{}, error) {
+	value := tm.Get(base.KeyT(args[1]), tid)
+	if !exists(value) {
+		return nil, nil
+	}
+	return strconv.Itoa(int(value)), nil
+}
+
+func respSet(tm *txn.Manager, tid base.Tid, args []string) (interface{}, error) {
+	n, err := strconv.Atoi(args[2])
+	if err != nil {
+		return nil, errNotInteger
+	}
+	value := base.ValueT(n)
+	if reserved(value) {
+		return nil, errReservedValue
+	}
+	if err := tm.Put(base.KeyT(args[1]), value, tid); err != nil {
+		return nil, err
+	}
+	return respStatus("OK"), nil
+}
+
+func respIncr(tm *txn.Manager, tid base.Tid, args []string) (interface{}, error) {
+	return incrBy(tm, tid, base.KeyT(args[1]), 1)
+}
+
+func respDecr(tm *txn.Manager, tid base.Tid, args []string) (interface{}, error) {
+	return incrBy(tm, tid, base.KeyT(args[1]), -1)
+}
+
+func respDel(tm *txn.Manager, tid base.Tid, args []string) (interface{}, error) {
+	deleted := int64(0)
+	for _, key := range args[1:] {
+		if !exists(tm.Get(base.KeyT(key), tid)) {
+			continue
+		}
+		if err := tm.Del(base.KeyT(key), tid); err != nil {
+			return nil, err
+		}
+		deleted++
+	}
+	return deleted, nil
+}
@@ -0,0 +1,47 @@
+package server
+
+import (
+	"bufio"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadCommand(t *testing.T) {
+	cases := []struct {
+		name  string
+		input string
+		want  []string
+		err   bool
+	}{
+		{"array", "*2\r\n$3\r\nGET\r\n$1\r\na\r\n", []string{"GET", "a"}, false},
+		{"inline", "PUT a 1\r\n", []string{"PUT", "a", "1"}, false},
+		{"empty array", "*0\r\n", []string{}, false},
+		{"huge count", "*9223372036854775807\r\n", nil, true},
+		{"count over the cap", "*1048577\r\n", nil, true},
+		{"negative count", "*-1\r\n", nil, true},
+		{"huge size", "*1\r\n$9223372036854775807\r\n", nil, true},
+		{"size over the cap", "*1\r\n$536870913\r\n", nil, true},
+		{"negative size", "*1\r\n$-1\r\n", nil, true},
+		{"not a bulk", "*1\r\n:1\r\n", nil, true},
+		// a count within the cap allocates nothing before the args arrive
+		{"count larger than the args", "*1048576\r\n$1\r\na\r\n", nil, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			args, err := readCommand(bufio.NewReader(strings.NewReader(c.input)))
+			if c.err {
+				if err == nil {
+					t.Fatalf("got %q, want an error", args)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(args, c.want) {
+				t.Fatalf("got %q, want %q", args, c.want)
+			}
+		})
+	}
+}
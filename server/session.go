@@ -0,0 +1,141 @@
+package server
+
+import (
+	"errors"
+	"strconv"
+	"stupid-kv/base"
+	log "stupid-kv/logutil"
+	"stupid-kv/txn"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var errTxnNotFound = errors.New("txn session not found or expired")
+
+// txnSession is a txn begun by a client, aborted after idleTimeout without requests
+type txnSession struct {
+	guard    sync.Mutex // serializes requests of the same txn
+	tid      base.Tid
+	lastUsed int64 // unix nano, accessed atomically so the reaper never waits on guard
+	reaping  int32 // set once by the reaper, so it starts a single end per session
+	done     bool
+}
+
+func (session *txnSession) touch() {
+	atomic.StoreInt64(&session.lastUsed, time.Now().UnixNano())
+}
+
+// txnSessions holds the open txns of the servers without a connection per txn
+type txnSessions struct {
+	idleTimeout time.Duration
+	sessions    *sync.Map // id string -> *txnSession
+	stop        chan struct{}
+}
+
+func newTxnSessions(idleTimeout time.Duration) *txnSessions {
+	s := &txnSessions{
+		idleTimeout: idleTimeout,
+		sessions:    &sync.Map{},
+		stop:        make(chan struct{}),
+	}
+	go s.reapLoop()
+	return s
+}
+
+func (s *txnSessions) begin() string {
+	tid := txn.GetManagerInstance().BeginTxn()
+	id := strconv.FormatInt(int64(tid), 10)
+	session := &txnSession{tid: tid}
+	session.touch()
+	s.sessions.Store(id, session)
+	return id
+}
+
+// run calls fn with the tid of session id, an empty id runs fn in its own txn.
+func (s *txnSessions) run(id string, fn func(tm *txn.Manager, tid base.Tid) error) error {
+	tm := txn.GetManagerInstance()
+	if id == "" {
+		tid := tm.BeginTxn()
+		if err := fn(tm, tid); err != nil {
+			_ = tm.AbortTxn(tid)
+			return err
+		}
+		return tm.CommitTxn(tid)
+	}
+
+	v, ok := s.sessions.Load(id)
+	if !ok {
+		return errTxnNotFound
+	}
+	session := v.(*txnSession)
+	session.guard.Lock()
+	defer session.guard.Unlock()
+	if session.done {
+		return errTxnNotFound
+	}
+	session.touch()
+	defer session.touch()
+	return fn(tm, session.tid)
+}
+
+func (s *txnSessions) end(id string, commit bool) error {
+	v, ok := s.sessions.Load(id)
+	if !ok {
+		// a prepared txn outlives its session across a restart
+		tm := txn.GetManagerInstance()
+		if tid, err := strconv.ParseInt(id, 10, 64); err == nil && tm.IsPrepared(base.Tid(tid)) {
+			if commit {
+				return tm.CommitTxn(base.Tid(tid))
+			}
+			return tm.AbortTxn(base.Tid(tid))
+		}
+		return errTxnNotFound
+	}
+	session := v.(*txnSession)
+	session.guard.Lock()
+	defer session.guard.Unlock()
+	if session.done {
+		return errTxnNotFound
+	}
+	session.done = true
+	s.sessions.Delete(id)
+	if commit {
+		return txn.GetManagerInstance().CommitTxn(session.tid)
+	}
+	return txn.GetManagerInstance().AbortTxn(session.tid)
+}
+
+// close stops the reaper and aborts every open session.
+func (s *txnSessions) close() {
+	close(s.stop)
+	s.sessions.Range(func(id, v interface{}) bool {
+		_ = s.end(id.(string), false)
+		return true
+	})
+}
+
+func (s *txnSessions) reapLoop() {
+	ticker := time.NewTicker(s.idleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case now := <-ticker.C:
+			s.sessions.Range(func(id, v interface{}) bool {
+				session := v.(*txnSession)
+				if txn.GetManagerInstance().IsPrepared(session.tid) {
+					return true // only its coordinator may end it
+				}
+				if now.Sub(time.Unix(0, atomic.LoadInt64(&session.lastUsed))) > s.idleTimeout &&
+					atomic.CompareAndSwapInt32(&session.reaping, 0, 1) {
+					log.Warningf("txn %v idle for %v, abort", session.tid, s.idleTimeout)
+					// a request may still hold guard while waiting for a write lock
+					go s.end(id.(string), false)
+				}
+				return true
+			})
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package shard
+
+import (
+	"encoding/json"
+	"net/http"
+	log "stupid-kv/logutil"
+)
+
+// Handler serves the admin api of the router:
+//
+//	GET /shards, PUT /shards {"shards": [<grpc addr>, ...]} rebalances
+func (r *Router) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/shards", r.handleShards)
+	return mux
+}
+
+func (r *Router) handleShards(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		r.routeGuard.RLock()
+		shards, moved := r.ring.Shards(), len(r.moved)
+		r.routeGuard.RUnlock()
+		writeJSON(w, http.StatusOK, map[string]interface{}{"shards": shards, "moved": moved})
+	case http.MethodPut:
+		var body struct {
+			Shards []string `json:"shards"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil || len(body.Shards) == 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": `body must be {"shards": [<grpc addr>, ...]}`})
+			return
+		}
+		moved, err := r.Rebalance(body.Shards)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]interface{}{"error": err.Error(), "moved": moved})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"shards": body.Shards, "moved": moved})
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]interface{}{"error": "use GET or PUT"})
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Warning("http write error: ", err)
+	}
+}
@@ -0,0 +1,126 @@
+package shard
+
+import (
+	"context"
+	"fmt"
+	"stupid-kv/base"
+	log "stupid-kv/logutil"
+	"stupid-kv/pb"
+)
+
+// Rebalance moves the keys to the shards of a new ring while serving. Keys
+// move one at a time along with their mvcc history, ops on a key wait for its
+// move. A second pass under the write lock moves the keys created meanwhile
+// and switches the ring. Txns must not be open. Returns how many keys moved.
+func (r *Router) Rebalance(shards []string) (int, error) {
+	r.rebalanceGuard.Lock()
+	defer r.rebalanceGuard.Unlock()
+
+	target := NewRing(shards)
+	r.routeGuard.Lock()
+	open := 0
+	r.txns.Range(func(gid, v interface{}) bool {
+		open++
+		return true
+	})
+	if open > 0 {
+		r.routeGuard.Unlock()
+		return 0, fmt.Errorf("%v txns are open, their branches can not move", open)
+	}
+	r.rebalancing = true
+	err := r.dial(shards)
+	r.routeGuard.Unlock()
+	defer func() {
+		r.routeGuard.Lock()
+		r.rebalancing = false
+		r.routeGuard.Unlock()
+	}()
+	if err != nil {
+		return 0, err
+	}
+
+	moved, err := r.moveMisplaced(target, false)
+	if err != nil {
+		return moved, err
+	}
+
+	r.routeGuard.Lock()
+	defer r.routeGuard.Unlock()
+	n, err := r.moveMisplaced(target, true)
+	moved += n
+	if err != nil {
+		return moved, err
+	}
+	for shard, conn := range r.conns {
+		if !contains(shards, shard) {
+			conn.Close()
+			delete(r.conns, shard)
+			delete(r.clients, shard)
+			delete(r.admins, shard)
+		}
+	}
+	r.ring = target
+	r.moved = make(map[base.KeyT]string)
+	log.Infof("rebalanced to shards %v, %v keys moved", shards, moved)
+	return moved, nil
+}
+
+// moveMisplaced moves every key of the current shards that target assigns
+// elsewhere, locked tells if the caller holds the write lock already.
+func (r *Router) moveMisplaced(target *Ring, locked bool) (int, error) {
+	ctx := context.Background()
+	moved := 0
+	for _, shard := range r.ring.Shards() {
+		resp, err := r.admins[shard].Keys(ctx, &pb.KeysRequest{})
+		if err != nil {
+			return moved, err
+		}
+		for _, key := range resp.Keys {
+			to := target.Locate(base.KeyT(key))
+			if to == shard {
+				continue
+			}
+			if !locked {
+				r.routeGuard.Lock()
+			}
+			if r.owner(base.KeyT(key)) == shard {
+				err = r.move(ctx, base.KeyT(key), shard, to)
+				moved++
+			}
+			if !locked {
+				r.routeGuard.Unlock()
+			}
+			if err != nil {
+				return moved, err
+			}
+		}
+	}
+	return moved, nil
+}
+
+// move copies the versions of key and drops them from the source, the caller
+// holds the write lock
+func (r *Router) move(ctx context.Context, key base.KeyT, from string, to string) error {
+	history, err := r.clients[from].History(ctx, &pb.HistoryRequest{Key: string(key)})
+	if err != nil {
+		return err
+	}
+	if _, err := r.admins[to].Import(ctx, &pb.ImportRequest{Key: string(key), Versions: history.Versions}); err != nil {
+		return err
+	}
+	r.moved[key] = to
+	if _, err := r.admins[from].Drop(ctx, &pb.KeyRequest{Key: string(key)}); err != nil {
+		log.Warningf("key %v moved to %v but stays on %v: %v", key, to, from, err)
+		return err
+	}
+	return nil
+}
+
+func contains(shards []string, shard string) bool {
+	for _, s := range shards {
+		if s == shard {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,118 @@
+package shard
+
+import (
+	"context"
+	"fmt"
+	"stupid-kv/base"
+	"stupid-kv/pb"
+	"sync"
+	"testing"
+)
+
+// expectPlaced checks every key lives only on its owner on the ring of r
+func expectPlaced(t *testing.T, r *Router, values map[string]int64, shards ...*fakeShard) {
+	t.Helper()
+	for key, want := range values {
+		owner := r.ring.Locate(base.KeyT(key))
+		for _, s := range shards {
+			expectValue(t, s, key, want, s.name == owner)
+		}
+	}
+}
+
+func TestRebalance(t *testing.T) {
+	a, b, c := newFakeShard("a"), newFakeShard("b"), newFakeShard("c")
+	r := newTestRouter(t, []string{"a", "b"}, a, b, c)
+	values := make(map[string]int64)
+	for i := 0; i < 300; i++ {
+		key := fmt.Sprintf("key%v", i)
+		put(t, r, "", key, int64(i))
+		values[key] = int64(i)
+	}
+	target := NewRing([]string{"a", "b", "c"})
+	want := 0
+	for key := range values {
+		if target.Locate(base.KeyT(key)) != r.ring.Locate(base.KeyT(key)) {
+			want++
+		}
+	}
+
+	moved, err := r.Rebalance([]string{"a", "b", "c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved != want {
+		t.Fatalf("%v keys moved, want %v", moved, want)
+	}
+	expectPlaced(t, r, values, a, b, c)
+	if len(r.moved) != 0 {
+		t.Fatalf("%v keys left ahead of the ring", len(r.moved))
+	}
+}
+
+func TestRebalanceOpenTxn(t *testing.T) {
+	a, b := newFakeShard("a"), newFakeShard("b")
+	r := newTestRouter(t, []string{"a"}, a, b)
+	key := "key0"
+	put(t, r, "", key, 1)
+	gid := begin(t, r)
+	put(t, r, gid, key, 2)
+
+	// the branch of the open txn can not move with the key
+	if _, err := r.Rebalance([]string{"b"}); err == nil {
+		t.Fatal("rebalance with an open txn succeeded")
+	}
+	expectValue(t, a, key, 1, true)
+	expectValue(t, b, key, 0, false)
+
+	if _, err := r.Commit(context.Background(), &pb.TxnRequest{Txn: gid}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Rebalance([]string{"b"}); err != nil {
+		t.Fatal(err)
+	}
+	expectValue(t, a, key, 0, false)
+	expectValue(t, b, key, 2, true)
+}
+
+func TestRebalanceWriteDuringMove(t *testing.T) {
+	a, b := newFakeShard("a"), newFakeShard("b")
+	r := newTestRouter(t, []string{"a"}, a, b)
+	values := make(map[string]int64)
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("key%v", i)
+		put(t, r, "", key, int64(i))
+		values[key] = int64(i)
+	}
+	// hold the first move with the write lock taken
+	started, release := make(chan struct{}), make(chan struct{})
+	var once sync.Once
+	a.onHistory = func() {
+		once.Do(func() {
+			close(started)
+			<-release
+		})
+	}
+	done := make(chan error)
+	go func() {
+		_, err := r.Rebalance([]string{"a", "b"})
+		done <- err
+	}()
+	<-started
+
+	// a write waits for the move and lands on the shard owning the key then
+	written := make(chan error)
+	go func() {
+		_, err := r.Put(context.Background(), &pb.PutRequest{Key: "key0", Value: 100})
+		written <- err
+	}()
+	close(release)
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+	values["key0"] = 100
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	expectPlaced(t, r, values, a, b)
+}
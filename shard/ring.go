@@ -0,0 +1,68 @@
+package shard
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"stupid-kv/base"
+)
+
+// virtualNodes is how many points a shard takes on the ring, so keys spread
+// evenly and only about 1/n of them move when a shard joins or leaves
+const virtualNodes = 128
+
+// Ring assigns keys to shards by consistent hashing. A shard owns the hash
+// range from the previous point on the ring up to each of its points.
+type Ring struct {
+	shards []string
+	points []uint32
+	owners map[uint32]string
+}
+
+func NewRing(shards []string) *Ring {
+	r := &Ring{
+		shards: append([]string{}, shards...),
+		points: make([]uint32, 0, len(shards)*virtualNodes),
+		owners: make(map[uint32]string),
+	}
+	for _, shard := range shards {
+		for i := 0; i < virtualNodes; i++ {
+			point := hash(shard + "#" + strconv.Itoa(i))
+			if _, ok := r.owners[point]; ok {
+				continue // a collision keeps the first shard
+			}
+			r.owners[point] = shard
+			r.points = append(r.points, point)
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+	return r
+}
+
+func (r *Ring) Shards() []string {
+	return append([]string{}, r.shards...)
+}
+
+// Locate returns the shard owning key, or "" for an empty ring
+func (r *Ring) Locate(key base.KeyT) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	h := hash(string(key))
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[r.points[i]]
+}
+
+// hash mixes 64 bit fnv-1a, whose low bits barely differ for similar keys
+func hash(s string) uint32 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	sum := h.Sum64()
+	sum ^= sum >> 33
+	sum *= 0xff51afd7ed558ccd
+	sum ^= sum >> 33
+	return uint32(sum)
+}
@@ -0,0 +1,65 @@
+package shard
+
+import (
+	"fmt"
+	"stupid-kv/base"
+	"testing"
+)
+
+const ringKeys = 20000
+
+// placement returns the owner of each test key on a ring of shards
+func placement(shards ...string) map[base.KeyT]string {
+	r := NewRing(shards)
+	owners := make(map[base.KeyT]string, ringKeys)
+	for i := 0; i < ringKeys; i++ {
+		key := base.KeyT(fmt.Sprintf("user:%v", i))
+		owners[key] = r.Locate(key)
+	}
+	return owners
+}
+
+func TestRingSpread(t *testing.T) {
+	counts := make(map[string]int)
+	for _, shard := range placement("a", "b", "c") {
+		counts[shard]++
+	}
+	for _, shard := range []string{"a", "b", "c"} {
+		if share := float64(counts[shard]) / ringKeys; share < 0.25 || share > 0.42 {
+			t.Fatalf("%v owns %.2f of the keys, want about a third", shard, share)
+		}
+	}
+	if shard := NewRing(nil).Locate("a"); shard != "" {
+		t.Fatalf("an empty ring placed a key on %v", shard)
+	}
+}
+
+func TestRingAddShard(t *testing.T) {
+	before, after := placement("a", "b", "c"), placement("a", "b", "c", "d")
+	moved := 0
+	for key, shard := range before {
+		if after[key] == shard {
+			continue
+		}
+		// only the new shard takes keys, the others keep theirs
+		if after[key] != "d" {
+			t.Fatalf("%v moved from %v to %v", key, shard, after[key])
+		}
+		moved++
+	}
+	if share := float64(moved) / ringKeys; share < 0.17 || share > 0.33 {
+		t.Fatalf("%.2f of the keys moved, want about a quarter", share)
+	}
+}
+
+func TestRingRemoveShard(t *testing.T) {
+	before, after := placement("a", "b", "c"), placement("a", "c")
+	for key, shard := range before {
+		if shard != "b" && after[key] != shard {
+			t.Fatalf("%v moved from %v to %v though %v stays", key, shard, after[key], shard)
+		}
+		if after[key] == "b" {
+			t.Fatalf("%v stays on the removed shard", key)
+		}
+	}
+}
@@ -0,0 +1,315 @@
+package shard
+
+import (
+	"context"
+	"io"
+	"net"
+	"sort"
+	"stupid-kv/base"
+	log "stupid-kv/logutil"
+	"stupid-kv/pb"
+	"stupid-kv/twopc"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+const dialTimeout = 5 * time.Second
+
+// Router serves pb.KV in front of shards, each a stupid-kv grpc server, and
+// forwards every single-key op to the shard owning the key on the ring. A txn
+// begins a branch on every shard it touches and commits them by 2pc.
+type Router struct {
+	pb.UnimplementedKVServer
+	pb.UnimplementedAdminServer
+
+	addr   string
+	server *grpc.Server
+
+	routeGuard *sync.RWMutex // read by every op, written while a key moves
+	ring       *Ring
+	moved      map[base.KeyT]string // keys moved ahead of the ring by a rebalance
+	clients    map[string]pb.KVClient
+	admins     map[string]pb.AdminClient
+	conns      map[string]*grpc.ClientConn
+
+	rebalanceGuard *sync.Mutex
+	rebalancing    bool // no txn begins while keys move
+
+	txns        *sync.Map // gid -> *globalTxn
+	idleTimeout time.Duration
+	coordinator *twopc.Coordinator
+	stop        chan struct{}
+}
+
+// NewRouter connects the shards and resolves the txns left in doubt by a
+// crash of the router, its 2pc log is 2PC.log in the data dir.
+func NewRouter(addr string, shards []string, idleTimeout time.Duration) (*Router, error) {
+	r := &Router{
+		addr:           addr,
+		server:         grpc.NewServer(),
+		routeGuard:     &sync.RWMutex{},
+		ring:           NewRing(shards),
+		moved:          make(map[base.KeyT]string),
+		clients:        make(map[string]pb.KVClient),
+		admins:         make(map[string]pb.AdminClient),
+		conns:          make(map[string]*grpc.ClientConn),
+		rebalanceGuard: &sync.Mutex{},
+		txns:           &sync.Map{},
+		idleTimeout:    idleTimeout,
+		stop:           make(chan struct{}),
+	}
+	if err := r.dial(shards); err != nil {
+		r.closeConns()
+		return nil, err
+	}
+	coordinator, err := twopc.NewCoordinator(base.DataPath("2PC.log"), r.participant)
+	if err != nil {
+		r.closeConns()
+		return nil, err
+	}
+	r.coordinator = coordinator
+	pb.RegisterKVServer(r.server, r)
+	pb.RegisterAdminServer(r.server, r)
+	go r.reapLoop()
+	return r, nil
+}
+
+// dial connects the shards not connected yet, the caller holds the write lock
+func (r *Router) dial(shards []string) error {
+	for _, shard := range shards {
+		if _, ok := r.conns[shard]; ok {
+			continue
+		}
+		conn, err := grpc.Dial(shard, grpc.WithInsecure(), grpc.WithBlock(), grpc.WithTimeout(dialTimeout),
+			pb.WithAdminToken(base.GetConfig().AdminToken))
+		if err != nil {
+			return err
+		}
+		r.conns[shard] = conn
+		r.clients[shard] = pb.NewKVClient(conn)
+		r.admins[shard] = pb.NewAdminClient(conn)
+	}
+	return nil
+}
+
+func (r *Router) ListenAndServe() error {
+	l, err := net.Listen("tcp", r.addr)
+	if err != nil {
+		return err
+	}
+	return r.Serve(l)
+}
+
+func (r *Router) Serve(l net.Listener) error {
+	log.Infof("router listens on %v, shards %v", l.Addr(), r.ring.Shards())
+	return r.server.Serve(l)
+}
+
+// Close stops the server and aborts every open txn
+func (r *Router) Close() error {
+	r.server.Stop()
+	close(r.stop)
+	r.txns.Range(func(gid, v interface{}) bool {
+		_ = r.end(gid.(string), false)
+		return true
+	})
+	err := r.coordinator.Close()
+	r.closeConns()
+	return err
+}
+
+func (r *Router) closeConns() {
+	for _, conn := range r.conns {
+		conn.Close()
+	}
+}
+
+func (r *Router) owner(key base.KeyT) string {
+	if shard, ok := r.moved[key]; ok {
+		return shard
+	}
+	return r.ring.Locate(key)
+}
+
+// route runs fn against the owner of key with the branch of gid on it, or
+// an empty txn if gid is empty. A move of the key waits for it.
+func (r *Router) route(ctx context.Context, gid string, key string, fn func(client pb.KVClient, txn string) error) error {
+	r.routeGuard.RLock()
+	defer r.routeGuard.RUnlock()
+	shard := r.owner(base.KeyT(key))
+	if gid == "" {
+		return fn(r.clients[shard], "")
+	}
+	g, err := r.lockTxn(gid)
+	if err != nil {
+		return err
+	}
+	defer g.guard.Unlock()
+	branch, err := g.branch(ctx, shard, r.clients[shard])
+	if err != nil {
+		return err
+	}
+	return fn(r.clients[shard], branch)
+}
+
+func (r *Router) Get(ctx context.Context, req *pb.GetRequest) (resp *pb.GetResponse, err error) {
+	err = r.route(ctx, req.Txn, req.Key, func(client pb.KVClient, txn string) error {
+		resp, err = client.Get(ctx, &pb.GetRequest{Txn: txn, Key: req.Key})
+		return err
+	})
+	return resp, err
+}
+
+func (r *Router) Put(ctx context.Context, req *pb.PutRequest) (resp *pb.PutResponse, err error) {
+	err = r.route(ctx, req.Txn, req.Key, func(client pb.KVClient, txn string) error {
+		resp, err = client.Put(ctx, &pb.PutRequest{Txn: txn, Key: req.Key, Value: req.Value})
+		return err
+	})
+	return resp, err
+}
+
+func (r *Router) Inc(ctx context.Context, req *pb.KeyRequest) (resp *pb.ValueResponse, err error) {
+	err = r.route(ctx, req.Txn, req.Key, func(client pb.KVClient, txn string) error {
+		resp, err = client.Inc(ctx, &pb.KeyRequest{Txn: txn, Key: req.Key})
+		return err
+	})
+	return resp, err
+}
+
+func (r *Router) Dec(ctx context.Context, req *pb.KeyRequest) (resp *pb.ValueResponse, err error) {
+	err = r.route(ctx, req.Txn, req.Key, func(client pb.KVClient, txn string) error {
+		resp, err = client.Dec(ctx, &pb.KeyRequest{Txn: txn, Key: req.Key})
+		return err
+	})
+	return resp, err
+}
+
+func (r *Router) Del(ctx context.Context, req *pb.KeyRequest) (resp *pb.DelResponse, err error) {
+	err = r.route(ctx, req.Txn, req.Key, func(client pb.KVClient, txn string) error {
+		resp, err = client.Del(ctx, &pb.KeyRequest{Txn: txn, Key: req.Key})
+		return err
+	})
+	return resp, err
+}
+
+func (r *Router) History(ctx context.Context, req *pb.HistoryRequest) (resp *pb.HistoryResponse, err error) {
+	err = r.route(ctx, "", req.Key, func(client pb.KVClient, txn string) error {
+		resp, err = client.History(ctx, req)
+		return err
+	})
+	return resp, err
+}
+
+// admin returns the admin client of the owner of key, the caller holds the read lock
+func (r *Router) admin(key string) pb.AdminClient {
+	return r.admins[r.owner(base.KeyT(key))]
+}
+
+func (r *Router) Import(ctx context.Context, req *pb.ImportRequest) (*pb.ImportResponse, error) {
+	if err := pb.AuthorizeAdmin(ctx, base.GetConfig().AdminToken); err != nil {
+		return nil, err
+	}
+	r.routeGuard.RLock()
+	defer r.routeGuard.RUnlock()
+	return r.admin(req.Key).Import(ctx, req)
+}
+
+func (r *Router) Drop(ctx context.Context, req *pb.KeyRequest) (*pb.DelResponse, error) {
+	if err := pb.AuthorizeAdmin(ctx, base.GetConfig().AdminToken); err != nil {
+		return nil, err
+	}
+	r.routeGuard.RLock()
+	defer r.routeGuard.RUnlock()
+	return r.admin(req.Key).Drop(ctx, req)
+}
+
+// Scan merges the scans of every shard, each shard reads its own snapshot.
+// In a txn it begins a branch on every shard.
+func (r *Router) Scan(req *pb.ScanRequest, stream pb.KV_ScanServer) error {
+	r.routeGuard.RLock()
+	var g *globalTxn
+	if req.Txn != "" {
+		var err error
+		if g, err = r.lockTxn(req.Txn); err != nil {
+			r.routeGuard.RUnlock()
+			return err
+		}
+		defer g.guard.Unlock()
+	}
+	pairs := make([]*pb.KeyValue, 0)
+	for shard, client := range r.clients {
+		shardReq := &pb.ScanRequest{Start: req.Start, End: req.End}
+		if g != nil {
+			branch, err := g.branch(stream.Context(), shard, client)
+			if err != nil {
+				r.routeGuard.RUnlock()
+				return err
+			}
+			shardReq.Txn = branch
+		}
+		shardStream, err := client.Scan(stream.Context(), shardReq)
+		if err != nil {
+			r.routeGuard.RUnlock()
+			return err
+		}
+		for {
+			pair, err := shardStream.Recv()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				r.routeGuard.RUnlock()
+				return err
+			}
+			pairs = append(pairs, pair)
+		}
+	}
+	r.routeGuard.RUnlock()
+
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].Key < pairs[j].Key })
+	for _, pair := range pairs {
+		if err := stream.Send(pair); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Router) Keys(ctx context.Context, req *pb.KeysRequest) (*pb.KeysResponse, error) {
+	if err := pb.AuthorizeAdmin(ctx, base.GetConfig().AdminToken); err != nil {
+		return nil, err
+	}
+	r.routeGuard.RLock()
+	defer r.routeGuard.RUnlock()
+	resp := &pb.KeysResponse{}
+	for _, client := range r.admins {
+		shardResp, err := client.Keys(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		resp.Keys = append(resp.Keys, shardResp.Keys...)
+	}
+	sort.Strings(resp.Keys)
+	return resp, nil
+}
+
+// Stats sums the keys, versions and engine counters of the shards, tids are
+// per shard and left out
+func (r *Router) Stats(ctx context.Context, req *pb.StatsRequest) (*pb.StatsResponse, error) {
+	r.routeGuard.RLock()
+	defer r.routeGuard.RUnlock()
+	resp := &pb.StatsResponse{Engine: map[string]int64{}}
+	for _, client := range r.clients {
+		shardResp, err := client.Stats(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		resp.Keys += shardResp.Keys
+		resp.Versions += shardResp.Versions
+		for name, n := range shardResp.Engine {
+			resp.Engine[name] += n
+		}
+	}
+	return resp, nil
+}
@@ -0,0 +1,192 @@
+package shard
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	log "stupid-kv/logutil"
+	"stupid-kv/pb"
+	"stupid-kv/twopc"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	errTxnNotFound = status.Error(codes.NotFound, "txn not found or expired")
+	errRebalancing = status.Error(codes.Unavailable, "shards are rebalancing, retry later")
+)
+
+// gids are unique across restarts of the router, the 2pc log outlives them
+var (
+	gidPrefix = fmt.Sprintf("g%x", time.Now().UnixNano())
+	gidCount  int64
+)
+
+// globalTxn is a txn of the router, with a branch txn on each shard it touched
+type globalTxn struct {
+	guard    sync.Mutex        // serializes requests of the same txn
+	branches map[string]string // shard -> txn on it
+	lastUsed int64             // unix nano, accessed atomically
+	reaping  int32             // set once by the reaper, so it starts a single end per txn
+	done     bool
+}
+
+func (g *globalTxn) touch() {
+	atomic.StoreInt64(&g.lastUsed, time.Now().UnixNano())
+}
+
+// branch returns the txn of g on shard, beginning it on first use. The
+// caller holds g.guard.
+func (g *globalTxn) branch(ctx context.Context, shard string, client pb.KVClient) (string, error) {
+	if txn, ok := g.branches[shard]; ok {
+		return txn, nil
+	}
+	resp, err := client.Begin(ctx, &pb.BeginRequest{})
+	if err != nil {
+		return "", err
+	}
+	g.branches[shard] = resp.Txn
+	return resp.Txn, nil
+}
+
+// lockTxn returns the open txn gid with its guard locked
+func (r *Router) lockTxn(gid string) (*globalTxn, error) {
+	v, ok := r.txns.Load(gid)
+	if !ok {
+		return nil, errTxnNotFound
+	}
+	g := v.(*globalTxn)
+	g.guard.Lock()
+	if g.done {
+		g.guard.Unlock()
+		return nil, errTxnNotFound
+	}
+	g.touch()
+	return g, nil
+}
+
+func (r *Router) Begin(ctx context.Context, req *pb.BeginRequest) (*pb.BeginResponse, error) {
+	r.routeGuard.RLock()
+	defer r.routeGuard.RUnlock()
+	if r.rebalancing {
+		return nil, errRebalancing
+	}
+	gid := fmt.Sprintf("%v.%d", gidPrefix, atomic.AddInt64(&gidCount, 1))
+	g := &globalTxn{branches: make(map[string]string)}
+	g.touch()
+	r.txns.Store(gid, g)
+	return &pb.BeginResponse{Txn: gid}, nil
+}
+
+func (r *Router) Commit(ctx context.Context, req *pb.TxnRequest) (*pb.TxnResponse, error) {
+	return &pb.TxnResponse{}, r.end(req.Txn, true)
+}
+
+func (r *Router) Abort(ctx context.Context, req *pb.TxnRequest) (*pb.TxnResponse, error) {
+	return &pb.TxnResponse{}, r.end(req.Txn, false)
+}
+
+// end commits a txn with one branch directly and one with more by 2pc,
+// a failed 2pc is returned as ABORTED.
+func (r *Router) end(gid string, commit bool) error {
+	g, err := r.lockTxn(gid)
+	if err != nil {
+		return err
+	}
+	defer g.guard.Unlock()
+	g.done = true
+	r.txns.Delete(gid)
+
+	ctx := context.Background()
+	branches := make([]twopc.Branch, 0, len(g.branches))
+	for shard, txn := range g.branches {
+		branches = append(branches, twopc.Branch{Participant: shard, Txn: txn})
+	}
+	sort.Slice(branches, func(i, j int) bool { return branches[i].Participant < branches[j].Participant })
+
+	if commit && len(branches) > 1 {
+		err := r.coordinator.Commit(ctx, gid, branches)
+		if errors.Is(err, twopc.ErrAborted) {
+			return status.Error(codes.Aborted, err.Error())
+		}
+		return err
+	}
+	var firstErr error
+	for _, b := range branches {
+		r.routeGuard.RLock()
+		client, ok := r.clients[b.Participant]
+		r.routeGuard.RUnlock()
+		if !ok {
+			err = fmt.Errorf("shard %v is not connected", b.Participant)
+		} else if commit {
+			_, err = client.Commit(ctx, &pb.TxnRequest{Txn: b.Txn})
+		} else {
+			_, err = client.Abort(ctx, &pb.TxnRequest{Txn: b.Txn})
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (r *Router) reapLoop() {
+	ticker := time.NewTicker(r.idleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.stop:
+			return
+		case now := <-ticker.C:
+			r.txns.Range(func(gid, v interface{}) bool {
+				g := v.(*globalTxn)
+				if now.Sub(time.Unix(0, atomic.LoadInt64(&g.lastUsed))) > r.idleTimeout &&
+					atomic.CompareAndSwapInt32(&g.reaping, 0, 1) {
+					log.Warningf("txn %v idle for %v, abort", gid, r.idleTimeout)
+					go r.end(gid.(string), false)
+				}
+				return true
+			})
+		}
+	}
+}
+
+// participant adapts the shard named name to twopc.Participant
+func (r *Router) participant(name string) (twopc.Participant, error) {
+	r.routeGuard.RLock()
+	defer r.routeGuard.RUnlock()
+	client, ok := r.clients[name]
+	if !ok {
+		return nil, fmt.Errorf("shard %v is not connected", name)
+	}
+	return participant{client}, nil
+}
+
+type participant struct {
+	client pb.KVClient
+}
+
+func (p participant) Prepare(ctx context.Context, txn string) error {
+	_, err := p.client.Prepare(ctx, &pb.TxnRequest{Txn: txn})
+	return err
+}
+
+// Commit takes a txn not found as committed by an earlier attempt
+func (p participant) Commit(ctx context.Context, txn string) error {
+	if _, err := p.client.Commit(ctx, &pb.TxnRequest{Txn: txn}); status.Code(err) != codes.NotFound {
+		return err
+	}
+	return nil
+}
+
+func (p participant) Abort(ctx context.Context, txn string) error {
+	if _, err := p.client.Abort(ctx, &pb.TxnRequest{Txn: txn}); status.Code(err) != codes.NotFound {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,339 @@
+package shard
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"stupid-kv/base"
+	"stupid-kv/pb"
+	"stupid-kv/testutil"
+	"stupid-kv/twopc"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestMain(m *testing.M) {
+	testutil.Main(m)
+}
+
+var errNoTxn = status.Error(codes.NotFound, "txn not found")
+
+// fakeShard keeps the versions of its keys in memory and buffers the writes
+// of a txn until it commits, the methods the router does not call panic
+type fakeShard struct {
+	pb.KVClient
+	pb.AdminClient
+
+	name       string
+	guard      sync.Mutex
+	versions   map[string][]*pb.Version
+	txns       map[string]map[string]int64 // open txn -> key -> value
+	prepared   map[string]bool
+	committed  []string
+	aborted    []string
+	count      int64
+	prepareErr error
+	onHistory  func() // runs first in History if set, e.g. to hold a move midway
+}
+
+func newFakeShard(name string) *fakeShard {
+	return &fakeShard{
+		name:     name,
+		versions: make(map[string][]*pb.Version),
+		txns:     make(map[string]map[string]int64),
+		prepared: make(map[string]bool),
+	}
+}
+
+// write appends a version of key, the caller holds guard
+func (s *fakeShard) write(key string, value int64) {
+	s.count++
+	if versions := s.versions[key]; len(versions) > 0 {
+		versions[len(versions)-1].End = s.count - 1
+	}
+	s.versions[key] = append(s.versions[key], &pb.Version{Value: value, Begin: s.count, End: int64(base.MAX_TID)})
+}
+
+// value returns the newest committed value of key
+func (s *fakeShard) value(key string) (int64, bool) {
+	s.guard.Lock()
+	defer s.guard.Unlock()
+	versions := s.versions[key]
+	if len(versions) == 0 {
+		return 0, false
+	}
+	return versions[len(versions)-1].Value, true
+}
+
+func (s *fakeShard) Begin(ctx context.Context, in *pb.BeginRequest, opts ...grpc.CallOption) (*pb.BeginResponse, error) {
+	s.guard.Lock()
+	defer s.guard.Unlock()
+	s.count++
+	txn := fmt.Sprintf("%v.%v", s.name, s.count)
+	s.txns[txn] = make(map[string]int64)
+	return &pb.BeginResponse{Txn: txn}, nil
+}
+
+func (s *fakeShard) Get(ctx context.Context, in *pb.GetRequest, opts ...grpc.CallOption) (*pb.GetResponse, error) {
+	s.guard.Lock()
+	if writes, ok := s.txns[in.Txn]; ok {
+		if value, ok := writes[in.Key]; ok {
+			s.guard.Unlock()
+			return &pb.GetResponse{Found: true, Value: value}, nil
+		}
+	}
+	s.guard.Unlock()
+	value, ok := s.value(in.Key)
+	return &pb.GetResponse{Found: ok, Value: value}, nil
+}
+
+func (s *fakeShard) Put(ctx context.Context, in *pb.PutRequest, opts ...grpc.CallOption) (*pb.PutResponse, error) {
+	s.guard.Lock()
+	defer s.guard.Unlock()
+	if in.Txn == "" {
+		s.write(in.Key, in.Value)
+		return &pb.PutResponse{}, nil
+	}
+	writes, ok := s.txns[in.Txn]
+	if !ok || s.prepared[in.Txn] {
+		return nil, errNoTxn
+	}
+	writes[in.Key] = in.Value
+	return &pb.PutResponse{}, nil
+}
+
+func (s *fakeShard) Prepare(ctx context.Context, in *pb.TxnRequest, opts ...grpc.CallOption) (*pb.TxnResponse, error) {
+	s.guard.Lock()
+	defer s.guard.Unlock()
+	if _, ok := s.txns[in.Txn]; !ok {
+		return nil, errNoTxn
+	}
+	if s.prepareErr != nil {
+		return nil, s.prepareErr
+	}
+	s.prepared[in.Txn] = true
+	return &pb.TxnResponse{}, nil
+}
+
+func (s *fakeShard) Commit(ctx context.Context, in *pb.TxnRequest, opts ...grpc.CallOption) (*pb.TxnResponse, error) {
+	s.guard.Lock()
+	defer s.guard.Unlock()
+	writes, ok := s.txns[in.Txn]
+	if !ok {
+		return nil, errNoTxn
+	}
+	for key, value := range writes {
+		s.write(key, value)
+	}
+	delete(s.txns, in.Txn)
+	s.committed = append(s.committed, in.Txn)
+	return &pb.TxnResponse{}, nil
+}
+
+func (s *fakeShard) Abort(ctx context.Context, in *pb.TxnRequest, opts ...grpc.CallOption) (*pb.TxnResponse, error) {
+	s.guard.Lock()
+	defer s.guard.Unlock()
+	if _, ok := s.txns[in.Txn]; !ok {
+		return nil, errNoTxn
+	}
+	delete(s.txns, in.Txn)
+	s.aborted = append(s.aborted, in.Txn)
+	return &pb.TxnResponse{}, nil
+}
+
+func (s *fakeShard) History(ctx context.Context, in *pb.HistoryRequest, opts ...grpc.CallOption) (*pb.HistoryResponse, error) {
+	if s.onHistory != nil {
+		s.onHistory()
+	}
+	s.guard.Lock()
+	defer s.guard.Unlock()
+	return &pb.HistoryResponse{Versions: append([]*pb.Version{}, s.versions[in.Key]...)}, nil
+}
+
+func (s *fakeShard) Keys(ctx context.Context, in *pb.KeysRequest, opts ...grpc.CallOption) (*pb.KeysResponse, error) {
+	s.guard.Lock()
+	defer s.guard.Unlock()
+	keys := make([]string, 0, len(s.versions))
+	for key := range s.versions {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return &pb.KeysResponse{Keys: keys}, nil
+}
+
+func (s *fakeShard) Import(ctx context.Context, in *pb.ImportRequest, opts ...grpc.CallOption) (*pb.ImportResponse, error) {
+	s.guard.Lock()
+	defer s.guard.Unlock()
+	s.versions[in.Key] = append([]*pb.Version{}, in.Versions...)
+	return &pb.ImportResponse{}, nil
+}
+
+func (s *fakeShard) Drop(ctx context.Context, in *pb.KeyRequest, opts ...grpc.CallOption) (*pb.DelResponse, error) {
+	s.guard.Lock()
+	defer s.guard.Unlock()
+	_, ok := s.versions[in.Key]
+	delete(s.versions, in.Key)
+	return &pb.DelResponse{Deleted: ok}, nil
+}
+
+// newTestRouter routes over the shards on the ring of the ones named in ring,
+// every shard is connected so a rebalance can move keys to it
+func newTestRouter(t *testing.T, ring []string, shards ...*fakeShard) *Router {
+	t.Helper()
+	r := &Router{
+		routeGuard:     &sync.RWMutex{},
+		ring:           NewRing(ring),
+		moved:          make(map[base.KeyT]string),
+		clients:        make(map[string]pb.KVClient),
+		admins:         make(map[string]pb.AdminClient),
+		conns:          make(map[string]*grpc.ClientConn),
+		rebalanceGuard: &sync.Mutex{},
+		txns:           &sync.Map{},
+		idleTimeout:    time.Hour,
+		stop:           make(chan struct{}),
+	}
+	for _, s := range shards {
+		// a lazy conn to nowhere, so dial skips the shard
+		conn, err := grpc.Dial(s.name, grpc.WithInsecure())
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.conns[s.name], r.clients[s.name], r.admins[s.name] = conn, s, s
+	}
+	dir, err := ioutil.TempDir(base.GetConfig().DataDir, "router-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.coordinator, err = twopc.NewCoordinator(filepath.Join(dir, "2PC.log"), r.participant); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		r.coordinator.Close()
+		r.closeConns()
+	})
+	return r
+}
+
+// keyOn returns a key the ring of r places on shard
+func keyOn(t *testing.T, r *Router, shard string) string {
+	t.Helper()
+	for i := 0; i < 10000; i++ {
+		key := fmt.Sprintf("key%v", i)
+		if r.ring.Locate(base.KeyT(key)) == shard {
+			return key
+		}
+	}
+	t.Fatalf("no key on %v", shard)
+	return ""
+}
+
+func begin(t *testing.T, r *Router) string {
+	t.Helper()
+	resp, err := r.Begin(context.Background(), &pb.BeginRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.Txn
+}
+
+func put(t *testing.T, r *Router, gid string, key string, value int64) {
+	t.Helper()
+	if _, err := r.Put(context.Background(), &pb.PutRequest{Txn: gid, Key: key, Value: value}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func expectValue(t *testing.T, s *fakeShard, key string, want int64, found bool) {
+	t.Helper()
+	if value, ok := s.value(key); ok != found || (found && value != want) {
+		t.Fatalf("%v on %v = %v %v, want %v %v", key, s.name, value, ok, want, found)
+	}
+}
+
+func TestCommitOneBranch(t *testing.T) {
+	a, b := newFakeShard("a"), newFakeShard("b")
+	r := newTestRouter(t, []string{"a", "b"}, a, b)
+	key := keyOn(t, r, "a")
+	gid := begin(t, r)
+	put(t, r, gid, key, 1)
+	if _, err := r.Commit(context.Background(), &pb.TxnRequest{Txn: gid}); err != nil {
+		t.Fatal(err)
+	}
+	expectValue(t, a, key, 1, true)
+	if len(a.prepared) != 0 {
+		t.Fatal("a single branch went through 2pc")
+	}
+	if _, err := r.Commit(context.Background(), &pb.TxnRequest{Txn: gid}); err != errTxnNotFound {
+		t.Fatalf("second commit: %v, want not found", err)
+	}
+}
+
+func TestCommitTwoPhase(t *testing.T) {
+	a, b := newFakeShard("a"), newFakeShard("b")
+	r := newTestRouter(t, []string{"a", "b"}, a, b)
+	ka, kb := keyOn(t, r, "a"), keyOn(t, r, "b")
+	gid := begin(t, r)
+	put(t, r, gid, ka, 1)
+	put(t, r, gid, kb, 2)
+	if _, err := r.Commit(context.Background(), &pb.TxnRequest{Txn: gid}); err != nil {
+		t.Fatal(err)
+	}
+	expectValue(t, a, ka, 1, true)
+	expectValue(t, b, kb, 2, true)
+	if len(a.prepared) != 1 || len(b.prepared) != 1 {
+		t.Fatal("branches committed without a prepare")
+	}
+	if n := r.coordinator.Pending(); n != 0 {
+		t.Fatalf("%v pending, want 0", n)
+	}
+}
+
+func TestCommitPrepareFailure(t *testing.T) {
+	a, b := newFakeShard("a"), newFakeShard("b")
+	b.prepareErr = status.Error(codes.Unavailable, "disk full")
+	r := newTestRouter(t, []string{"a", "b"}, a, b)
+	ka, kb := keyOn(t, r, "a"), keyOn(t, r, "b")
+	gid := begin(t, r)
+	put(t, r, gid, ka, 1)
+	put(t, r, gid, kb, 2)
+	_, err := r.Commit(context.Background(), &pb.TxnRequest{Txn: gid})
+	if status.Code(err) != codes.Aborted {
+		t.Fatalf("commit: %v, want aborted", err)
+	}
+	expectValue(t, a, ka, 0, false)
+	expectValue(t, b, kb, 0, false)
+	if len(a.aborted) != 1 || len(b.aborted) != 1 {
+		t.Fatalf("aborted %v on a and %v on b, want both", a.aborted, b.aborted)
+	}
+}
+
+func TestParticipantNotFound(t *testing.T) {
+	p := participant{newFakeShard("a")}
+	ctx := context.Background()
+	// an earlier attempt ended the branch already
+	if err := p.Commit(ctx, "gone"); err != nil {
+		t.Fatalf("commit of an ended branch: %v", err)
+	}
+	if err := p.Abort(ctx, "gone"); err != nil {
+		t.Fatalf("abort of an ended branch: %v", err)
+	}
+	// a branch that is gone can not vote yes
+	if err := p.Prepare(ctx, "gone"); err == nil {
+		t.Fatal("prepare of an ended branch succeeded")
+	}
+
+	s := newFakeShard("b")
+	s.prepareErr = errors.New("disk full")
+	resp, _ := s.Begin(ctx, &pb.BeginRequest{})
+	if err := (participant{s}).Prepare(ctx, resp.Txn); err == nil {
+		t.Fatal("prepare error was dropped")
+	}
+}
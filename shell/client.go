@@ -0,0 +1,59 @@
+package shell
+
+import (
+	"context"
+	"net"
+	"stupid-kv/base"
+	"stupid-kv/pb"
+	"stupid-kv/server"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// localIdleTimeout keeps a txn of a local shell open while its user thinks
+const localIdleTimeout = 24 * time.Hour
+
+// Client is a pb.KV client, with the pb.Admin client of the same server for
+// the tools that move whole histories
+type Client struct {
+	pb.KVClient
+	Admin pb.AdminClient
+}
+
+func newClient(conn *grpc.ClientConn) *Client {
+	return &Client{KVClient: pb.NewKVClient(conn), Admin: pb.NewAdminClient(conn)}
+}
+
+// DialRemote connects to the grpc server of a running stupid-kv, admin calls
+// carry the configured admin_token.
+func DialRemote(addr string) (*Client, func(), error) {
+	conn, err := grpc.Dial(addr, grpc.WithInsecure(), grpc.WithBlock(), grpc.WithTimeout(5*time.Second),
+		pb.WithAdminToken(base.GetConfig().AdminToken))
+	if err != nil {
+		return nil, nil, err
+	}
+	return newClient(conn), func() { conn.Close() }, nil
+}
+
+// DialLocal opens the configured data dir in this process and serves it over
+// an in-memory connection, so local and remote shells behave the same.
+func DialLocal() (*Client, func(), error) {
+	l := bufconn.Listen(1 << 20)
+	s := server.NewGrpcServer("", localIdleTimeout)
+	go s.Serve(l)
+
+	conn, err := grpc.Dial("local", grpc.WithInsecure(),
+		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			return l.Dial()
+		}))
+	if err != nil {
+		s.Close()
+		return nil, nil, err
+	}
+	return newClient(conn), func() {
+		conn.Close()
+		s.Close()
+	}, nil
+}
@@ -0,0 +1,310 @@
+package shell
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"stupid-kv/base"
+	"stupid-kv/pb"
+	"text/tabwriter"
+
+	"golang.org/x/term"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const help = `commands:
+  BEGIN                  start a txn, later commands run in it
+  COMMIT | ABORT         end the txn
+  GET key                read a key
+  PUT key value          write an integer value (SET works too)
+  INC key | DEC key      add or subtract 1, a missing key counts as 0
+  DEL key                delete a key
+  SCAN [start [end]]     list keys in [start, end)
+  HISTORY key            list the retained mvcc versions of a key
+  STATS                  show store and txn counters
+  HELP | EXIT`
+
+var errExit = errors.New("exit")
+
+type usageError string
+
+func (e usageError) Error() string {
+	return string(e)
+}
+
+// Shell runs queries against a pb.KVClient, one txn at a time
+type Shell struct {
+	client pb.KVClient
+	txn    string
+	out    io.Writer
+}
+
+func New(client pb.KVClient) *Shell {
+	return &Shell{client: client, out: os.Stdout}
+}
+
+func (sh *Shell) prompt() string {
+	if sh.txn != "" {
+		return fmt.Sprintf("stupid-kv(txn %v)> ", sh.txn)
+	}
+	return "stupid-kv> "
+}
+
+// Run reads commands from stdin until EXIT or eof, with line editing and
+// history when stdin is a terminal. An open txn is aborted on exit.
+func (sh *Shell) Run() error {
+	defer func() {
+		if sh.txn != "" {
+			_, _ = sh.client.Abort(context.Background(), &pb.TxnRequest{Txn: sh.txn})
+		}
+	}()
+
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			if sh.exec(scanner.Text()) == errExit {
+				return nil
+			}
+		}
+		return scanner.Err()
+	}
+
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		return err
+	}
+	defer term.Restore(fd, state)
+	t := term.NewTerminal(struct {
+		io.Reader
+		io.Writer
+	}{os.Stdin, os.Stdout}, sh.prompt())
+	sh.out = t
+	fmt.Fprintln(sh.out, `stupid-kv shell, type HELP for commands`)
+	for {
+		t.SetPrompt(sh.prompt())
+		line, err := t.ReadLine()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if sh.exec(line) == errExit {
+			return nil
+		}
+	}
+}
+
+// exec runs one command line and prints its result or error.
+func (sh *Shell) exec(line string) error {
+	args := strings.Fields(line)
+	if len(args) == 0 {
+		return nil
+	}
+	err := sh.execArgs(strings.ToUpper(args[0]), args[1:])
+	if err != nil && err != errExit {
+		sh.printError(err)
+	}
+	return err
+}
+
+func (sh *Shell) printError(err error) {
+	if _, ok := err.(usageError); ok {
+		fmt.Fprintln(sh.out, "(error)", err)
+		return
+	}
+	s := status.Convert(err)
+	switch s.Code() {
+	case codes.Aborted:
+		fmt.Fprintf(sh.out, "(error) %v, ABORT and retry the txn\n", s.Message())
+	case codes.Unavailable:
+		fmt.Fprintf(sh.out, "(error) server unavailable: %v\n", s.Message())
+	default:
+		fmt.Fprintf(sh.out, "(error) %v\n", s.Message())
+	}
+}
+
+func (sh *Shell) execArgs(cmd string, args []string) error {
+	ctx := context.Background()
+	switch cmd {
+	case "HELP":
+		fmt.Fprintln(sh.out, help)
+	case "EXIT", "QUIT":
+		return errExit
+	case "BEGIN":
+		if sh.txn != "" {
+			return usageError("COMMIT or ABORT txn " + sh.txn + " first")
+		}
+		resp, err := sh.client.Begin(ctx, &pb.BeginRequest{})
+		if err != nil {
+			return err
+		}
+		sh.txn = resp.Txn
+		fmt.Fprintf(sh.out, "txn %v begins\n", sh.txn)
+	case "COMMIT", "ABORT":
+		if sh.txn == "" {
+			return usageError("BEGIN a txn first")
+		}
+		req := &pb.TxnRequest{Txn: sh.txn}
+		var err error
+		if cmd == "COMMIT" {
+			_, err = sh.client.Commit(ctx, req)
+		} else {
+			_, err = sh.client.Abort(ctx, req)
+		}
+		if status.Code(err) == codes.NotFound || err == nil {
+			sh.txn = "" // ended, or expired on the server
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(sh.out, "txn %v %vs\n", req.Txn, strings.ToLower(cmd))
+	case "GET":
+		if len(args) != 1 {
+			return usageError("usage: GET key")
+		}
+		resp, err := sh.client.Get(ctx, &pb.GetRequest{Txn: sh.txn, Key: args[0]})
+		if err != nil {
+			return err
+		}
+		if !resp.Found {
+			fmt.Fprintln(sh.out, "(nil)")
+		} else {
+			fmt.Fprintf(sh.out, "%v = %v\n", args[0], resp.Value)
+		}
+	case "PUT", "SET":
+		if len(args) != 2 {
+			return usageError("usage: PUT key value")
+		}
+		value, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return usageError("usage: PUT key value, value must be an integer")
+		}
+		if _, err := sh.client.Put(ctx, &pb.PutRequest{Txn: sh.txn, Key: args[0], Value: value}); err != nil {
+			return err
+		}
+		fmt.Fprintln(sh.out, "OK")
+	case "INC", "DEC":
+		if len(args) != 1 {
+			return usageError("usage: " + cmd + " key")
+		}
+		req := &pb.KeyRequest{Txn: sh.txn, Key: args[0]}
+		var resp *pb.ValueResponse
+		var err error
+		if cmd == "INC" {
+			resp, err = sh.client.Inc(ctx, req)
+		} else {
+			resp, err = sh.client.Dec(ctx, req)
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(sh.out, "%v = %v\n", args[0], resp.Value)
+	case "DEL":
+		if len(args) != 1 {
+			return usageError("usage: DEL key")
+		}
+		resp, err := sh.client.Del(ctx, &pb.KeyRequest{Txn: sh.txn, Key: args[0]})
+		if err != nil {
+			return err
+		}
+		if resp.Deleted {
+			fmt.Fprintln(sh.out, "(deleted)")
+		} else {
+			fmt.Fprintln(sh.out, "(nil)")
+		}
+	case "SCAN":
+		if len(args) > 2 {
+			return usageError("usage: SCAN [start [end]]")
+		}
+		req := &pb.ScanRequest{Txn: sh.txn}
+		if len(args) > 0 {
+			req.Start = args[0]
+		}
+		if len(args) > 1 {
+			req.End = args[1]
+		}
+		return sh.scan(ctx, req)
+	case "HISTORY":
+		if len(args) != 1 {
+			return usageError("usage: HISTORY key")
+		}
+		resp, err := sh.client.History(ctx, &pb.HistoryRequest{Key: args[0]})
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(sh.out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "VALUE\tBEGIN\tEND\t")
+		for _, v := range resp.Versions {
+			fmt.Fprintf(w, "%v\t%v\t%v\t\n", formatValue(v.Value), v.Begin, formatTid(v.End))
+		}
+		w.Flush()
+		fmt.Fprintf(sh.out, "(%d versions)\n", len(resp.Versions))
+	case "STATS":
+		resp, err := sh.client.Stats(ctx, &pb.StatsRequest{})
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(sh.out, 0, 4, 2, ' ', 0)
+		fmt.Fprintf(w, "keys\t%v\n", resp.Keys)
+		fmt.Fprintf(w, "versions\t%v\n", resp.Versions)
+		fmt.Fprintf(w, "next tid\t%v\n", resp.CurTid)
+		fmt.Fprintf(w, "active txns\t%v\n", resp.ActiveTids)
+		names := make([]string, 0, len(resp.Engine))
+		for name := range resp.Engine {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(w, "%v\t%v\n", strings.ReplaceAll(name, "_", " "), resp.Engine[name])
+		}
+		w.Flush()
+	default:
+		return usageError("unknown command " + cmd + ", type HELP")
+	}
+	return nil
+}
+
+func (sh *Shell) scan(ctx context.Context, req *pb.ScanRequest) error {
+	stream, err := sh.client.Scan(ctx, req)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(sh.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "KEY\tVALUE\t")
+	n := 0
+	for {
+		pair, err := stream.Recv()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%v\t%v\t\n", pair.Key, pair.Value)
+		n++
+	}
+	w.Flush()
+	fmt.Fprintf(sh.out, "(%d keys)\n", n)
+	return nil
+}
+
+func formatValue(v int64) string {
+	if base.ValueT(v) == base.VALUE_NOT_FOUND {
+		return "(deleted)"
+	}
+	return strconv.FormatInt(v, 10)
+}
+
+func formatTid(tid int64) string {
+	if base.Tid(tid) == base.MAX_TID {
+		return "max"
+	}
+	return strconv.FormatInt(tid, 10)
+}
@@ -125,10 +125,10 @@ func TestCase41(wg *sync.WaitGroup) {
 			tid := txnManager.BeginTxn()
 
 			if err := txnManager.Inc("A", tid); err != nil {
-				log.Error("inc error: ", err)
+				log.Fatal("inc error: ", err)
 			}
 			if err := txnManager.Inc("B", tid); err != nil {
-				log.Error("inc error: ", err)
+				log.Fatal("inc error: ", err)
 			}
 			_ = txnManager.Inc("A", tid)
 			_ = txnManager.Inc("B", tid)
@@ -140,17 +140,17 @@ func TestCase41(wg *sync.WaitGroup) {
 			_ = txnManager.Inc("B", tid)
 
 			if err := txnManager.CommitTxn(tid); err != nil {
-				log.Error("commit error: ", err)
+				log.Fatal("commit error: ", err)
 			}
 		}
 		{
 			tid := txnManager.BeginTxn()
 
 			if err := txnManager.Inc("A", tid); err != nil {
-				log.Error("inc error: ", err)
+				log.Fatal("inc error: ", err)
 			}
 			if err := txnManager.Inc("B", tid); err != nil {
-				log.Error("inc error: ", err)
+				log.Fatal("inc error: ", err)
 			}
 			_ = txnManager.Inc("A", tid)
 			_ = txnManager.Inc("B", tid)
@@ -162,7 +162,7 @@ func TestCase41(wg *sync.WaitGroup) {
 			_ = txnManager.Inc("B", tid)
 
 			if err := txnManager.CommitTxn(tid); err != nil {
-				log.Error("commit error: ", err)
+				log.Fatal("commit error: ", err)
 			}
 		}
 
@@ -170,10 +170,10 @@ func TestCase41(wg *sync.WaitGroup) {
 			tid := txnManager.BeginTxn()
 
 			if err := txnManager.Dec("A", tid); err != nil {
-				log.Error("inc error: ", err)
+				log.Fatal("inc error: ", err)
 			}
 			if err := txnManager.Dec("B", tid); err != nil {
-				log.Error("inc error: ", err)
+				log.Fatal("inc error: ", err)
 			}
 			_ = txnManager.Dec("A", tid)
 			_ = txnManager.Dec("B", tid)
@@ -185,7 +185,7 @@ func TestCase41(wg *sync.WaitGroup) {
 			_ = txnManager.Dec("B", tid)
 
 			if err := txnManager.AbortTxn(tid); err != nil {
-				log.Error("commit error: ", err)
+				log.Fatal("commit error: ", err)
 			}
 		}
 	}
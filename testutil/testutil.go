@@ -0,0 +1,46 @@
+// Package testutil is the fixture shared by the tests of the packages that
+// run on the process wide config, txn and kv managers.
+package testutil
+
+import (
+	"io/ioutil"
+	"os"
+	"stupid-kv/base"
+	log "stupid-kv/logutil"
+	"stupid-kv/txn"
+	"testing"
+)
+
+// Main runs the tests of a package on the default config over a temp data
+// dir with logging off, a package calls it from its TestMain
+func Main(m *testing.M) {
+	dir, err := ioutil.TempDir("", "stupid-kv-test-")
+	if err != nil {
+		panic(err)
+	}
+	cfg := base.DefaultConfig()
+	cfg.DataDir = dir
+	base.SetConfig(cfg)
+	log.SetLevel(log.OffLevel)
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func MustDo(t testing.TB, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// ExpectCommitted reads key in a txn of its own
+func ExpectCommitted(t testing.TB, key base.KeyT, want base.ValueT) {
+	t.Helper()
+	tm := txn.GetManagerInstance()
+	tid := tm.BeginTxn()
+	defer tm.AbortTxn(tid)
+	if got := tm.Get(key, tid); got != want {
+		t.Fatalf("%v = %v at tid %v, want %v", key, got, tid, want)
+	}
+}
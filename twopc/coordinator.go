@@ -0,0 +1,261 @@
+package twopc
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"stupid-kv/base"
+	log "stupid-kv/logutil"
+	"sync"
+	"time"
+)
+
+const recoverInterval = 5 * time.Second
+
+var ErrAborted = errors.New("global txn aborted")
+
+// Participant is a store taking part in global txns. Commit and Abort of a
+// txn that already ended must return nil, recovery may send them twice.
+type Participant interface {
+	Prepare(ctx context.Context, txn string) error
+	Commit(ctx context.Context, txn string) error
+	Abort(ctx context.Context, txn string) error
+}
+
+// Branch is the local txn of a global txn on one participant
+type Branch struct {
+	Participant string `json:"participant"`
+	Txn         string `json:"txn"`
+}
+
+const (
+	statePrepare = "prepare" // undecided, presumed abort
+	stateCommit  = "commit"  // decided, every branch must commit
+	stateDone    = "done"    // every branch took the decision
+)
+
+// record is a line of the coordinator log
+type record struct {
+	Gid      string   `json:"gid"`
+	State    string   `json:"state"`
+	Branches []Branch `json:"branches,omitempty"`
+}
+
+// Coordinator runs two-phase commits over participants. Its log keeps the
+// branches of a global txn before the prepares and the commit decision
+// before the commits, so after a crash Recover commits decided txns and
+// aborts undecided ones, both of which may have prepared branches.
+type Coordinator struct {
+	guard       *sync.Mutex
+	file        *os.File
+	participant func(name string) (Participant, error)
+	pending     map[string]record // logged and not done
+	inflight    map[string]bool   // gids Commit is working on, recovery skips them
+	stop        chan struct{}
+}
+
+// NewCoordinator replays and compacts the log at path, then resolves the
+// pending txns in the background until they are done.
+func NewCoordinator(path string, participant func(name string) (Participant, error)) (*Coordinator, error) {
+	c := &Coordinator{
+		guard:       &sync.Mutex{},
+		participant: participant,
+		pending:     make(map[string]record),
+		inflight:    make(map[string]bool),
+		stop:        make(chan struct{}),
+	}
+	if err := c.load(path); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	c.file = f
+	if len(c.pending) > 0 {
+		log.Warningf("2pc coordinator has %v in-doubt txns to resolve", len(c.pending))
+	}
+	go c.recoverLoop()
+	return c, nil
+}
+
+func (c *Coordinator) load(path string) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var rec record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			log.Warningf("2pc log %v: skip torn record: %v", path, err)
+			continue
+		}
+		c.apply(rec)
+	}
+	f.Close()
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	data := make([]byte, 0)
+	for _, rec := range c.pending {
+		line, _ := json.Marshal(rec)
+		data = append(append(data, line...), '\n')
+	}
+	return base.WriteFile(path, data)
+}
+
+// apply updates pending with rec, the caller holds guard
+func (c *Coordinator) apply(rec record) {
+	if rec.State == stateDone {
+		delete(c.pending, rec.Gid)
+		return
+	}
+	if rec.Branches == nil {
+		rec.Branches = c.pending[rec.Gid].Branches
+	}
+	c.pending[rec.Gid] = rec
+}
+
+func (c *Coordinator) log(rec record) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	c.guard.Lock()
+	defer c.guard.Unlock()
+	if _, err := c.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if base.GetConfig().Fsync == base.FsyncAlways {
+		if err := c.file.Sync(); err != nil {
+			return err
+		}
+	}
+	c.apply(rec)
+	return nil
+}
+
+// Commit prepares every branch and commits them if all prepared, otherwise
+// aborts them and returns an error wrapping ErrAborted. Once the decision is
+// logged the txn is committed, branches that miss it are retried in the
+// background.
+func (c *Coordinator) Commit(ctx context.Context, gid string, branches []Branch) error {
+	c.guard.Lock()
+	c.inflight[gid] = true
+	c.guard.Unlock()
+	defer func() {
+		c.guard.Lock()
+		delete(c.inflight, gid)
+		c.guard.Unlock()
+	}()
+
+	if err := c.log(record{gid, statePrepare, branches}); err != nil {
+		return err
+	}
+	for _, b := range branches {
+		p, err := c.participant(b.Participant)
+		if err == nil {
+			err = p.Prepare(ctx, b.Txn)
+		}
+		if err != nil {
+			if err := c.finish(ctx, gid, false, branches); err != nil {
+				log.Warningf("2pc %v abort: %v, recovery retries", gid, err)
+			}
+			return fmt.Errorf("%w, prepare on %v: %v", ErrAborted, b.Participant, err)
+		}
+	}
+	if err := c.log(record{gid, stateCommit, nil}); err != nil {
+		return err
+	}
+	if err := c.finish(ctx, gid, true, branches); err != nil {
+		log.Warningf("2pc %v commit: %v, recovery retries", gid, err)
+	}
+	return nil
+}
+
+// finish sends the decision to every branch and logs the txn done once all took it
+func (c *Coordinator) finish(ctx context.Context, gid string, commit bool, branches []Branch) error {
+	var firstErr error
+	for _, b := range branches {
+		p, err := c.participant(b.Participant)
+		if err == nil {
+			if commit {
+				err = p.Commit(ctx, b.Txn)
+			} else {
+				err = p.Abort(ctx, b.Txn)
+			}
+		}
+		if err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("%v on %v: %v", gid, b.Participant, err)
+		}
+	}
+	if firstErr != nil {
+		return firstErr
+	}
+	return c.log(record{Gid: gid, State: stateDone})
+}
+
+// Recover commits the decided pending txns and aborts the undecided ones
+func (c *Coordinator) Recover(ctx context.Context) error {
+	c.guard.Lock()
+	todo := make([]record, 0, len(c.pending))
+	for gid, rec := range c.pending {
+		if !c.inflight[gid] {
+			todo = append(todo, rec)
+		}
+	}
+	c.guard.Unlock()
+
+	var firstErr error
+	for _, rec := range todo {
+		err := c.finish(ctx, rec.Gid, rec.State == stateCommit, rec.Branches)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		} else if err == nil {
+			log.Infof("2pc %v resolved, commit: %v", rec.Gid, rec.State == stateCommit)
+		}
+	}
+	return firstErr
+}
+
+// Pending is how many logged txns are not done
+func (c *Coordinator) Pending() int {
+	c.guard.Lock()
+	defer c.guard.Unlock()
+	n := 0
+	for gid := range c.pending {
+		if !c.inflight[gid] {
+			n++
+		}
+	}
+	return n
+}
+
+func (c *Coordinator) recoverLoop() {
+	ticker := time.NewTicker(recoverInterval)
+	defer ticker.Stop()
+	for {
+		if c.Pending() > 0 {
+			if err := c.Recover(context.Background()); err != nil {
+				log.Warning("2pc recover: ", err)
+			}
+		}
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *Coordinator) Close() error {
+	close(c.stop)
+	return c.file.Close()
+}
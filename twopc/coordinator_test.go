@@ -0,0 +1,224 @@
+package twopc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"stupid-kv/base"
+	"stupid-kv/testutil"
+	"sync"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	testutil.Main(m)
+}
+
+// fakeParticipant counts the calls per txn and fails the ones set to
+type fakeParticipant struct {
+	guard      sync.Mutex
+	prepareErr error
+	commitErr  error
+	prepared   map[string]int
+	committed  map[string]int
+	aborted    map[string]int
+}
+
+func newFakeParticipant() *fakeParticipant {
+	return &fakeParticipant{
+		prepared:  make(map[string]int),
+		committed: make(map[string]int),
+		aborted:   make(map[string]int),
+	}
+}
+
+func (p *fakeParticipant) Prepare(ctx context.Context, txn string) error {
+	p.guard.Lock()
+	defer p.guard.Unlock()
+	if p.prepareErr != nil {
+		return p.prepareErr
+	}
+	p.prepared[txn]++
+	return nil
+}
+
+func (p *fakeParticipant) Commit(ctx context.Context, txn string) error {
+	p.guard.Lock()
+	defer p.guard.Unlock()
+	if p.commitErr != nil {
+		return p.commitErr
+	}
+	p.committed[txn]++
+	return nil
+}
+
+func (p *fakeParticipant) Abort(ctx context.Context, txn string) error {
+	p.guard.Lock()
+	defer p.guard.Unlock()
+	p.aborted[txn]++
+	return nil
+}
+
+func (p *fakeParticipant) set(fn func()) {
+	p.guard.Lock()
+	defer p.guard.Unlock()
+	fn()
+}
+
+// counts returns how often txn prepared, committed and aborted
+func (p *fakeParticipant) counts(txn string) (int, int, int) {
+	p.guard.Lock()
+	defer p.guard.Unlock()
+	return p.prepared[txn], p.committed[txn], p.aborted[txn]
+}
+
+// cluster is the participants a coordinator of a test reaches, by name
+type cluster map[string]*fakeParticipant
+
+func newCluster(names ...string) cluster {
+	c := make(cluster)
+	for _, name := range names {
+		c[name] = newFakeParticipant()
+	}
+	return c
+}
+
+func (c cluster) participant(name string) (Participant, error) {
+	p, ok := c[name]
+	if !ok {
+		return nil, fmt.Errorf("participant %v is down", name)
+	}
+	return p, nil
+}
+
+var branches = []Branch{{"a", "ta"}, {"b", "tb"}}
+
+func logPath(t *testing.T) string {
+	dir, err := ioutil.TempDir(base.GetConfig().DataDir, "log-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "2PC.log")
+}
+
+func open(t *testing.T, path string, c cluster) *Coordinator {
+	t.Helper()
+	coordinator, err := NewCoordinator(path, c.participant)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return coordinator
+}
+
+// expect checks the calls a participant got for txn
+func expect(t *testing.T, p *fakeParticipant, txn string, prepared, committed, aborted int) {
+	t.Helper()
+	if p, c, a := p.counts(txn); p != prepared || c != committed || a != aborted {
+		t.Fatalf("%v prepared %v committed %v aborted %v, want %v %v %v", txn, p, c, a, prepared, committed, aborted)
+	}
+}
+
+func TestCommit(t *testing.T) {
+	path, c := logPath(t), newCluster("a", "b")
+	coordinator := open(t, path, c)
+	if err := coordinator.Commit(context.Background(), "g1", branches); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, c["a"], "ta", 1, 1, 0)
+	expect(t, c["b"], "tb", 1, 1, 0)
+	if n := coordinator.Pending(); n != 0 {
+		t.Fatalf("%v pending, want 0", n)
+	}
+	coordinator.Close()
+
+	coordinator = open(t, path, c)
+	defer coordinator.Close()
+	if n := coordinator.Pending(); n != 0 {
+		t.Fatalf("%v pending after reopen, want 0", n)
+	}
+}
+
+func TestPrepareFailure(t *testing.T) {
+	path, c := logPath(t), newCluster("a", "b")
+	c["b"].prepareErr = errors.New("no vote")
+	coordinator := open(t, path, c)
+	defer coordinator.Close()
+	if err := coordinator.Commit(context.Background(), "g1", branches); !errors.Is(err, ErrAborted) {
+		t.Fatalf("commit: %v, want aborted", err)
+	}
+	expect(t, c["a"], "ta", 1, 0, 1)
+	expect(t, c["b"], "tb", 0, 0, 1)
+	if n := coordinator.Pending(); n != 0 {
+		t.Fatalf("%v pending, want 0", n)
+	}
+}
+
+func TestParticipantDown(t *testing.T) {
+	path, c := logPath(t), newCluster("a")
+	coordinator := open(t, path, c)
+	defer coordinator.Close()
+	if err := coordinator.Commit(context.Background(), "g1", branches); !errors.Is(err, ErrAborted) {
+		t.Fatalf("commit: %v, want aborted", err)
+	}
+	expect(t, c["a"], "ta", 1, 0, 1)
+	// the abort of the branch on b is retried until b is back
+	if n := coordinator.Pending(); n != 1 {
+		t.Fatalf("%v pending, want 1", n)
+	}
+}
+
+func TestCrashAfterDecision(t *testing.T) {
+	path, c := logPath(t), newCluster("a", "b")
+	c["b"].commitErr = errors.New("connection reset")
+	coordinator := open(t, path, c)
+	// the decision is logged, so the txn committed though b missed it
+	if err := coordinator.Commit(context.Background(), "g1", branches); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, c["b"], "tb", 1, 0, 0)
+	if n := coordinator.Pending(); n != 1 {
+		t.Fatalf("%v pending, want 1", n)
+	}
+	coordinator.Close()
+
+	c["b"].set(func() { c["b"].commitErr = nil })
+	coordinator = open(t, path, c)
+	defer coordinator.Close()
+	if err := coordinator.Recover(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, committed, aborted := c["b"].counts("tb"); committed == 0 || aborted != 0 {
+		t.Fatalf("tb committed %v aborted %v after recover, want a commit", committed, aborted)
+	}
+	if n := coordinator.Pending(); n != 0 {
+		t.Fatalf("%v pending after recover, want 0", n)
+	}
+}
+
+func TestPresumedAbort(t *testing.T) {
+	path, c := logPath(t), newCluster("a", "b")
+	// the coordinator crashed after logging the branches, before the decision
+	line, err := json.Marshal(record{"g1", statePrepare, branches})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, append(line, '\n'), 0644); err != nil {
+		t.Fatal(err)
+	}
+	coordinator := open(t, path, c)
+	defer coordinator.Close()
+	if err := coordinator.Recover(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for name, txn := range map[string]string{"a": "ta", "b": "tb"} {
+		if _, committed, aborted := c[name].counts(txn); committed != 0 || aborted == 0 {
+			t.Fatalf("%v committed %v aborted %v, want an abort", txn, committed, aborted)
+		}
+	}
+	if n := coordinator.Pending(); n != 0 {
+		t.Fatalf("%v pending after recover, want 0", n)
+	}
+}
@@ -3,6 +3,7 @@ package txn
 import (
 	"stupid-kv/base"
 	"sync"
+	"time"
 )
 
 //type Manager struct {
@@ -29,17 +30,62 @@ import (
 //	}
 //}
 //
-func (m *Manager) acquireWriteLock(key base.KeyT, tid base.Tid) {
-	tmp, _ := m.tid2writeSet.Load(tid)
+
+// keyLock is a mutex that can be acquired with a timeout
+type keyLock chan struct{}
+
+func (m *Manager) acquireWriteLock(key base.KeyT, tid base.Tid) error {
+	tmp, ok := m.tid2writeSet.Load(tid)
+	if !ok {
+		return ErrorTxnNotExist
+	}
+	if m.IsPrepared(tid) {
+		return ErrorTxnPrepared
+	}
 	ws := tmp.(*sync.Map)
-	if _, ok := ws.Load(key); !ok {
-		ws.Store(key, 1)
-		if _, ok := m.key2lock.Load(key); !ok {
-			m.key2lock.Store(key, &sync.RWMutex{})
+	if _, ok := ws.Load(key); ok {
+		return nil
+	}
+	if m.replicator != nil {
+		if err := m.replicator.Writable(); err != nil {
+			return err
 		}
-		rw, _ := m.key2lock.Load(key)
-		rw.(*sync.RWMutex).Lock()
 	}
+	tmp, _ = m.key2lock.LoadOrStore(key, make(keyLock, 1))
+	lock := tmp.(keyLock)
+	defer m.observeLockWait(tid, m.startLockWait(tid, key))
+	if err := waitLock(lock); err != nil {
+		return err
+	}
+	ws.Store(key, 1)
+	return nil
+}
+
+// waitLock acquires lock, giving up after lock_timeout
+func waitLock(lock keyLock) error {
+	if timeout := base.GetConfig().LockTimeout; timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case lock <- struct{}{}:
+		case <-timer.C:
+			return ErrorLockTimeout
+		}
+	} else {
+		lock <- struct{}{}
+	}
+	return nil
+}
+
+// lockKey takes the write lock of key outside of a txn, after the txn holding
+// it ends. It returns the release of the lock.
+func (m *Manager) lockKey(key base.KeyT) (func(), error) {
+	tmp, _ := m.key2lock.LoadOrStore(key, make(keyLock, 1))
+	lock := tmp.(keyLock)
+	if err := waitLock(lock); err != nil {
+		return nil, err
+	}
+	return func() { <-lock }, nil
 }
 
 //
@@ -50,7 +96,7 @@ func (m *Manager) acquireWriteLock(key base.KeyT, tid base.Tid) {
 //}
 //
 func (m *Manager) releaseWriteLock(key base.KeyT, tid base.Tid) {
-	if rw, ok := m.key2lock.Load(key); ok {
-		rw.(*sync.RWMutex).Unlock()
+	if lock, ok := m.key2lock.Load(key); ok {
+		<-lock.(keyLock)
 	}
 }
@@ -0,0 +1,109 @@
+package txn
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"stupid-kv/base"
+	"stupid-kv/kv"
+	log "stupid-kv/logutil"
+)
+
+// A backup is a header followed by the chains in the kv data file format,
+// one version per key:
+//
+//	magic "stkvbkup" | tid i64 | n u32 | n open tids i64 | crc32c of the bytes before u32
+const backupMagic = "stkvbkup"
+
+// maxBackupOpen caps the open tids a header may claim before its crc is checked
+const maxBackupOpen = 1 << 20
+
+var ErrBadBackup = errors.New("txn: not a stupid-kv backup")
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// Backup writes the latest value of every key as of a new tid to w and
+// returns the tid. The backup reads like a txn: it waits for values of
+// earlier txns that are not committed yet, but writers never wait for it,
+// and its tid holds back gc until it is done. It holds every txn with a
+// lower tid that committed before it began and none with a higher one. A
+// txn with a lower tid still open then may commit writes the backup missed,
+// so the header keeps those tids for the cdc log replay.
+func (m *Manager) Backup(w io.Writer) (base.Tid, error) {
+	tid := m.BeginTxn()
+	defer m.AbortTxn(tid)
+	open := make([]base.Tid, 0)
+	for _, active := range m.activeTids() {
+		if active < tid {
+			open = append(open, active)
+		}
+	}
+
+	header := make([]byte, 20+8*len(open), 24+8*len(open))
+	copy(header, backupMagic)
+	binary.LittleEndian.PutUint64(header[8:], uint64(tid))
+	binary.LittleEndian.PutUint32(header[16:], uint32(len(open)))
+	for i, active := range open {
+		binary.LittleEndian.PutUint64(header[20+8*i:], uint64(active))
+	}
+	header = header[:len(header)+4]
+	binary.LittleEndian.PutUint32(header[len(header)-4:], crc32.Checksum(header[:len(header)-4], castagnoli))
+	if _, err := w.Write(header); err != nil {
+		return tid, err
+	}
+	d, err := kv.NewDataWriter(w)
+	if err != nil {
+		return tid, err
+	}
+	keys := 0
+	for _, key := range kv.GetManagerInstance().Keys("", "") {
+		value, begin := m.getVersion(key, tid)
+		if value == base.VALUE_NOT_FOUND || value == base.VALUE_NOT_VALID {
+			continue
+		}
+		version := kv.Version{Value: value, Begin: begin, End: base.MAX_TID}
+		if err := d.Add(key, kv.NewValueSlot([]kv.Version{version})); err != nil {
+			return tid, err
+		}
+		keys++
+	}
+	if err := d.Close(); err != nil {
+		return tid, err
+	}
+	log.Infof("backup of %v keys at tid %v, %v lower tids open", keys, tid, len(open))
+	return tid, nil
+}
+
+// Restore replaces the whole store with a Backup and returns its tid and the
+// lower tids open when it began. Replaying the txns after it takes the ones
+// with a higher tid and those. The tids of later txns start after it, so
+// they see the restored values.
+func (m *Manager) Restore(r io.Reader) (base.Tid, []base.Tid, error) {
+	header := make([]byte, 20)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, ErrBadBackup
+	}
+	n := binary.LittleEndian.Uint32(header[16:])
+	if string(header[:8]) != backupMagic || n > maxBackupOpen {
+		return 0, nil, ErrBadBackup
+	}
+	header = append(header, make([]byte, 8*n+4)...)
+	if _, err := io.ReadFull(r, header[20:]); err != nil {
+		return 0, nil, ErrBadBackup
+	}
+	if binary.LittleEndian.Uint32(header[len(header)-4:]) != crc32.Checksum(header[:len(header)-4], castagnoli) {
+		return 0, nil, ErrBadBackup
+	}
+	tid := base.Tid(binary.LittleEndian.Uint64(header[8:]))
+	open := make([]base.Tid, n)
+	for i := range open {
+		open[i] = base.Tid(binary.LittleEndian.Uint64(header[20+8*i:]))
+	}
+	if err := kv.GetManagerInstance().Restore(r); err != nil {
+		return tid, open, err
+	}
+	m.AdvanceTid(tid)
+	log.Infof("restore backup at tid %v", tid)
+	return tid, open, nil
+}
@@ -4,4 +4,9 @@ import "errors"
 
 var (
 	ErrorWriteOlderVersion = errors.New("txn try to append older version to chain")
+	ErrorTxnNotExist       = errors.New("txn not exist")
+	ErrorKeyNotFound       = errors.New("txn inc or dec a key not found")
+	ErrorLockTimeout       = errors.New("txn wait for write lock timeout")
+	ErrorTxnPrepared       = errors.New("txn is prepared and can only commit or abort")
+	ErrorOutcomeUnknown    = errors.New("txn outcome unknown, it commits if the replicated log has it")
 )
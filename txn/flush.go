@@ -3,39 +3,63 @@ package txn
 import (
 	"fmt"
 	"io/ioutil"
-	"os"
 	"strconv"
 	"strings"
 	"stupid-kv/base"
 	log "stupid-kv/logutil"
 )
 
-func (m *Manager) FlushTid() {
-	//m.flushGuard.Lock()
-	//defer m.flushGuard.Unlock()
-	f, err := os.Create("STATE.txt") // creating...
+// State is what STATE.txt holds: the next tid on the first line, the
+// active tids on the second
+type State struct {
+	CurTid     base.Tid
+	ActiveTids []base.Tid
+}
+
+// ReadState parses STATE.txt strictly, for tools that check the data dir
+func ReadState() (State, error) {
+	state := State{ActiveTids: make([]base.Tid, 0)}
+	b, err := ioutil.ReadFile(base.DataPath("STATE.txt"))
 	if err != nil {
-		log.Error("error create STATE.txt")
-		return
+		return state, err
 	}
-	defer f.Close()
-
-	_, err = f.WriteString(fmt.Sprintf("%d\n", m.curTid))
+	lines := strings.Split(string(b), "\n")
+	n, err := strconv.Atoi(lines[0])
 	if err != nil {
-		log.Error("error write STATE.txt")
+		return state, fmt.Errorf("bad current tid: %v", err)
 	}
-
-	for i := 0; i < len(m.curActiveTids); i++ { // Generating...
-		_, err = f.WriteString(fmt.Sprintf("%d ", m.curActiveTids[i])) // writing...
-		if err != nil {
-			fmt.Printf("error writing string: %v", err)
+	state.CurTid = base.Tid(n)
+	if len(lines) >= 2 {
+		for _, field := range strings.Fields(lines[1]) {
+			tid, err := strconv.Atoi(field)
+			if err != nil {
+				return state, fmt.Errorf("bad active tid: %v", err)
+			}
+			state.ActiveTids = append(state.ActiveTids, base.Tid(tid))
 		}
 	}
+	return state, nil
+}
 
+func WriteState(state State) error {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("%d\n", state.CurTid))
+	for i := 0; i < len(state.ActiveTids); i++ { // Generating...
+		sb.WriteString(fmt.Sprintf("%d ", state.ActiveTids[i]))
+	}
+	return base.WriteFile(base.DataPath("STATE.txt"), []byte(sb.String()))
+}
+
+func (m *Manager) FlushTid() {
+	//m.flushGuard.Lock()
+	//defer m.flushGuard.Unlock()
+	if err := WriteState(State{m.curTid, m.curActiveTids}); err != nil {
+		log.Error("error write STATE.txt: ", err)
+	}
 }
 
 func (m *Manager) Load() {
-	b, err := ioutil.ReadFile("STATE.txt")
+	b, err := ioutil.ReadFile(base.DataPath("STATE.txt"))
 	if err != nil {
 		log.Warning("no STATE.txt")
 		return
@@ -45,10 +69,13 @@ func (m *Manager) Load() {
 	n, err := strconv.Atoi(lines[0])
 	m.curTid = base.Tid(n)
 
-	if len(lines) == 2 {
-		//tmp := strings.Trim(lines[1], " ")
-		//activeTids := strings.Fields(tmp)
-		// TODO: Undo log
+	if len(lines) >= 2 {
+		// txns still active at the last flush never committed, recover rolls them back
+		for _, field := range strings.Fields(lines[1]) {
+			if tid, err := strconv.Atoi(field); err == nil {
+				m.curActiveTids = append(m.curActiveTids, base.Tid(tid))
+			}
+		}
 	}
 	//for _, l := range lines {
 	//	// Empty line occurs at the end of the file when we use Split.
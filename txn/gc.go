@@ -0,0 +1,32 @@
+package txn
+
+import (
+	"stupid-kv/kv"
+	log "stupid-kv/logutil"
+	"time"
+)
+
+// gcLoop periodically drops mvcc versions no active or future txn can read.
+func (m *Manager) gcLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+		}
+		m.tidsGuard.Lock()
+		watermark := m.curTid
+		for _, tid := range m.curActiveTids {
+			if tid < watermark {
+				watermark = tid
+			}
+		}
+		m.tidsGuard.Unlock()
+
+		if removed := kv.GetManagerInstance().GC(watermark); removed > 0 {
+			log.Infof("gc removes %v versions below tid %v", removed, watermark)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package txn
+
+import (
+	"sort"
+	"stupid-kv/base"
+	"stupid-kv/kv"
+	log "stupid-kv/logutil"
+)
+
+// ImportVersions replaces the versions of key under its write lock. The tids
+// of versions come from elsewhere, e.g. another shard, so they are re-stamped
+// with new tids of this manager in the same order.
+func (m *Manager) ImportVersions(key base.KeyT, versions []kv.Version) error {
+	release, err := m.lockKey(key)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	old := make([]base.Tid, 0, 2*len(versions))
+	for _, v := range versions {
+		old = append(old, v.Begin)
+		if v.End != base.MAX_TID {
+			old = append(old, v.End)
+		}
+	}
+	sort.Slice(old, func(i, j int) bool { return old[i] < old[j] })
+	distinct := 0
+	for i := range old {
+		if i == 0 || old[i] != old[i-1] {
+			distinct++
+		}
+	}
+	stamps := make(map[base.Tid]base.Tid, distinct)
+	next := m.reserveTids(distinct)
+	for i, tid := range old {
+		if i == 0 || tid != old[i-1] {
+			stamps[tid] = next
+			next++
+		}
+	}
+
+	restamped := make([]kv.Version, 0, len(versions))
+	for _, v := range versions {
+		v.Begin = stamps[v.Begin]
+		if v.End != base.MAX_TID {
+			v.End = stamps[v.End]
+		}
+		restamped = append(restamped, v)
+	}
+	kvStore := kv.GetManagerInstance()
+	kvStore.Ingest(key, restamped)
+	kvStore.Flush()
+	log.With("key", key, "versions", len(versions)).Info("import versions")
+	return nil
+}
+
+// DropKey removes key with all its versions under its write lock, returns
+// false if there was none
+func (m *Manager) DropKey(key base.KeyT) (bool, error) {
+	release, err := m.lockKey(key)
+	if err != nil {
+		return false, err
+	}
+	defer release()
+	kvStore := kv.GetManagerInstance()
+	dropped := kvStore.Drop(key)
+	kvStore.Flush()
+	return dropped, nil
+}
+
+// reserveTids takes n new tids no txn will get, returns the first
+func (m *Manager) reserveTids(n int) base.Tid {
+	m.tidsGuard.Lock()
+	defer m.tidsGuard.Unlock()
+	first := m.curTid
+	m.curTid += base.Tid(n)
+	m.FlushTid()
+	return first
+}
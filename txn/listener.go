@@ -0,0 +1,70 @@
+package txn
+
+import (
+	"sort"
+	"stupid-kv/base"
+	"stupid-kv/kv"
+)
+
+// Write is a key written by a committed txn, Value is VALUE_NOT_FOUND for a delete.
+// Old is the committed value tid overwrote, VALUE_NOT_FOUND if there was none,
+// it is only known to the node that ran the txn and is not replicated.
+type Write struct {
+	Key   base.KeyT
+	Value base.ValueT
+	Old   base.ValueT `json:"-"`
+}
+
+// CommitListener is called after a txn commits, with its writes in key order.
+type CommitListener func(tid base.Tid, writes []Write)
+
+// AddCommitListener registers l and returns an id for RemoveCommitListener.
+func (m *Manager) AddCommitListener(l CommitListener) int {
+	m.listenersGuard.Lock()
+	defer m.listenersGuard.Unlock()
+	m.nextListenerId++
+	m.listeners[m.nextListenerId] = l
+	return m.nextListenerId
+}
+
+func (m *Manager) RemoveCommitListener(id int) {
+	m.listenersGuard.Lock()
+	defer m.listenersGuard.Unlock()
+	delete(m.listeners, id)
+}
+
+// writesOf returns the keys of the write set that tid actually wrote in key
+// order, the write set also holds keys whose inc/dec failed.
+func (m *Manager) writesOf(tid base.Tid, keys []base.KeyT) []Write {
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	writes := make([]Write, 0, len(keys))
+	for _, key := range keys {
+		if value, beginTid := kv.GetManagerInstance().Get(key, tid, nil); beginTid == tid {
+			writes = append(writes, Write{key, value, oldValue(key, tid)})
+		}
+	}
+	return writes
+}
+
+// oldValue is the version before the one of tid, tid is still active so gc
+// has not dropped it.
+func oldValue(key base.KeyT, tid base.Tid) base.ValueT {
+	history := kv.GetManagerInstance().History(key)
+	for i := len(history) - 1; i > 0; i-- {
+		if history[i].Begin == tid {
+			return history[i-1].Value
+		}
+	}
+	return base.VALUE_NOT_FOUND
+}
+
+func (m *Manager) notifyCommit(tid base.Tid, writes []Write) {
+	m.listenersGuard.Lock()
+	defer m.listenersGuard.Unlock()
+	if len(writes) == 0 {
+		return
+	}
+	for _, l := range m.listeners {
+		l(tid, writes)
+	}
+}
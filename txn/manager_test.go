@@ -0,0 +1,242 @@
+package txn_test
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"stupid-kv/base"
+	_ "stupid-kv/btree"
+	"stupid-kv/kv"
+	log "stupid-kv/logutil"
+	_ "stupid-kv/lsm"
+	"stupid-kv/testutil"
+	"stupid-kv/txn"
+	"testing"
+)
+
+// the managers and their engines are process singletons, so every phase of
+// a case runs in a child process on the data dir of the case
+const phaseEnv = "STUPIDKV_TEST_PHASE"
+
+type step func(t *testing.T, m *txn.Manager)
+
+// every case runs its phases in order over each engine, a phase ends like a
+// crash: open txns stay in STATE.txt for the next phase to recover
+var managerCases = []struct {
+	name   string
+	phases []step
+}{
+	{"commit", []step{
+		func(t *testing.T, m *txn.Manager) {
+			tid := m.BeginTxn()
+			testutil.MustDo(t, m.Put("a", 1, tid))
+			testutil.MustDo(t, m.Put("b", 2, tid))
+			testutil.MustDo(t, m.Inc("a", tid))
+			expect(t, m, "a", 2, tid)
+			testutil.MustDo(t, m.CommitTxn(tid))
+			testutil.ExpectCommitted(t, "a", 2)
+			testutil.ExpectCommitted(t, "b", 2)
+		},
+		func(t *testing.T, m *txn.Manager) {
+			testutil.ExpectCommitted(t, "a", 2)
+			testutil.ExpectCommitted(t, "b", 2)
+		},
+	}},
+	{"abort", []step{
+		func(t *testing.T, m *txn.Manager) {
+			tid := m.BeginTxn()
+			testutil.MustDo(t, m.Put("a", 1, tid))
+			testutil.MustDo(t, m.CommitTxn(tid))
+			tid = m.BeginTxn()
+			testutil.MustDo(t, m.Put("a", 10, tid))
+			testutil.MustDo(t, m.Del("a", tid))
+			testutil.MustDo(t, m.Put("b", 20, tid))
+			testutil.MustDo(t, m.AbortTxn(tid))
+			testutil.ExpectCommitted(t, "a", 1)
+			testutil.ExpectCommitted(t, "b", base.VALUE_NOT_FOUND)
+		},
+		func(t *testing.T, m *txn.Manager) {
+			testutil.ExpectCommitted(t, "a", 1)
+			testutil.ExpectCommitted(t, "b", base.VALUE_NOT_FOUND)
+		},
+	}},
+	{"delete", []step{
+		func(t *testing.T, m *txn.Manager) {
+			tid := m.BeginTxn()
+			testutil.MustDo(t, m.Put("a", 1, tid))
+			testutil.MustDo(t, m.CommitTxn(tid))
+			tid = m.BeginTxn()
+			testutil.MustDo(t, m.Del("a", tid))
+			expect(t, m, "a", base.VALUE_NOT_FOUND, tid)
+			testutil.MustDo(t, m.CommitTxn(tid))
+		},
+		func(t *testing.T, m *txn.Manager) {
+			testutil.ExpectCommitted(t, "a", base.VALUE_NOT_FOUND)
+		},
+	}},
+	{"recover", []step{
+		func(t *testing.T, m *txn.Manager) {
+			tid := m.BeginTxn()
+			testutil.MustDo(t, m.Put("a", 1, tid))
+			testutil.MustDo(t, m.CommitTxn(tid))
+			open := m.BeginTxn()
+			testutil.MustDo(t, m.Put("a", 10, open))
+			testutil.MustDo(t, m.Put("c", 30, open))
+			// the commit flushes the versions of the open txn along with its own
+			tid = m.BeginTxn()
+			testutil.MustDo(t, m.Put("d", 4, tid))
+			testutil.MustDo(t, m.CommitTxn(tid))
+		},
+		func(t *testing.T, m *txn.Manager) {
+			if report := m.Recovery(); len(report.Tids) != 1 {
+				t.Fatalf("recovered txns %v, want the one left open", report.Tids)
+			}
+			testutil.ExpectCommitted(t, "a", 1)
+			testutil.ExpectCommitted(t, "c", base.VALUE_NOT_FOUND)
+			testutil.ExpectCommitted(t, "d", 4)
+			// tids go on after the recovered ones
+			tid := m.BeginTxn()
+			testutil.MustDo(t, m.Put("c", 3, tid))
+			testutil.MustDo(t, m.CommitTxn(tid))
+			testutil.ExpectCommitted(t, "c", 3)
+		},
+	}},
+	{"prepared", []step{
+		func(t *testing.T, m *txn.Manager) {
+			tid := m.BeginTxn()
+			testutil.MustDo(t, m.Put("a", 1, tid))
+			testutil.MustDo(t, m.Put("b", 2, tid))
+			testutil.MustDo(t, m.PrepareTxn(tid))
+		},
+		func(t *testing.T, m *txn.Manager) {
+			// PREPARED.json brings the txn back with its writes for the coordinator
+			tid := preparedTid(t, m)
+			expect(t, m, "a", 1, tid)
+			testutil.MustDo(t, m.CommitTxn(tid))
+			testutil.ExpectCommitted(t, "a", 1)
+			testutil.ExpectCommitted(t, "b", 2)
+		},
+		func(t *testing.T, m *txn.Manager) {
+			testutil.ExpectCommitted(t, "a", 1)
+			testutil.ExpectCommitted(t, "b", 2)
+			if records, err := txn.ReadPrepared(); err != nil || len(records) != 0 {
+				t.Fatalf("PREPARED.json keeps %v, %v after the commit", records, err)
+			}
+		},
+	}},
+	{"prepared-abort", []step{
+		func(t *testing.T, m *txn.Manager) {
+			tid := m.BeginTxn()
+			testutil.MustDo(t, m.Put("a", 1, tid))
+			testutil.MustDo(t, m.PrepareTxn(tid))
+		},
+		func(t *testing.T, m *txn.Manager) {
+			testutil.MustDo(t, m.AbortTxn(preparedTid(t, m)))
+			testutil.ExpectCommitted(t, "a", base.VALUE_NOT_FOUND)
+		},
+		func(t *testing.T, m *txn.Manager) {
+			testutil.ExpectCommitted(t, "a", base.VALUE_NOT_FOUND)
+		},
+	}},
+	{"import", []step{
+		func(t *testing.T, m *txn.Manager) {
+			tid := m.BeginTxn()
+			testutil.MustDo(t, m.Put("a", 1, tid))
+			testutil.MustDo(t, m.CommitTxn(tid))
+			// tids of another shard, below and above the local ones
+			from := m.Stats().CurTid
+			testutil.MustDo(t, m.ImportVersions("b", []kv.Version{
+				{Value: 1, Begin: 0, End: 900},
+				{Value: 2, Begin: 900, End: base.MAX_TID},
+			}))
+			history := kv.GetManagerInstance().History("b")
+			if len(history) != 2 || history[0].Value != 1 || history[1].Value != 2 {
+				t.Fatalf("imported history %v", history)
+			}
+			// new tids above the local ones, in the same order, the ends still meet
+			if history[0].Begin < from || history[0].End != history[1].Begin || history[1].Begin >= m.Stats().CurTid {
+				t.Fatalf("imported history %v, want tids in [%v, %v)", history, from, m.Stats().CurTid)
+			}
+			testutil.ExpectCommitted(t, "b", 2)
+		},
+		func(t *testing.T, m *txn.Manager) {
+			// tids go on after the imported ones
+			history := kv.GetManagerInstance().History("b")
+			if tid := m.BeginTxn(); tid <= history[1].Begin {
+				t.Fatalf("tid %v after a restart, want above the imported %v", tid, history[1].Begin)
+			}
+			testutil.ExpectCommitted(t, "b", 2)
+		},
+	}},
+}
+
+// preparedTid returns the single txn recovery found prepared
+func preparedTid(t *testing.T, m *txn.Manager) base.Tid {
+	t.Helper()
+	report := m.Recovery()
+	if len(report.Tids) != 1 || !m.IsPrepared(report.Tids[0]) {
+		t.Fatalf("recovered txns %v, want the prepared one", report.Tids)
+	}
+	return report.Tids[0]
+}
+
+func TestManager(t *testing.T) {
+	if phase := os.Getenv(phaseEnv); phase != "" {
+		runPhase(t, phase)
+		return
+	}
+	for _, engine := range []string{base.EngineMemory, base.EngineLSM, base.EngineBTree} {
+		for _, c := range managerCases {
+			engine, c := engine, c
+			t.Run(engine+"/"+c.name, func(t *testing.T) {
+				dir, err := ioutil.TempDir("", "stupid-kv-txn-")
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer os.RemoveAll(dir)
+				for i := range c.phases {
+					cmd := exec.Command(os.Args[0], "-test.run=^TestManager$")
+					cmd.Env = append(os.Environ(),
+						phaseEnv+"="+c.name+"/"+strconv.Itoa(i),
+						"STUPIDKV_DATA_DIR="+dir,
+						"STUPIDKV_STORAGE_ENGINE="+engine,
+						// the shortest threshold and interval keep the loops busy
+						"STUPIDKV_SLOW_TXN_THRESHOLD=1ns",
+						"STUPIDKV_GC_INTERVAL=1ms")
+					if out, err := cmd.CombinedOutput(); err != nil {
+						t.Fatalf("phase %v: %v\n%s", i, err, out)
+					}
+				}
+			})
+		}
+	}
+}
+
+// runPhase runs one phase of a case in this child process
+func runPhase(t *testing.T, phase string) {
+	cfg, err := base.LoadConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	base.SetConfig(cfg)
+	log.SetLevel(log.OffLevel)
+	for _, c := range managerCases {
+		for i, fn := range c.phases {
+			if phase == c.name+"/"+strconv.Itoa(i) {
+				m := txn.GetManagerInstance()
+				defer m.Stop()
+				fn(t, m)
+				return
+			}
+		}
+	}
+	t.Fatalf("unknown phase %v", phase)
+}
+
+func expect(t *testing.T, m *txn.Manager, key base.KeyT, want base.ValueT, tid base.Tid) {
+	t.Helper()
+	if got := m.Get(key, tid); got != want {
+		t.Fatalf("%v = %v at tid %v, want %v", key, got, tid, want)
+	}
+}
@@ -0,0 +1,31 @@
+package txn
+
+import (
+	"stupid-kv/metrics"
+)
+
+var (
+	txnBegins  = metrics.NewCounter("stupidkv_txn_begins_total", "Transactions begun.")
+	txnCommits = metrics.NewCounter("stupidkv_txn_commits_total", "Transactions committed.")
+	txnAborts  = metrics.NewCounter("stupidkv_txn_aborts_total", "Transactions aborted.")
+
+	opDuration = map[string]*metrics.Histogram{}
+
+	lockWait = metrics.NewHistogram("stupidkv_lock_wait_seconds",
+		"Time acquireWriteLock waited for the write lock of a key.", metrics.DurationBuckets)
+	uncommittedSpins = metrics.NewHistogram("stupidkv_uncommitted_wait_spins",
+		"Spin iterations of a read waiting for an uncommitted value.", metrics.ExpBuckets(1, 10, 7))
+)
+
+func init() {
+	for _, op := range []string{"get", "put", "inc", "dec", "del", "commit", "abort"} {
+		opDuration[op] = metrics.NewHistogram("stupidkv_txn_op_duration_seconds",
+			"Latency of txn.Manager operations, lock waits included.", metrics.DurationBuckets, "op", op)
+	}
+	metrics.NewGaugeFunc("stupidkv_active_txns", "Transactions begun and not committed or aborted.", func() float64 {
+		if instance == nil {
+			return 0
+		}
+		return float64(len(instance.activeTids()))
+	})
+}
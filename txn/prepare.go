@@ -0,0 +1,132 @@
+package txn
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"stupid-kv/base"
+	"stupid-kv/kv"
+	log "stupid-kv/logutil"
+	"sync"
+)
+
+// PrepareTxn is the first phase of a two-phase commit: tid can no longer write,
+// and its writes are persisted to PREPARED.json so a restart keeps the txn and
+// its write locks until the coordinator commits or aborts it.
+func (m *Manager) PrepareTxn(tid base.Tid) error {
+	ws, ok := m.tid2writeSet.Load(tid)
+	if !ok {
+		return ErrorTxnNotExist
+	}
+	keys := make([]base.KeyT, 0)
+	ws.(*sync.Map).Range(func(key, value interface{}) bool {
+		keys = append(keys, key.(base.KeyT))
+		return true
+	})
+
+	m.preparedGuard.Lock()
+	defer m.preparedGuard.Unlock()
+	m.prepared[tid] = m.writesOf(tid, keys)
+	if err := m.flushPrepared(); err != nil {
+		// the vote is not durable, the coordinator has to abort
+		delete(m.prepared, tid)
+		log.With("tid", tid, "err", err).Error("txn prepare error")
+		return err
+	}
+	log.With("tid", tid).Info("txn prepare")
+	return nil
+}
+
+func (m *Manager) IsPrepared(tid base.Tid) bool {
+	m.preparedGuard.Lock()
+	defer m.preparedGuard.Unlock()
+	_, ok := m.prepared[tid]
+	return ok
+}
+
+// unprepare runs before an abort removes tid from the active tids and after a
+// commit does, so loadPrepared tells a committed txn by it being inactive
+func (m *Manager) unprepare(tid base.Tid) {
+	m.preparedGuard.Lock()
+	defer m.preparedGuard.Unlock()
+	if _, ok := m.prepared[tid]; ok {
+		delete(m.prepared, tid)
+		if err := m.flushPrepared(); err != nil {
+			log.Error("error write PREPARED.json: ", err)
+		}
+	}
+}
+
+func (m *Manager) flushPrepared() error {
+	b, err := json.Marshal(m.prepared)
+	if err != nil {
+		return err
+	}
+	return base.WriteFile(base.DataPath("PREPARED.json"), b)
+}
+
+// loadPrepared runs after recover rolled back every active txn. A prepared
+// txn that was active begins again with its writes and locks, one that was
+// not had committed and its writes are redone if the store lacks them.
+func (m *Manager) loadPrepared() {
+	records, err := ReadPrepared()
+	if err != nil {
+		// dropping prepared txns would break the atomicity of their distributed txns
+		log.Fatal("load PREPARED.json error: ", err)
+	}
+	if len(records) == 0 {
+		return
+	}
+
+	kvStore := kv.GetManagerInstance()
+	for tid, writes := range records {
+		if !containsTid(m.recovery.Tids, tid) {
+			for _, w := range writes {
+				if history := kvStore.History(w.Key); len(history) == 0 || history[len(history)-1].Begin < tid {
+					kvStore.Put(w.Key, w.Value, tid)
+				}
+			}
+			continue
+		}
+		m.curActiveTids = append(m.curActiveTids, tid)
+		m.tid2writeSet.Store(tid, &sync.Map{})
+		m.startStat(tid)
+		for _, w := range writes {
+			if err := m.Put(w.Key, w.Value, tid); err != nil {
+				log.With("tid", tid, "key", w.Key, "err", err).Error("restore prepared txn error")
+			}
+		}
+		m.prepared[tid] = writes
+	}
+	m.FlushTid()
+	kvStore.Flush()
+	if err := m.flushPrepared(); err != nil {
+		log.Error("error write PREPARED.json: ", err)
+	}
+	if len(m.prepared) > 0 {
+		log.Warningf("%v prepared txns wait for their coordinator", len(m.prepared))
+	}
+}
+
+// ReadPrepared returns the writes of the txns in PREPARED.json, none if there
+// is no such file
+func ReadPrepared() (map[base.Tid][]Write, error) {
+	records := make(map[base.Tid][]Write)
+	b, err := ioutil.ReadFile(base.DataPath("PREPARED.json"))
+	if os.IsNotExist(err) {
+		return records, nil
+	} else if err != nil {
+		return records, err
+	}
+	err = json.Unmarshal(b, &records)
+	return records, err
+}
+
+func containsTid(tids []base.Tid, tid base.Tid) bool {
+	for _, t := range tids {
+		if t == tid {
+			return true
+		}
+	}
+	return false
+}
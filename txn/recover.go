@@ -0,0 +1,34 @@
+package txn
+
+import (
+	"stupid-kv/base"
+	"stupid-kv/kv"
+	log "stupid-kv/logutil"
+)
+
+// RecoveryReport tells what was rolled back when the manager started
+type RecoveryReport struct {
+	Tids     []base.Tid // txns active in STATE.txt, i.e. interrupted by a shutdown
+	Versions int        // versions they had flushed to the store
+}
+
+// recover rolls back the txns Load found active, their writes may have been
+// flushed along with the commit of another txn.
+func (m *Manager) recover() {
+	m.recovery = RecoveryReport{Tids: m.curActiveTids, Versions: 0}
+	if len(m.curActiveTids) == 0 {
+		return
+	}
+	kvStore := kv.GetManagerInstance()
+	for _, tid := range m.curActiveTids {
+		m.recovery.Versions += kvStore.RollbackTid(tid)
+	}
+	m.curActiveTids = make([]base.Tid, 0)
+	kvStore.Flush()
+	m.FlushTid()
+	log.Warningf("recover: rolled back %v versions of interrupted txns %v", m.recovery.Versions, m.recovery.Tids)
+}
+
+func (m *Manager) Recovery() RecoveryReport {
+	return m.recovery
+}
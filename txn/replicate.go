@@ -0,0 +1,132 @@
+package txn
+
+import (
+	"errors"
+	"stupid-kv/base"
+	"stupid-kv/kv"
+	log "stupid-kv/logutil"
+	"sync"
+)
+
+// Replicator copies the writes of committed txns to other nodes
+type Replicator interface {
+	// Writable returns an error if txns of this node must not write, the
+	// first write of each key checks it so a txn fails before it commits.
+	Writable() error
+	// Replicate runs before a txn with writes is marked committed, an error
+	// aborts the txn and is returned by CommitTxn. ErrorOutcomeUnknown leaves
+	// the txn in doubt instead, see ResolveInDoubt.
+	Replicate(tid base.Tid, writes []Write) error
+}
+
+// SetReplicator must be called before any txn begins
+func (m *Manager) SetReplicator(r Replicator) {
+	m.replicator = r
+}
+
+// AdvanceTid makes tids allocated later greater than tid, for writes that
+// were committed by another node.
+func (m *Manager) AdvanceTid(tid base.Tid) {
+	m.tidsGuard.Lock()
+	defer m.tidsGuard.Unlock()
+	if m.curTid <= tid {
+		m.curTid = tid + 1
+		m.FlushTid()
+	}
+}
+
+// replicaState is where the replication of a local txn is
+type replicaState int
+
+const (
+	replicating replicaState = iota // Replicate runs
+	inDoubt                         // Replicate could not tell if the log has it
+	logged                          // the log applied it while Replicate ran
+)
+
+// replicate runs Replicate for a commit of tid. An error aborts tid, unless
+// the outcome is unknown: then tid stays open with its locks until the log
+// applies it or ResolveInDoubt finds the log has not.
+func (m *Manager) replicate(tid base.Tid, writes []Write) error {
+	m.replicatingGuard.Lock()
+	m.replicating[tid] = replicating
+	m.replicatingGuard.Unlock()
+
+	err := m.replicator.Replicate(tid, writes)
+
+	m.replicatingGuard.Lock()
+	defer m.replicatingGuard.Unlock()
+	switch {
+	case err == nil || m.replicating[tid] == logged:
+		delete(m.replicating, tid)
+		return nil
+	case errors.Is(err, ErrorOutcomeUnknown):
+		m.replicating[tid] = inDoubt
+		log.With("tid", tid, "err", err).Warning("txn replicate outcome unknown, the log decides")
+		return err
+	default:
+		delete(m.replicating, tid)
+		log.With("tid", tid, "err", err).Warning("txn replicate error, abort")
+		if ws, ok := m.tid2writeSet.Load(tid); ok {
+			m.abort(tid, ws.(*sync.Map))
+		}
+		return err
+	}
+}
+
+// InDoubt tells if the commit of tid is being replicated or waits for the
+// log to decide, tid must not be committed or aborted by the client then
+func (m *Manager) InDoubt(tid base.Tid) bool {
+	m.replicatingGuard.Lock()
+	defer m.replicatingGuard.Unlock()
+	_, ok := m.replicating[tid]
+	return ok
+}
+
+// ResolveInDoubt ends tid once the log decided, it commits tid if the log
+// has it and aborts it otherwise. It returns false if tid is not in doubt.
+func (m *Manager) ResolveInDoubt(tid base.Tid, committed bool) bool {
+	m.replicatingGuard.Lock()
+	defer m.replicatingGuard.Unlock()
+	if state, ok := m.replicating[tid]; !ok || state != inDoubt {
+		return false
+	}
+	delete(m.replicating, tid)
+	keys, ok := m.writeSetOf(tid)
+	if !ok {
+		return false
+	}
+	if committed {
+		m.finishCommit(tid, keys, m.writesOf(tid, keys))
+	} else if ws, ok := m.tid2writeSet.Load(tid); ok {
+		m.abort(tid, ws.(*sync.Map))
+	}
+	log.With("tid", tid, "committed", committed).Warning("txn in doubt resolved")
+	return true
+}
+
+// ApplyReplicated writes what tid committed on another node, or on this node
+// when tid is a local txn whose writes are here already: it returns true then
+// and commits tid if it was in doubt. The caller makes sure a commit is not
+// applied twice and flushes the store.
+func (m *Manager) ApplyReplicated(tid base.Tid, writes []Write) bool {
+	m.replicatingGuard.Lock()
+	if state, ok := m.replicating[tid]; ok {
+		if state == inDoubt {
+			m.replicatingGuard.Unlock()
+			m.ResolveInDoubt(tid, true)
+			return true
+		}
+		m.replicating[tid] = logged
+		m.replicatingGuard.Unlock()
+		return true
+	}
+	m.replicatingGuard.Unlock()
+
+	kvStore := kv.GetManagerInstance()
+	for _, w := range writes {
+		kvStore.Put(w.Key, w.Value, tid)
+	}
+	m.AdvanceTid(tid)
+	return false
+}
@@ -0,0 +1,25 @@
+package txn
+
+import (
+	"stupid-kv/base"
+	"stupid-kv/kv"
+)
+
+type KeyValue struct {
+	Key   base.KeyT
+	Value base.ValueT
+}
+
+// Scan reads the existing keys in [start, end) at tid in key order,
+// an empty end means no upper bound. Uncommitted values are waited for like Get.
+func (m *Manager) Scan(start base.KeyT, end base.KeyT, tid base.Tid) []KeyValue {
+	kvs := make([]KeyValue, 0)
+	for _, key := range kv.GetManagerInstance().Keys(start, end) {
+		value := m.Get(key, tid)
+		if value == base.VALUE_NOT_FOUND || value == base.VALUE_NOT_VALID {
+			continue
+		}
+		kvs = append(kvs, KeyValue{key, value})
+	}
+	return kvs
+}
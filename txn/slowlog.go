@@ -0,0 +1,140 @@
+package txn
+
+import (
+	"sort"
+	"stupid-kv/base"
+	log "stupid-kv/logutil"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// slowLockedKeys caps the locked keys a slow log record lists
+const slowLockedKeys = 16
+
+// minSlowTick bounds how often slowLoop looks for open txns
+const minSlowTick = 10 * time.Millisecond
+
+// txnStat is what the slow log reports of a txn
+type txnStat struct {
+	begin    time.Time
+	lockWait int64 // nanoseconds spent in acquireWriteLock
+	reported int32 // set once slowLoop logged the txn still open
+
+	waitGuard *sync.Mutex
+	waitKey   base.KeyT // the write lock waited for now, if waitStart is set
+	waitStart time.Time
+}
+
+func (m *Manager) startStat(tid base.Tid) {
+	m.tid2stat.Store(tid, &txnStat{begin: time.Now(), waitGuard: &sync.Mutex{}})
+}
+
+// observeOp records the latency of an op begun at start, and logs it if slow
+func (m *Manager) observeOp(op string, tid base.Tid, key base.KeyT, start time.Time) {
+	d := time.Since(start)
+	opDuration[op].Observe(d.Seconds())
+	if threshold := base.GetConfig().SlowOpThreshold; threshold > 0 && d >= threshold {
+		logger := log.With("slow", "op", "op", op, "tid", tid, "duration", d)
+		if key != "" {
+			logger = logger.With("key", key)
+		}
+		logger.Warning("slow op")
+	}
+}
+
+// startLockWait notes that tid waits for the write lock of key from now on
+func (m *Manager) startLockWait(tid base.Tid, key base.KeyT) time.Time {
+	start := time.Now()
+	if tmp, ok := m.tid2stat.Load(tid); ok {
+		stat := tmp.(*txnStat)
+		stat.waitGuard.Lock()
+		stat.waitKey, stat.waitStart = key, start
+		stat.waitGuard.Unlock()
+	}
+	return start
+}
+
+// observeLockWait records the time tid waited for a write lock from start
+func (m *Manager) observeLockWait(tid base.Tid, start time.Time) {
+	d := time.Since(start)
+	lockWait.Observe(d.Seconds())
+	if tmp, ok := m.tid2stat.Load(tid); ok {
+		stat := tmp.(*txnStat)
+		stat.waitGuard.Lock()
+		atomic.AddInt64(&stat.lockWait, int64(d))
+		stat.waitKey, stat.waitStart = "", time.Time{}
+		stat.waitGuard.Unlock()
+	}
+}
+
+// endStat drops the stat of tid when it commits or aborts, and logs the txn
+// if it was open longer than slow_txn_threshold
+func (m *Manager) endStat(tid base.Tid, outcome string) {
+	tmp, ok := m.tid2stat.Load(tid)
+	if !ok {
+		return
+	}
+	m.tid2stat.Delete(tid)
+	threshold := base.GetConfig().SlowTxnThreshold
+	if stat := tmp.(*txnStat); threshold > 0 && time.Since(stat.begin) >= threshold {
+		m.slowTxnLogger(tid, stat).With("outcome", outcome).Warning("slow txn")
+	}
+}
+
+func (m *Manager) slowTxnLogger(tid base.Tid, stat *txnStat) *log.Logger {
+	keys := make([]string, 0)
+	if ws, ok := m.tid2writeSet.Load(tid); ok {
+		ws.(*sync.Map).Range(func(key, value interface{}) bool {
+			keys = append(keys, string(key.(base.KeyT)))
+			return true
+		})
+	}
+	sort.Strings(keys)
+	count := len(keys)
+	if count > slowLockedKeys {
+		keys = keys[:slowLockedKeys]
+	}
+	stat.waitGuard.Lock()
+	waited := time.Duration(atomic.LoadInt64(&stat.lockWait))
+	waitKey := stat.waitKey
+	if !stat.waitStart.IsZero() {
+		waited += time.Since(stat.waitStart)
+	}
+	stat.waitGuard.Unlock()
+
+	logger := log.With("slow", "txn", "tid", tid,
+		"duration", time.Since(stat.begin),
+		"ops", GetUndoLoggerInstance().OpCount(tid),
+		"lock_wait", waited,
+		"locked_keys", count, "locked", keys)
+	if waitKey != "" {
+		logger = logger.With("waiting_for", waitKey)
+	}
+	return logger
+}
+
+// slowLoop logs every txn once it is open longer than threshold, while it
+// still holds its locks, so a txn starving others shows up before it ends
+func (m *Manager) slowLoop(threshold time.Duration) {
+	tick := threshold / 2
+	if tick < minSlowTick {
+		tick = minSlowTick
+	}
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+		}
+		m.tid2stat.Range(func(key, value interface{}) bool {
+			stat := value.(*txnStat)
+			if time.Since(stat.begin) >= threshold && atomic.CompareAndSwapInt32(&stat.reported, 0, 1) {
+				m.slowTxnLogger(key.(base.Tid), stat).Warning("slow txn still open")
+			}
+			return true
+		})
+	}
+}
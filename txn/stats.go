@@ -0,0 +1,17 @@
+package txn
+
+import "stupid-kv/base"
+
+type Stats struct {
+	CurTid     base.Tid
+	ActiveTids []base.Tid
+}
+
+func (m *Manager) Stats() Stats {
+	m.tidsGuard.Lock()
+	defer m.tidsGuard.Unlock()
+	return Stats{
+		CurTid:     m.curTid,
+		ActiveTids: append([]base.Tid{}, m.curActiveTids...),
+	}
+}
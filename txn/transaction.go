@@ -1,11 +1,13 @@
 package txn
 
 import (
+	"runtime"
 	"stupid-kv/base"
 	"stupid-kv/kv"
 	log "stupid-kv/logutil"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 type Manager struct {
@@ -20,11 +22,37 @@ type Manager struct {
 
 	tid2writeSet *sync.Map
 	key2lock     *sync.Map // used for protect write-write conflict
+	tid2stat     *sync.Map // open txns for the slow log
+
+	listenersGuard *sync.Mutex
+	listeners      map[int]CommitListener
+	nextListenerId int
+	replicator     Replicator
+
+	replicatingGuard *sync.Mutex
+	replicating      map[base.Tid]replicaState // local txns whose writes are replicated
+
+	preparedGuard *sync.Mutex
+	prepared      map[base.Tid][]Write // writes of the txns prepared by 2pc
+
+	recovery RecoveryReport
+
+	stop     chan struct{} // ends gcLoop and slowLoop
+	stopOnce *sync.Once
 }
 
 var instance *Manager
 var once sync.Once
 
+// startHooks run once the manager has recovered, before any txn begins
+var startHooks []func(m *Manager)
+
+// OnStart registers fn to run when the manager starts, from an init func,
+// e.g. to add a commit listener that must not miss a commit
+func OnStart(fn func(m *Manager)) {
+	startHooks = append(startHooks, fn)
+}
+
 func GetManagerInstance() *Manager {
 	once.Do(func() {
 		log.Info("Transaction manager starts to init")
@@ -37,12 +65,43 @@ func GetManagerInstance() *Manager {
 
 			tid2writeSet: &sync.Map{},
 			key2lock:     &sync.Map{},
+			tid2stat:     &sync.Map{},
+
+			listenersGuard: &sync.Mutex{},
+			listeners:      make(map[int]CommitListener),
+
+			replicatingGuard: &sync.Mutex{},
+			replicating:      make(map[base.Tid]replicaState),
+
+			preparedGuard: &sync.Mutex{},
+			prepared:      make(map[base.Tid][]Write),
+
+			stop:     make(chan struct{}),
+			stopOnce: &sync.Once{},
 		}
 		instance.Load()
+		instance.recover()
+		instance.loadPrepared()
+		for _, fn := range startHooks {
+			fn(instance)
+		}
+		if interval := base.GetConfig().GCInterval; interval > 0 {
+			go instance.gcLoop(interval)
+		}
+		if threshold := base.GetConfig().SlowTxnThreshold; threshold > 0 {
+			go instance.slowLoop(threshold)
+		}
 	})
 	return instance
 }
 
+// Stop ends the background gc and slow txn loops, txns still work
+func (m *Manager) Stop() {
+	m.stopOnce.Do(func() {
+		close(m.stop)
+	})
+}
+
 func (m *Manager) GetCurrentTid() base.Tid {
 	return m.curTid
 }
@@ -64,7 +123,9 @@ func (m *Manager) BeginTxn() base.Tid {
 	m.tidsGuard.Unlock()
 
 	m.tid2writeSet.Store(newTid, &sync.Map{})
-	log.Infof("txn %v start", newTid)
+	m.startStat(newTid)
+	txnBegins.Inc()
+	log.With("tid", newTid).Info("txn start")
 	return newTid
 }
 
@@ -78,27 +139,75 @@ func remove(l []base.Tid, item base.Tid) []base.Tid {
 }
 
 func (m *Manager) CommitTxn(tid base.Tid) error {
+	defer m.observeOp("commit", tid, "", time.Now())
+	keys, ok := m.writeSetOf(tid)
+	if !ok {
+		log.With("tid", tid).Error("commit of a txn that does not exist")
+		return ErrorTxnNotExist
+	}
+	if m.InDoubt(tid) {
+		return ErrorOutcomeUnknown
+	}
+	writes := m.writesOf(tid, keys)
+	if m.replicator != nil && len(writes) > 0 {
+		if err := m.replicate(tid, writes); err != nil {
+			return err
+		}
+	}
+	m.finishCommit(tid, keys, writes)
+	return nil
+}
+
+// writeSetOf returns the keys tid locked to write
+func (m *Manager) writeSetOf(tid base.Tid) ([]base.KeyT, bool) {
+	ws, ok := m.tid2writeSet.Load(tid)
+	if !ok {
+		return nil, false
+	}
+	keys := make([]base.KeyT, 0)
+	ws.(*sync.Map).Range(func(key, value interface{}) bool {
+		keys = append(keys, key.(base.KeyT))
+		return true
+	})
+	return keys, true
+}
+
+// finishCommit makes the writes of tid visible and releases its locks
+func (m *Manager) finishCommit(tid base.Tid, keys []base.KeyT, writes []Write) {
 	m.tidsGuard.Lock()
 	m.curActiveTids = remove(m.curActiveTids, tid)
 	m.FlushTid()
 	m.tidsGuard.Unlock()
 	kv.GetManagerInstance().Flush()
-	log.Infof("txn %v commit", tid)
+	m.unprepare(tid)
+	log.With("tid", tid, "keys", len(keys)).Info("txn commit")
 	m.commitTidMap.Store(tid, true)
-	if ws, ok := m.tid2writeSet.Load(tid); ok {
-		ws.(*sync.Map).Range(func(key, value interface{}) bool {
-			m.releaseWriteLock(key.(base.KeyT), tid)
-			return true
-		})
-	} else {
-		log.Error("txn not exist")
+	// notify before releasing, so listeners see the writes of a key in commit order
+	m.notifyCommit(tid, writes)
+	for _, key := range keys {
+		m.releaseWriteLock(key, tid)
 	}
+	m.endStat(tid, "commit")
 	m.tid2writeSet.Delete(tid)
+	txnCommits.Inc()
+}
 
+func (m *Manager) AbortTxn(tid base.Tid) error {
+	defer m.observeOp("abort", tid, "", time.Now())
+	ws, ok := m.tid2writeSet.Load(tid)
+	if !ok {
+		log.With("tid", tid).Error("abort of a txn that does not exist")
+		return ErrorTxnNotExist
+	}
+	if m.InDoubt(tid) {
+		return ErrorOutcomeUnknown
+	}
+	m.abort(tid, ws.(*sync.Map))
 	return nil
 }
 
-func (m *Manager) AbortTxn(tid base.Tid) error {
+func (m *Manager) abort(tid base.Tid, ws *sync.Map) {
+	m.unprepare(tid)
 	m.tidsGuard.Lock()
 	m.curActiveTids = remove(m.curActiveTids, tid)
 	m.FlushTid()
@@ -110,22 +219,22 @@ func (m *Manager) AbortTxn(tid base.Tid) error {
 
 	kv.GetManagerInstance().Flush()
 
-	if ws, ok := m.tid2writeSet.Load(tid); ok {
-		ws.(*sync.Map).Range(func(key, value interface{}) bool {
-			m.releaseWriteLock(key.(base.KeyT), tid)
-			return true
-		})
-	} else {
-		log.Error("txn not exist")
-	}
+	ws.Range(func(key, value interface{}) bool {
+		m.releaseWriteLock(key.(base.KeyT), tid)
+		return true
+	})
+	m.endStat(tid, "abort")
 	m.tid2writeSet.Delete(tid)
-	log.Infof("txn %v abort", tid)
-	return nil
+	txnAborts.Inc()
+	log.With("tid", tid).Info("txn abort")
 }
 
 func (m *Manager) Put(key base.KeyT, value base.ValueT, tid base.Tid) error {
+	defer m.observeOp("put", tid, key, time.Now())
 	kvStore := kv.GetManagerInstance()
-	m.acquireWriteLock(key, tid)
+	if err := m.acquireWriteLock(key, tid); err != nil {
+		return err
+	}
 	kvStore.Put(key, value, tid)
 	GetUndoLoggerInstance().AppendOp(tid, TxnOp{
 		op:  opPut,
@@ -135,33 +244,65 @@ func (m *Manager) Put(key base.KeyT, value base.ValueT, tid base.Tid) error {
 	return nil
 }
 
+func (m *Manager) activeTids() []base.Tid {
+	m.tidsGuard.Lock()
+	defer m.tidsGuard.Unlock()
+	return append([]base.Tid{}, m.curActiveTids...)
+}
+
+// IsActive tells if tid began and has not committed or aborted yet
+func (m *Manager) IsActive(tid base.Tid) bool {
+	m.tidsGuard.Lock()
+	defer m.tidsGuard.Unlock()
+	for _, t := range m.curActiveTids {
+		if t == tid {
+			return true
+		}
+	}
+	return false
+}
+
 func (m *Manager) Get(key base.KeyT, tid base.Tid) base.ValueT {
+	defer m.observeOp("get", tid, key, time.Now())
+	ret, _ := m.getVersion(key, tid)
+	return ret
+}
+
+// getVersion returns the value key has at tid and the tid that wrote it
+func (m *Manager) getVersion(key base.KeyT, tid base.Tid) (base.ValueT, base.Tid) {
 	kvStore := kv.GetManagerInstance()
 
-	ret, waitTid := kvStore.Get(key, tid, m.curActiveTids)
+	ret, waitTid := kvStore.Get(key, tid, m.activeTids())
 
 	if ret == base.VALUE_NOT_COMMIT {
-		// wait until value is commit
-		log.Infof("tid %v: read uncommitted value and wait %v", tid, waitTid)
-		for {
-			if _, ok := m.commitTidMap.Load(waitTid); ok {
-				if ret, waitTid = kvStore.Get(key, tid, m.curActiveTids); ret == base.VALUE_NOT_COMMIT {
-					log.Infof("tid %v: read uncommitted value and wait %v", tid, waitTid)
+		// wait until value is committed or aborted
+		log.With("tid", tid, "key", key, "wait", waitTid).Info("read uncommitted value, wait")
+		for spins := 1; ; spins++ {
+			if !m.IsActive(waitTid) {
+				if ret, waitTid = kvStore.Get(key, tid, m.activeTids()); ret == base.VALUE_NOT_COMMIT {
+					log.With("tid", tid, "key", key, "wait", waitTid).Info("read uncommitted value, wait")
 				} else {
-					return ret
+					uncommittedSpins.Observe(float64(spins))
+					return ret, waitTid
 				}
 			}
+			runtime.Gosched()
 		}
 
 	}
 
-	return ret
+	return ret, waitTid
 }
 
 func (m *Manager) Inc(key base.KeyT, tid base.Tid) error {
+	defer m.observeOp("inc", tid, key, time.Now())
 	kvStore := kv.GetManagerInstance()
-	m.acquireWriteLock(key, tid)
-	kvStore.Inc(key, tid)
+	if err := m.acquireWriteLock(key, tid); err != nil {
+		return err
+	}
+	if kvStore.Inc(key, tid) == base.VALUE_NOT_FOUND {
+		return ErrorKeyNotFound
+	}
 
 	GetUndoLoggerInstance().AppendOp(tid, TxnOp{
 		op:  opInc,
@@ -172,9 +313,14 @@ func (m *Manager) Inc(key base.KeyT, tid base.Tid) error {
 }
 
 func (m *Manager) Dec(key base.KeyT, tid base.Tid) error {
+	defer m.observeOp("dec", tid, key, time.Now())
 	kvStore := kv.GetManagerInstance()
-	m.acquireWriteLock(key, tid)
-	kvStore.Dec(key, tid)
+	if err := m.acquireWriteLock(key, tid); err != nil {
+		return err
+	}
+	if kvStore.Dec(key, tid) == base.VALUE_NOT_FOUND {
+		return ErrorKeyNotFound
+	}
 
 	GetUndoLoggerInstance().AppendOp(tid, TxnOp{
 		op:  opDec,
@@ -185,8 +331,11 @@ func (m *Manager) Dec(key base.KeyT, tid base.Tid) error {
 }
 
 func (m *Manager) Del(key base.KeyT, tid base.Tid) error {
+	defer m.observeOp("del", tid, key, time.Now())
 	kvStore := kv.GetManagerInstance()
-	m.acquireWriteLock(key, tid)
+	if err := m.acquireWriteLock(key, tid); err != nil {
+		return err
+	}
 	kvStore.Del(key, tid)
 
 	GetUndoLoggerInstance().AppendOp(tid, TxnOp{
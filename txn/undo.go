@@ -51,6 +51,13 @@ func (logger *UndoLogger) AppendOp(tid base.Tid, op TxnOp) {
 
 }
 
+// OpCount counts the ops tid logged
+func (logger *UndoLogger) OpCount(tid base.Tid) int {
+	logger.guard.Lock()
+	defer logger.guard.Unlock()
+	return len(logger.txnOps[tid])
+}
+
 func (logger *UndoLogger) GetTidOps(tid base.Tid) []TxnOp {
 	if ops, ok := logger.txnOps[tid]; ok {
 		return ops
@@ -0,0 +1,134 @@
+package txn
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"stupid-kv/base"
+	"stupid-kv/kv"
+	log "stupid-kv/logutil"
+	"sync"
+)
+
+// watchBuffer is how many changes a slow watcher may lag behind before it is dropped
+const watchBuffer = 1024
+
+// WatchNow starts a watcher at the next commit, without history
+const WatchNow base.Tid = -1
+
+// Change is a committed write seen by a watcher, Value is VALUE_NOT_FOUND for a delete.
+type Change struct {
+	Tid   base.Tid
+	Key   base.KeyT
+	Value base.ValueT
+}
+
+// Watch sends the changes of key committed from now on, until ctx is done.
+func (m *Manager) Watch(ctx context.Context, key base.KeyT) <-chan Change {
+	return m.WatchFrom(ctx, key, false, WatchNow)
+}
+
+// WatchPrefix sends the changes of every key starting with prefix.
+func (m *Manager) WatchPrefix(ctx context.Context, prefix base.KeyT) <-chan Change {
+	return m.WatchFrom(ctx, prefix, true, WatchNow)
+}
+
+// WatchFrom first sends the retained versions committed by tids >= from in
+// tid order, then follows new commits. History older than the gc watermark is
+// gone, so a past watcher only sees what gc kept. The channel is closed when
+// ctx is done, or early if the watcher lags too far behind; it can watch
+// again from the last tid it got.
+func (m *Manager) WatchFrom(ctx context.Context, key base.KeyT, prefix bool, from base.Tid) <-chan Change {
+	match := func(k base.KeyT) bool {
+		return k == key || prefix && strings.HasPrefix(string(k), string(key))
+	}
+
+	// listen before reading the history, so no commit falls in between
+	live := make(chan Change, watchBuffer)
+	lagged := make(chan struct{})
+	var once sync.Once
+	id := m.AddCommitListener(func(tid base.Tid, writes []Write) {
+		for _, w := range writes {
+			if !match(w.Key) {
+				continue
+			}
+			select {
+			case live <- Change{tid, w.Key, w.Value}:
+			default: // never block a commit on a slow watcher
+				once.Do(func() { close(lagged) })
+			}
+		}
+	})
+
+	history := make([]Change, 0)
+	if from != WatchNow {
+		history = m.retained(key, prefix, match, from)
+	}
+	sent := make(map[Change]bool, len(history))
+	for _, c := range history {
+		sent[c] = true
+	}
+
+	out := make(chan Change)
+	go func() {
+		defer close(out)
+		defer m.RemoveCommitListener(id)
+		send := func(c Change) bool {
+			select {
+			case out <- c:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+		for _, c := range history {
+			if !send(c) {
+				return
+			}
+		}
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-lagged:
+				log.Warningf("watcher of %v falls too far behind, drop it", key)
+				return
+			case c := <-live:
+				if sent[c] { // committed while the history was read
+					continue
+				}
+				if !send(c) {
+					return
+				}
+			}
+		}
+	}()
+	return out
+}
+
+// retained returns the committed versions of the matched keys with begin >= from
+func (m *Manager) retained(key base.KeyT, prefix bool, match func(base.KeyT) bool, from base.Tid) []Change {
+	store := kv.GetManagerInstance()
+	keys := []base.KeyT{key}
+	if prefix {
+		keys = keys[:0]
+		for _, k := range store.Keys(key, "") {
+			if !match(k) {
+				break
+			}
+			keys = append(keys, k)
+		}
+	}
+
+	active := m.Stats().ActiveTids
+	changes := make([]Change, 0)
+	for _, k := range keys {
+		for _, v := range store.History(k) {
+			if v.Begin >= from && !containsTid(active, v.Begin) {
+				changes = append(changes, Change{v.Begin, k, v.Value})
+			}
+		}
+	}
+	sort.SliceStable(changes, func(i, j int) bool { return changes[i].Tid < changes[j].Tid })
+	return changes
+}